@@ -0,0 +1,1271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/markbates/pkger"
+)
+
+// apiPrefix is the path of the version 1 of the REST API
+const apiPrefix = "/api/v1"
+
+// apiMaxPerPage limit the per_page parameter of the lists
+const apiMaxPerPage = 200
+
+// APIList is the answer of the list routes
+type APIList struct {
+	Data  interface{} `json:"data"`
+	Meta  APIMeta     `json:"meta"`
+	Links APILinks    `json:"links"`
+}
+
+// APIMeta is the pagination of a list
+type APIMeta struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+	Pages   int `json:"pages"`
+}
+
+// APILinks are the pagination links of a list
+type APILinks struct {
+	Self  string `json:"self"`
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
+// APIBook is a book in the API
+type APIBook struct {
+	ID           uint        `json:"id"`
+	Title        string      `json:"title"`
+	Description  string      `json:"description"`
+	Isbn         string      `json:"isbn"`
+	Language     string      `json:"language"`
+	Publisher    string      `json:"publisher"`
+	Collection   string      `json:"collection"`
+	Published    string      `json:"published,omitempty"`
+	Series       *APISeries  `json:"series"`
+	SeriesNumber float32     `json:"series_number"`
+	Authors      []APIAuthor `json:"authors"`
+	Tags         []APITag    `json:"tags"`
+	Files        []APIFile   `json:"files"`
+	Cover        APICover    `json:"cover"`
+	Favorite     bool        `json:"favorite"`
+	Read         bool        `json:"read"`
+	Progress     float32     `json:"progress"`
+	Edited       bool        `json:"edited"`
+	CreatedAt    time.Time   `json:"created_at"`
+	UpdatedAt    time.Time   `json:"updated_at"`
+}
+
+// APICover are the urls of the cover of a book, a placeholder when it has none
+type APICover struct {
+	URL       string `json:"url"`
+	Medium    string `json:"medium"`
+	Thumbnail string `json:"thumbnail"`
+	Generated bool   `json:"generated"`
+}
+
+// APIAuthor is an author in the API
+type APIAuthor struct {
+	ID        uint       `json:"id"`
+	Name      string     `json:"name"`
+	SortName  string     `json:"sort_name"`
+	BookCount *int       `json:"book_count,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// APITag is a tag in the API
+type APITag struct {
+	ID        uint       `json:"id"`
+	Name      string     `json:"name"`
+	ParentID  uint       `json:"parent_id"`
+	BookCount *int       `json:"book_count,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// APISeries is a series in the API
+type APISeries struct {
+	ID          uint       `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	BookCount   *int       `json:"book_count,omitempty"`
+	Missing     []int      `json:"missing,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// APIFile is a file of a book in the API
+type APIFile struct {
+	ID        uint      `json:"id"`
+	BookID    uint      `json:"book_id"`
+	Format    string    `json:"format"`
+	MediaType string    `json:"media_type"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// APIJob is a background job in the API, the upload routes answer the import job
+type APIJob struct {
+	ID         uint       `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	BookID     uint       `json:"book_id,omitempty"`
+	Progress   int        `json:"progress"`
+	Error      string     `json:"error,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// APISettings are the settings in the API, the secrets are never sent
+type APISettings struct {
+	Name            string `json:"name"`
+	BaseURL         string `json:"base_url"`
+	Port            int    `json:"port"`
+	PerPage         int    `json:"per_page"`
+	JobWorkers      int    `json:"job_workers"`
+	InboxDir        string `json:"inbox_dir"`
+	DuplicatePolicy string `json:"duplicate_policy"`
+	ReadThreshold   int    `json:"read_threshold"`
+	EmbedMetadata   bool   `json:"embed_metadata"`
+	TagSeparator    string `json:"tag_separator"`
+	SMTPHost        string `json:"smtp_host"`
+	SMTPPort        int    `json:"smtp_port"`
+	SMTPUser        string `json:"smtp_user"`
+	SMTPPasswordSet bool   `json:"smtp_password_set"`
+	SMTPFrom        string `json:"smtp_from"`
+}
+
+// apiBookPatch is the body of a book update, only the fields sent are changed
+type apiBookPatch struct {
+	Title        *string   `json:"title"`
+	Description  *string   `json:"description"`
+	Isbn         *string   `json:"isbn"`
+	Language     *string   `json:"language"`
+	Publisher    *string   `json:"publisher"`
+	Collection   *string   `json:"collection"`
+	Published    *string   `json:"published"`
+	Series       *string   `json:"series"`
+	SeriesNumber *float32  `json:"series_number"`
+	Authors      *[]string `json:"authors"`
+	Tags         *[]string `json:"tags"`
+	Favorite     *bool     `json:"favorite"`
+	Read         *bool     `json:"read"`
+}
+
+// apiNamePatch is the body of the author, tag and series routes
+type apiNamePatch struct {
+	Name        *string `json:"name"`
+	SortName    *string `json:"sort_name"`
+	Description *string `json:"description"`
+}
+
+// apiSettingsPatch is the body of a settings update
+type apiSettingsPatch struct {
+	Name            *string `json:"name"`
+	BaseURL         *string `json:"base_url"`
+	Port            *int    `json:"port"`
+	PerPage         *int    `json:"per_page"`
+	JobWorkers      *int    `json:"job_workers"`
+	InboxDir        *string `json:"inbox_dir"`
+	DuplicatePolicy *string `json:"duplicate_policy"`
+	ReadThreshold   *int    `json:"read_threshold"`
+	EmbedMetadata   *bool   `json:"embed_metadata"`
+	TagSeparator    *string `json:"tag_separator"`
+	SMTPHost        *string `json:"smtp_host"`
+	SMTPPort        *int    `json:"smtp_port"`
+	SMTPUser        *string `json:"smtp_user"`
+	SMTPPassword    *string `json:"smtp_password"`
+	SMTPFrom        *string `json:"smtp_from"`
+}
+
+// apiBatch is the body of an action on several books
+type apiBatch struct {
+	Action string `json:"action"`
+	Value  string `json:"value"`
+	Books  []uint `json:"books"`
+}
+
+type apiSend struct {
+	DeviceID uint `json:"device_id"`
+}
+
+// isAPIRequest return true for the REST API routes
+func isAPIRequest(req *http.Request) bool {
+	return req.URL.Path == apiPrefix || strings.HasPrefix(req.URL.Path, apiPrefix+"/")
+}
+
+// apiToken return the client token sent as bearer token or in the query
+func apiToken(req *http.Request) string {
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return req.URL.Query().Get("token")
+}
+
+// writeAPI write the value as json with the status
+func writeAPI(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(status)
+
+	encoder := json.NewEncoder(res)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// writeAPIError write a json error
+func writeAPIError(res http.ResponseWriter, status int, message string) {
+	writeAPI(res, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"status":  status,
+			"message": message,
+		},
+	})
+}
+
+func apiMethodNotAllowed(res http.ResponseWriter, allowed ...string) {
+	res.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(res, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func apiNotFoundHandler(res http.ResponseWriter, req *http.Request) {
+	writeAPIError(res, http.StatusNotFound, "not found")
+}
+
+// readAPIBody decode the json body of the request, unknown fields are refused
+func readAPIBody(req *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errors.New("invalid json body: " + err.Error())
+	}
+	return nil
+}
+
+// apiPagination read the page and per_page parameters
+func apiPagination(req *http.Request) (int, int, error) {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	page, perPage := 1, serverOption.NumberBookPerPage
+	query := req.URL.Query()
+	if value := query.Get("page"); value != "" {
+		var err error
+		page, err = strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return 0, 0, errors.New("invalid page")
+		}
+	}
+	if value := query.Get("per_page"); value != "" {
+		var err error
+		perPage, err = strconv.Atoi(value)
+		if err != nil || perPage < 1 || perPage > apiMaxPerPage {
+			return 0, 0, errors.New("per_page must be between 1 and " + strconv.Itoa(apiMaxPerPage))
+		}
+	}
+	if perPage < 1 {
+		perPage = 20
+	}
+	return page, perPage, nil
+}
+
+// apiList build the answer of a list with its pagination
+func apiList(req *http.Request, data interface{}, page int, perPage int, total int) APIList {
+	first, prev, next, last := paginationLinks(req.URL, page, perPage, total)
+	self := *req.URL
+	query := self.Query()
+	query.Del("token")
+	self.RawQuery = query.Encode()
+	return APIList{
+		Data:  data,
+		Meta:  APIMeta{Page: page, PerPage: perPage, Total: total, Pages: int(math.Ceil(float64(total) / float64(perPage)))},
+		Links: APILinks{Self: self.String(), First: stripToken(first), Prev: stripToken(prev), Next: stripToken(next), Last: stripToken(last)},
+	}
+}
+
+// stripToken remove the token of the query from a link, clients send it in a header
+func stripToken(link string) string {
+	if link == "" {
+		return ""
+	}
+	linkURL, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	query := linkURL.Query()
+	query.Del("token")
+	linkURL.RawQuery = query.Encode()
+	return linkURL.String()
+}
+
+// apiID return the id of the route, 0 when it is not a number
+func apiID(req *http.Request, name string) uint {
+	id, _ := strconv.ParseUint(mux.Vars(req)[name], 10, 64)
+	return uint(id)
+}
+
+func intPtr(value int) *int {
+	return &value
+}
+
+func timePtr(value time.Time) *time.Time {
+	return &value
+}
+
+// apiBookFrom return the book for the API, with its relations and the state of the user
+func apiBookFrom(book Book, userID uint) APIBook {
+	var files []BookFile
+
+	if book.Authors == nil {
+		db.Model(&book).Related(&book.Authors, "Authors")
+	}
+	db.Model(&book).Related(&book.Tags, "Tags")
+	db.Where("book_id = ?", book.ID).Order("id asc").Find(&files)
+	if userID != 0 {
+		state := userBook(userID, book.ID)
+		book.Favorite, book.Read, book.Progress = state.Favorite, state.Read, state.Progress
+	}
+
+	apiBook := APIBook{
+		ID:           book.ID,
+		Title:        book.Title,
+		Description:  book.Description,
+		Isbn:         book.Isbn,
+		Language:     book.Language,
+		Publisher:    book.Publisher,
+		Collection:   book.Collection,
+		Published:    book.PublishedDate(),
+		SeriesNumber: book.SerieNumber,
+		Authors:      []APIAuthor{},
+		Tags:         []APITag{},
+		Files:        []APIFile{},
+		Cover: APICover{
+			URL:       book.ImageURL(),
+			Medium:    book.MediumURL(),
+			Thumbnail: book.ThumbnailURL(),
+			Generated: book.CoverDownloadURL() == "",
+		},
+		Favorite:  book.Favorite,
+		Read:      book.Read,
+		Progress:  book.Progress,
+		Edited:    book.Edited,
+		CreatedAt: book.CreatedAt,
+		UpdatedAt: book.UpdatedAt,
+	}
+	if book.SeriesID != 0 {
+		apiBook.Series = &APISeries{ID: book.SeriesID, Name: book.Serie}
+	}
+	for _, author := range book.Authors {
+		apiBook.Authors = append(apiBook.Authors, APIAuthor{ID: author.ID, Name: author.Name, SortName: author.SortName})
+	}
+	for _, tag := range book.Tags {
+		apiBook.Tags = append(apiBook.Tags, APITag{ID: tag.ID, Name: tag.Name})
+	}
+	for _, file := range files {
+		apiBook.Files = append(apiBook.Files, apiFileFrom(book, file))
+	}
+	return apiBook
+}
+
+func apiFileFrom(book Book, file BookFile) APIFile {
+	return APIFile{
+		ID:        file.ID,
+		BookID:    file.BookID,
+		Format:    file.Format,
+		MediaType: file.MediaType,
+		Size:      file.Size,
+		Checksum:  file.Checksum,
+		URL:       book.FormatDownloadURL(file.Format),
+		CreatedAt: file.CreatedAt,
+		UpdatedAt: file.UpdatedAt,
+	}
+}
+
+func apiJobFrom(job Job) APIJob {
+	return APIJob{
+		ID:         job.ID,
+		Kind:       job.Kind,
+		Status:     job.Status,
+		BookID:     job.BookID,
+		Progress:   job.Progress,
+		Error:      job.Error,
+		Message:    job.Message,
+		CreatedAt:  job.CreatedAt,
+		StartedAt:  job.StartedAt,
+		FinishedAt: job.FinishedAt,
+	}
+}
+
+func apiSettingsFrom(serverOption ServerOption) APISettings {
+	return APISettings{
+		Name:            serverOption.Name,
+		BaseURL:         serverOption.BaseURL,
+		Port:            serverOption.Port,
+		PerPage:         serverOption.NumberBookPerPage,
+		JobWorkers:      serverOption.JobWorkers,
+		InboxDir:        serverOption.InboxDir,
+		DuplicatePolicy: serverOption.DuplicatePolicy,
+		ReadThreshold:   serverOption.ReadThreshold,
+		EmbedMetadata:   serverOption.EmbedMetadata,
+		TagSeparator:    serverOption.TagSeparator,
+		SMTPHost:        serverOption.SMTPHost,
+		SMTPPort:        serverOption.SMTPPort,
+		SMTPUser:        serverOption.SMTPUser,
+		SMTPPasswordSet: serverOption.SMTPPassword != "",
+		SMTPFrom:        serverOption.SMTPFrom,
+	}
+}
+
+// apiIndexHandler list the resources of the API
+func apiIndexHandler(res http.ResponseWriter, req *http.Request) {
+	writeAPI(res, http.StatusOK, map[string]string{
+		"books":    apiPrefix + "/books",
+		"authors":  apiPrefix + "/authors",
+		"tags":     apiPrefix + "/tags",
+		"series":   apiPrefix + "/series",
+		"settings": apiPrefix + "/settings",
+		"openapi":  apiPrefix + "/openapi.json",
+	})
+}
+
+// apiOpenAPIHandler serve the description of the API
+func apiOpenAPIHandler(res http.ResponseWriter, req *http.Request) {
+	file, err := pkger.Open("/template/openapi.json")
+	if err != nil {
+		writeAPIError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer file.Close()
+	data, _ := ioutil.ReadAll(file)
+
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.Write(data)
+}
+
+// apiBooksHandler list the books with the filters of the feeds, or upload a new book
+func apiBooksHandler(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		var books []Book
+		var total int
+
+		page, perPage, err := apiPagination(req)
+		if err != nil {
+			writeAPIError(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		user := currentUser(req)
+		query := req.URL.Query()
+		books, total = bookList(query, user.ID, perPage, (page-1)*perPage)
+		data := make([]APIBook, 0, len(books))
+		for _, book := range books {
+			data = append(data, apiBookFrom(book, user.ID))
+		}
+		writeAPI(res, http.StatusOK, apiList(req, data, page, perPage, total))
+	case http.MethodPost:
+		filePath, err := saveUpload(req, "file")
+		if err != nil {
+			writeAPIError(res, http.StatusBadRequest, "file: "+err.Error())
+			return
+		}
+		job := enqueueJob(jobImport, filePath, 0)
+		res.Header().Set("Location", apiPrefix+"/jobs/"+strconv.Itoa(int(job.ID)))
+		writeAPI(res, http.StatusAccepted, apiJobFrom(job))
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPost)
+	}
+}
+
+// apiBookHandler get, update or delete a book
+func apiBookHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+
+	db.Find(&book, apiID(req, "id"))
+	if book.ID == 0 {
+		writeAPIError(res, http.StatusNotFound, "book not found")
+		return
+	}
+	user := currentUser(req)
+
+	switch req.Method {
+	case http.MethodGet:
+		writeAPI(res, http.StatusOK, apiBookFrom(book, user.ID))
+	case http.MethodPatch:
+		var patch apiBookPatch
+		if err := readAPIBody(req, &patch); err != nil {
+			writeAPIError(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := patchBook(&book, patch, user.ID); err != nil {
+			writeAPIError(res, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		book.Authors = nil
+		writeAPI(res, http.StatusOK, apiBookFrom(book, user.ID))
+	case http.MethodDelete:
+		db.Delete(&book)
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// patchBook change the fields of the book sent in the patch, the book is then marked as edited
+func patchBook(book *Book, patch apiBookPatch, userID uint) error {
+	if patch.Title != nil && strings.TrimSpace(*patch.Title) == "" {
+		return errors.New("title can't be empty")
+	}
+	var published *time.Time
+	if patch.Published != nil && *patch.Published != "" {
+		date, err := time.Parse("2006-01-02", *patch.Published)
+		if err != nil {
+			return errors.New("published must be a YYYY-MM-DD date")
+		}
+		published = &date
+	}
+
+	setString := func(field *string, value *string) {
+		if value != nil {
+			*field = strings.TrimSpace(*value)
+		}
+	}
+	setString(&book.Title, patch.Title)
+	setString(&book.Description, patch.Description)
+	setString(&book.Isbn, patch.Isbn)
+	setString(&book.Language, patch.Language)
+	setString(&book.Publisher, patch.Publisher)
+	setString(&book.Collection, patch.Collection)
+	if patch.Published != nil {
+		book.PublishedAt = published
+	}
+	if patch.Series != nil {
+		book.Serie = *patch.Series
+		book.linkSeries()
+	}
+	if patch.SeriesNumber != nil {
+		book.SerieNumber = *patch.SeriesNumber
+	}
+	if patch.Authors != nil {
+		var authors []Author
+		for _, name := range *patch.Authors {
+			if strings.TrimSpace(name) != "" {
+				authors = append(authors, findOrCreateAuthor(name, ""))
+			}
+		}
+		db.Model(book).Association("Authors").Clear()
+		book.Authors = authors
+	}
+	if patch.Tags != nil {
+		var tags []Tag
+		db.Unscoped().Where("book_id = ?", book.ID).Delete(BookTag{})
+		for _, name := range *patch.Tags {
+			if tag := findOrCreateTag(name); tag.ID != 0 {
+				tags = append(tags, tag)
+			}
+		}
+		book.Tags = tags
+	}
+	edited := patch.Title != nil || patch.Description != nil || patch.Isbn != nil || patch.Language != nil ||
+		patch.Publisher != nil || patch.Collection != nil || patch.Published != nil || patch.Series != nil ||
+		patch.SeriesNumber != nil || patch.Authors != nil || patch.Tags != nil
+	if edited {
+		book.Edited = true
+		if err := db.Save(book).Error; err != nil {
+			return err
+		}
+	}
+
+	if patch.Favorite != nil || patch.Read != nil {
+		state := userBook(userID, book.ID)
+		if patch.Favorite != nil {
+			state.Favorite = *patch.Favorite
+		}
+		if patch.Read != nil && *patch.Read != state.Read {
+			state.Read = *patch.Read
+			if state.Read {
+				state.ReadAt = timePtr(time.Now())
+			}
+		}
+		db.Save(&state)
+	}
+	return nil
+}
+
+// apiBatchHandler do an action on a selection of books and return the summary
+func apiBatchHandler(res http.ResponseWriter, req *http.Request) {
+	var batch apiBatch
+
+	if req.Method != http.MethodPost {
+		apiMethodNotAllowed(res, http.MethodPost)
+		return
+	}
+	if err := readAPIBody(req, &batch); err != nil {
+		writeAPIError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	result, err := runBatch(batch.Action, batch.Value, batch.Books, currentUser(req).ID)
+	if err != nil {
+		writeAPIError(res, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeAPI(res, http.StatusOK, result)
+}
+
+// apiBookFilesHandler list the files of a book, or upload another format
+func apiBookFilesHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+
+	db.Find(&book, apiID(req, "id"))
+	if book.ID == 0 {
+		writeAPIError(res, http.StatusNotFound, "book not found")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		files := book.bookFiles()
+		data := make([]APIFile, 0, len(files))
+		for _, file := range files {
+			data = append(data, apiFileFrom(book, file))
+		}
+		writeAPI(res, http.StatusOK, map[string]interface{}{"data": data})
+	case http.MethodPost:
+		filePath, err := saveUpload(req, "file")
+		if err != nil {
+			writeAPIError(res, http.StatusBadRequest, "file: "+err.Error())
+			return
+		}
+		job := enqueueJob(jobAttach, filePath, book.ID)
+		res.Header().Set("Location", apiPrefix+"/jobs/"+strconv.Itoa(int(job.ID)))
+		writeAPI(res, http.StatusAccepted, apiJobFrom(job))
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPost)
+	}
+}
+
+// apiBookSendHandler queue the delivery of a book to a device of the user
+func apiBookSendHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+	var device Device
+	var send apiSend
+
+	if req.Method != http.MethodPost {
+		apiMethodNotAllowed(res, http.MethodPost)
+		return
+	}
+	db.Find(&book, apiID(req, "id"))
+	if book.ID == 0 {
+		writeAPIError(res, http.StatusNotFound, "book not found")
+		return
+	}
+	if err := readAPIBody(req, &send); err != nil {
+		writeAPIError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	db.Where("user_id = ?", currentUser(req).ID).First(&device, send.DeviceID)
+	if send.DeviceID == 0 || device.ID == 0 {
+		writeAPIError(res, http.StatusNotFound, "device not found")
+		return
+	}
+
+	job := enqueueSend(book.ID, device.ID)
+	res.Header().Set("Location", apiPrefix+"/jobs/"+strconv.Itoa(int(job.ID)))
+	writeAPI(res, http.StatusAccepted, apiJobFrom(job))
+}
+
+// apiFileHandler get or delete a file, the last file of a book can't be deleted
+func apiFileHandler(res http.ResponseWriter, req *http.Request) {
+	var file BookFile
+	var book Book
+
+	db.First(&file, apiID(req, "id"))
+	if file.ID != 0 {
+		db.Find(&book, file.BookID)
+	}
+	if file.ID == 0 || book.ID == 0 {
+		writeAPIError(res, http.StatusNotFound, "file not found")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeAPI(res, http.StatusOK, apiFileFrom(book, file))
+	case http.MethodDelete:
+		var others []BookFile
+		db.Where("book_id = ? AND id <> ?", book.ID, file.ID).Order("id asc").Find(&others)
+		if len(others) == 0 {
+			writeAPIError(res, http.StatusConflict, "the last file of a book can't be deleted, delete the book")
+			return
+		}
+		db.Unscoped().Delete(&file)
+		os.Remove(file.Path)
+		if book.Format == file.Format {
+			// the oldest other file become the main file
+			book.Format = others[0].Format
+			book.MediaType = others[0].MediaType
+			db.Model(&book).UpdateColumns(map[string]interface{}{"format": book.Format, "media_type": book.MediaType})
+		}
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// apiJobHandler give the state of a job, used to follow an upload
+func apiJobHandler(res http.ResponseWriter, req *http.Request) {
+	var job Job
+
+	if req.Method != http.MethodGet {
+		apiMethodNotAllowed(res, http.MethodGet)
+		return
+	}
+	db.First(&job, apiID(req, "id"))
+	if job.ID == 0 {
+		writeAPIError(res, http.StatusNotFound, "job not found")
+		return
+	}
+	writeAPI(res, http.StatusOK, apiJobFrom(job))
+}
+
+// apiCountList run a list query of a table joined to the books, with the number of books of each row
+func apiCountList(table string, join string, search string, order string, limit int, offset int, rows interface{}) int {
+	var total int
+
+	query := db.Table(table).Where(table + ".deleted_at IS NULL")
+	if search != "" {
+		query = query.Where(table+".name LIKE ?", "%"+search+"%")
+	}
+	query.Count(&total)
+	query.Select(table + ".*, count(books.id) AS count").
+		Joins(join).
+		Group(table + ".id").
+		Order(order).
+		Limit(limit).Offset(offset).
+		Scan(rows)
+	return total
+}
+
+// apiAuthorsHandler list the authors or create one
+func apiAuthorsHandler(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		var authors []AuthorCount
+
+		page, perPage, err := apiPagination(req)
+		if err != nil {
+			writeAPIError(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		total := apiCountList("authors",
+			"LEFT JOIN book_authors ON book_authors.author_id = authors.id LEFT JOIN books ON books.id = book_authors.book_id AND books.deleted_at IS NULL",
+			req.URL.Query().Get("q"), "authors.sort_name COLLATE NOCASE asc", perPage, (page-1)*perPage, &authors)
+		data := make([]APIAuthor, 0, len(authors))
+		for _, author := range authors {
+			data = append(data, apiAuthorFrom(author.Author, author.Count))
+		}
+		writeAPI(res, http.StatusOK, apiList(req, data, page, perPage, total))
+	case http.MethodPost:
+		var body apiNamePatch
+		if err := readAPIBody(req, &body); err != nil {
+			writeAPIError(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		if body.Name == nil || strings.TrimSpace(*body.Name) == "" {
+			writeAPIError(res, http.StatusUnprocessableEntity, "name is required")
+			return
+		}
+		var existing Author
+		db.Where("name = ?", strings.TrimSpace(*body.Name)).First(&existing)
+		if existing.ID != 0 {
+			writeAPIError(res, http.StatusConflict, "an author with this name already exists")
+			return
+		}
+		author := Author{Name: strings.TrimSpace(*body.Name)}
+		if body.SortName != nil {
+			author.SortName = strings.TrimSpace(*body.SortName)
+		}
+		db.Save(&author)
+		res.Header().Set("Location", apiPrefix+"/authors/"+strconv.Itoa(int(author.ID)))
+		writeAPI(res, http.StatusCreated, apiAuthorFrom(author, 0))
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPost)
+	}
+}
+
+func apiAuthorFrom(author Author, count int) APIAuthor {
+	return APIAuthor{
+		ID:        author.ID,
+		Name:      author.Name,
+		SortName:  author.SortName,
+		BookCount: intPtr(count),
+		CreatedAt: timePtr(author.CreatedAt),
+		UpdatedAt: timePtr(author.UpdatedAt),
+	}
+}
+
+// apiAuthorHandler get, rename or delete an author, an author with books can't be deleted
+func apiAuthorHandler(res http.ResponseWriter, req *http.Request) {
+	var author Author
+	var count int
+
+	db.First(&author, apiID(req, "id"))
+	if author.ID == 0 {
+		writeAPIError(res, http.StatusNotFound, "author not found")
+		return
+	}
+	db.Model(&Book{}).Joins("INNER JOIN book_authors ON book_authors.book_id = books.id").Where("book_authors.author_id = ?", author.ID).Count(&count)
+
+	switch req.Method {
+	case http.MethodGet:
+		writeAPI(res, http.StatusOK, apiAuthorFrom(author, count))
+	case http.MethodPatch:
+		var body apiNamePatch
+		if err := readAPIBody(req, &body); err != nil || body.Description != nil {
+			writeAPIError(res, http.StatusBadRequest, "invalid json body, name and sort_name can be changed")
+			return
+		}
+		if body.Name != nil {
+			name := strings.TrimSpace(*body.Name)
+			if name == "" {
+				writeAPIError(res, http.StatusUnprocessableEntity, "name can't be empty")
+				return
+			}
+			if name != author.Name {
+				var existing Author
+				db.Where("name = ? AND id <> ?", name, author.ID).First(&existing)
+				if existing.ID != 0 {
+					writeAPIError(res, http.StatusConflict, "an author with this name already exists, merge them from the authors page")
+					return
+				}
+				// the old name stay an alias, like a rename from the author page
+				db.Unscoped().Where("name = ?", author.Name).Delete(AuthorAlias{})
+				db.Save(&AuthorAlias{AuthorID: author.ID, Name: author.Name})
+				author.Name = name
+			}
+		}
+		if body.SortName != nil {
+			author.SortName = strings.TrimSpace(*body.SortName)
+		}
+		db.Save(&author)
+		reindexAuthorBooks(author.ID)
+		writeAPI(res, http.StatusOK, apiAuthorFrom(author, count))
+	case http.MethodDelete:
+		if count > 0 {
+			writeAPIError(res, http.StatusConflict, "the author has books")
+			return
+		}
+		db.Where("author_id = ?", author.ID).Delete(AuthorAlias{})
+		db.Delete(&author)
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// apiTagsHandler list the tags or create one, the book count include the books of the sub tags
+func apiTagsHandler(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		var tags []TagCount
+
+		page, perPage, err := apiPagination(req)
+		if err != nil {
+			writeAPIError(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		search := strings.ToLower(req.URL.Query().Get("q"))
+		for _, tag := range tagCounts(-1) {
+			if strings.Contains(strings.ToLower(tag.Name), search) {
+				tags = append(tags, tag)
+			}
+		}
+		total := len(tags)
+		start := (page - 1) * perPage
+		if start > total {
+			start = total
+		}
+		end := start + perPage
+		if end > total {
+			end = total
+		}
+		data := make([]APITag, 0, end-start)
+		for _, tag := range tags[start:end] {
+			data = append(data, apiTagFrom(tag.Tag, tag.Count))
+		}
+		writeAPI(res, http.StatusOK, apiList(req, data, page, perPage, total))
+	case http.MethodPost:
+		var body apiNamePatch
+		if err := readAPIBody(req, &body); err != nil || body.SortName != nil || body.Description != nil {
+			writeAPIError(res, http.StatusBadRequest, "invalid json body, only name is accepted")
+			return
+		}
+		if body.Name == nil || strings.TrimSpace(*body.Name) == "" {
+			writeAPIError(res, http.StatusUnprocessableEntity, "name is required")
+			return
+		}
+		var existing Tag
+		name := strings.Join(tagSegments(*body.Name, tagSeparator()), tagJoin(tagSeparator()))
+		db.Where("name = ? COLLATE NOCASE", name).First(&existing)
+		if existing.ID != 0 {
+			writeAPIError(res, http.StatusConflict, "a tag with this name already exists")
+			return
+		}
+		tag := findOrCreateTag(name)
+		res.Header().Set("Location", apiPrefix+"/tags/"+strconv.Itoa(int(tag.ID)))
+		writeAPI(res, http.StatusCreated, apiTagFrom(tag, 0))
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPost)
+	}
+}
+
+func apiTagFrom(tag Tag, count int) APITag {
+	return APITag{
+		ID:        tag.ID,
+		Name:      tag.Name,
+		ParentID:  tag.ParentID,
+		BookCount: intPtr(count),
+		CreatedAt: timePtr(tag.CreatedAt),
+		UpdatedAt: timePtr(tag.UpdatedAt),
+	}
+}
+
+// apiTagHandler get, rename or delete a tag, a deleted tag is removed from its books with its sub tags
+func apiTagHandler(res http.ResponseWriter, req *http.Request) {
+	var tag Tag
+	var count int
+
+	db.First(&tag, apiID(req, "id"))
+	if tag.ID == 0 {
+		writeAPIError(res, http.StatusNotFound, "tag not found")
+		return
+	}
+	db.Model(&Book{}).Scopes(BookwithCat(tag.Name)).Count(&count)
+
+	switch req.Method {
+	case http.MethodGet:
+		writeAPI(res, http.StatusOK, apiTagFrom(tag, count))
+	case http.MethodPatch:
+		var body apiNamePatch
+		if err := readAPIBody(req, &body); err != nil || body.SortName != nil || body.Description != nil {
+			writeAPIError(res, http.StatusBadRequest, "invalid json body, only name can be changed")
+			return
+		}
+		if body.Name != nil {
+			var existing Tag
+			name := strings.Join(tagSegments(*body.Name, tagSeparator()), tagJoin(tagSeparator()))
+			db.Where("name = ? COLLATE NOCASE AND id <> ?", name, tag.ID).First(&existing)
+			if existing.ID != 0 {
+				writeAPIError(res, http.StatusConflict, "a tag with this name already exists")
+				return
+			}
+			var err error
+			if tag, err = renameTag(tag, name); err != nil {
+				writeAPIError(res, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+		}
+		writeAPI(res, http.StatusOK, apiTagFrom(tag, count))
+	case http.MethodDelete:
+		deleteTag(tag)
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// apiSeriesListHandler list the series or create one
+func apiSeriesListHandler(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		var series []SeriesCount
+
+		page, perPage, err := apiPagination(req)
+		if err != nil {
+			writeAPIError(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		total := apiCountList("series",
+			"LEFT JOIN books ON books.series_id = series.id AND books.deleted_at IS NULL",
+			req.URL.Query().Get("q"), "series.name COLLATE NOCASE asc", perPage, (page-1)*perPage, &series)
+		data := make([]APISeries, 0, len(series))
+		for _, serie := range series {
+			data = append(data, apiSeriesFrom(serie.Series, serie.Count, nil))
+		}
+		writeAPI(res, http.StatusOK, apiList(req, data, page, perPage, total))
+	case http.MethodPost:
+		var body apiNamePatch
+		if err := readAPIBody(req, &body); err != nil || body.SortName != nil {
+			writeAPIError(res, http.StatusBadRequest, "invalid json body, name and description are accepted")
+			return
+		}
+		if body.Name == nil || strings.TrimSpace(*body.Name) == "" {
+			writeAPIError(res, http.StatusUnprocessableEntity, "name is required")
+			return
+		}
+		var existing Series
+		db.Where("name = ?", strings.TrimSpace(*body.Name)).First(&existing)
+		if existing.ID != 0 {
+			writeAPIError(res, http.StatusConflict, "a series with this name already exists")
+			return
+		}
+		series := Series{Name: strings.TrimSpace(*body.Name)}
+		if body.Description != nil {
+			series.Description = *body.Description
+		}
+		db.Save(&series)
+		res.Header().Set("Location", apiPrefix+"/series/"+strconv.Itoa(int(series.ID)))
+		writeAPI(res, http.StatusCreated, apiSeriesFrom(series, 0, nil))
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPost)
+	}
+}
+
+func apiSeriesFrom(series Series, count int, missing []int) APISeries {
+	return APISeries{
+		ID:          series.ID,
+		Name:        series.Name,
+		Description: series.Description,
+		BookCount:   intPtr(count),
+		Missing:     missing,
+		CreatedAt:   timePtr(series.CreatedAt),
+		UpdatedAt:   timePtr(series.UpdatedAt),
+	}
+}
+
+// apiSeriesHandler get, rename or delete a series, the books of a deleted series are kept without series
+func apiSeriesHandler(res http.ResponseWriter, req *http.Request) {
+	var series Series
+	var numbers []float32
+
+	db.First(&series, apiID(req, "id"))
+	if series.ID == 0 {
+		writeAPIError(res, http.StatusNotFound, "series not found")
+		return
+	}
+	db.Model(&Book{}).Where("series_id = ?", series.ID).Pluck("serie_number", &numbers)
+
+	switch req.Method {
+	case http.MethodGet:
+		writeAPI(res, http.StatusOK, apiSeriesFrom(series, len(numbers), missingVolumes(numbers)))
+	case http.MethodPatch:
+		var body apiNamePatch
+		if err := readAPIBody(req, &body); err != nil || body.SortName != nil {
+			writeAPIError(res, http.StatusBadRequest, "invalid json body, name and description can be changed")
+			return
+		}
+		if body.Name != nil {
+			name := strings.TrimSpace(*body.Name)
+			if name == "" {
+				writeAPIError(res, http.StatusUnprocessableEntity, "name can't be empty")
+				return
+			}
+			var existing Series
+			db.Where("name = ? AND id <> ?", name, series.ID).First(&existing)
+			if existing.ID != 0 {
+				writeAPIError(res, http.StatusConflict, "a series with this name already exists")
+				return
+			}
+			series.Name = name
+		}
+		if body.Description != nil {
+			series.Description = *body.Description
+		}
+		db.Save(&series)
+		if body.Name != nil {
+			db.Model(&Book{}).Where("series_id = ?", series.ID).UpdateColumn("serie", series.Name)
+			reindexSeriesBooks(series.ID)
+		}
+		writeAPI(res, http.StatusOK, apiSeriesFrom(series, len(numbers), missingVolumes(numbers)))
+	case http.MethodDelete:
+		var bookIDs []uint
+		db.Model(&Book{}).Where("series_id = ?", series.ID).Pluck("id", &bookIDs)
+		db.Model(&Book{}).Where("series_id = ?", series.ID).UpdateColumns(map[string]interface{}{"series_id": 0, "serie": "", "serie_number": 0})
+		// only the books of the series changed, not all the books without series
+		var books []Book
+		db.Where("id in (?)", bookIDs).Find(&books)
+		for _, book := range books {
+			indexBook(db, &book)
+		}
+		// the name is unique, it must be free for a new series
+		db.Unscoped().Delete(&series)
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// reindexSeriesBooks update the search index of the books of the series
+func reindexSeriesBooks(seriesID uint) {
+	var books []Book
+
+	db.Where("series_id = ?", seriesID).Find(&books)
+	for _, book := range books {
+		indexBook(db, &book)
+	}
+}
+
+// apiSettingsHandler get or change the settings, only admins can
+func apiSettingsHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+
+	if !currentUser(req).Admin {
+		writeAPIError(res, http.StatusForbidden, "admin only")
+		return
+	}
+	db.First(&serverOption)
+
+	switch req.Method {
+	case http.MethodGet:
+		writeAPI(res, http.StatusOK, apiSettingsFrom(serverOption))
+	case http.MethodPatch:
+		var patch apiSettingsPatch
+		if err := readAPIBody(req, &patch); err != nil {
+			writeAPIError(res, http.StatusBadRequest, err.Error())
+			return
+		}
+		separator := serverOption.TagSeparator
+		inbox := serverOption.InboxDir
+		if err := patchSettings(&serverOption, patch); err != nil {
+			writeAPIError(res, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		db.Save(&serverOption)
+		if serverOption.TagSeparator != separator {
+			setupTags()
+		}
+		if serverOption.InboxDir != inbox {
+			startInbox(serverOption.InboxDir)
+		}
+		writeAPI(res, http.StatusOK, apiSettingsFrom(serverOption))
+	default:
+		apiMethodNotAllowed(res, http.MethodGet, http.MethodPatch)
+	}
+}
+
+// patchSettings check and apply the settings sent, with the rules of the settings page
+func patchSettings(serverOption *ServerOption, patch apiSettingsPatch) error {
+	if patch.Port != nil && (*patch.Port < 1 || *patch.Port > 65535) {
+		return errors.New("port must be between 1 and 65535")
+	}
+	if patch.PerPage != nil && *patch.PerPage < 1 {
+		return errors.New("per_page must be positive")
+	}
+	if patch.JobWorkers != nil && *patch.JobWorkers < 1 {
+		return errors.New("job_workers must be positive")
+	}
+	if patch.ReadThreshold != nil && (*patch.ReadThreshold < 0 || *patch.ReadThreshold > 100) {
+		return errors.New("read_threshold must be between 0 and 100")
+	}
+	if patch.SMTPPort != nil && (*patch.SMTPPort < 1 || *patch.SMTPPort > 65535) {
+		return errors.New("smtp_port must be between 1 and 65535")
+	}
+	if patch.DuplicatePolicy != nil {
+		switch *patch.DuplicatePolicy {
+		case duplicateSkip, duplicateMerge, duplicateImport:
+		default:
+			return errors.New("duplicate_policy must be skip, merge or import")
+		}
+	}
+
+	if patch.Name != nil {
+		serverOption.Name = *patch.Name
+	}
+	if patch.BaseURL != nil {
+		serverOption.BaseURL = strings.TrimSpace(*patch.BaseURL)
+	}
+	if patch.Port != nil {
+		serverOption.Port = *patch.Port
+	}
+	if patch.PerPage != nil {
+		serverOption.NumberBookPerPage = *patch.PerPage
+	}
+	if patch.JobWorkers != nil {
+		serverOption.JobWorkers = *patch.JobWorkers
+	}
+	if patch.InboxDir != nil {
+		serverOption.InboxDir = *patch.InboxDir
+	}
+	if patch.DuplicatePolicy != nil {
+		serverOption.DuplicatePolicy = *patch.DuplicatePolicy
+	}
+	if patch.ReadThreshold != nil {
+		serverOption.ReadThreshold = *patch.ReadThreshold
+	}
+	if patch.EmbedMetadata != nil {
+		serverOption.EmbedMetadata = *patch.EmbedMetadata
+	}
+	if patch.TagSeparator != nil {
+		serverOption.TagSeparator = strings.TrimSpace(*patch.TagSeparator)
+	}
+	if patch.SMTPHost != nil {
+		serverOption.SMTPHost = strings.TrimSpace(*patch.SMTPHost)
+	}
+	if patch.SMTPPort != nil {
+		serverOption.SMTPPort = *patch.SMTPPort
+	}
+	if patch.SMTPUser != nil {
+		serverOption.SMTPUser = *patch.SMTPUser
+	}
+	if patch.SMTPPassword != nil {
+		serverOption.SMTPPassword = *patch.SMTPPassword
+	}
+	if patch.SMTPFrom != nil {
+		serverOption.SMTPFrom = strings.TrimSpace(*patch.SMTPFrom)
+	}
+	return nil
+}
+
+// apiRoutes add the routes of the API to the router
+func apiRoutes(routeur *mux.Router) {
+	api := routeur.PathPrefix(apiPrefix).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(apiNotFoundHandler)
+
+	api.HandleFunc("", apiIndexHandler)
+	api.HandleFunc("/", apiIndexHandler)
+	api.HandleFunc("/openapi.json", apiOpenAPIHandler)
+	api.HandleFunc("/books", apiBooksHandler)
+	api.HandleFunc("/books/batch", apiBatchHandler)
+	api.HandleFunc("/books/{id:[0-9]+}", apiBookHandler)
+	api.HandleFunc("/books/{id:[0-9]+}/files", apiBookFilesHandler)
+	api.HandleFunc("/books/{id:[0-9]+}/send", apiBookSendHandler)
+	api.HandleFunc("/files/{id:[0-9]+}", apiFileHandler)
+	api.HandleFunc("/jobs/{id:[0-9]+}", apiJobHandler)
+	api.HandleFunc("/authors", apiAuthorsHandler)
+	api.HandleFunc("/authors/{id:[0-9]+}", apiAuthorHandler)
+	api.HandleFunc("/tags", apiTagsHandler)
+	api.HandleFunc("/tags/{id:[0-9]+}", apiTagHandler)
+	api.HandleFunc("/series", apiSeriesListHandler)
+	api.HandleFunc("/series/{id:[0-9]+}", apiSeriesHandler)
+	api.HandleFunc("/settings", apiSettingsHandler)
+}
+
+// apiUser return the user of an API request, from a client token, basic auth or the session
+func apiUser(req *http.Request) (User, bool) {
+	if token := apiToken(req); token != "" {
+		return tokenUser(token), false
+	}
+	if _, _, ok := req.BasicAuth(); ok {
+		return basicAuthUser(req), false
+	}
+	return sessionUser(req), true
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	sessions "github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+	"github.com/pborman/uuid"
+)
+
+type contextKey int
+
+const userContextKey contextKey = 0
+
+// basicAuthCacheDuration is how long a checked basic auth password is trusted,
+// OPDS clients send it with every cover request and bcrypt is slow on purpose
+const basicAuthCacheDuration = 10 * time.Minute
+
+// maxLoginFailures failed logins from an address block it during loginBlockDuration
+const maxLoginFailures = 5
+const loginBlockDuration = 15 * time.Minute
+
+// ClientToken store a revocable token given to an OPDS client of a user
+type ClientToken struct {
+	gorm.Model
+	UserID     uint
+	Name       string
+	Token      string `gorm:"unique_index"`
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+type basicAuthEntry struct {
+	userID  uint
+	expires time.Time
+}
+
+type loginFailure struct {
+	count int
+	since time.Time
+}
+
+var basicAuthCache = map[string]basicAuthEntry{}
+var basicAuthMutex sync.Mutex
+
+var loginFailures = map[string]*loginFailure{}
+var loginMutex sync.Mutex
+
+// publicPrefixes list paths reachable without authentication
+var publicPrefixes = []string{"/login.html", "/css/", "/js/", "/img/", "/fonts/", "/logo.png", "/favicon.ico"}
+
+// migrateClientTokens move the token of each user to a client token
+func migrateClientTokens() {
+	var tokens []ClientToken
+
+	rows, err := db.Raw("SELECT id, token FROM users WHERE token IS NOT NULL AND token <> ''").Rows()
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var token ClientToken
+		rows.Scan(&token.UserID, &token.Token)
+		token.Name = "OPDS"
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+
+	for _, token := range tokens {
+		db.Save(&token)
+	}
+	db.Exec("UPDATE users SET token = '' WHERE token IS NOT NULL AND token <> ''")
+}
+
+// feedAuthRequired return true when OPDS and download routes need credentials
+func feedAuthRequired() bool {
+	var count int
+
+	if authRequired() {
+		return true
+	}
+	db.Model(&ClientToken{}).Where("revoked_at IS NULL").Count(&count)
+	return count > 0
+}
+
+// isFeedRequest return true for routes used by OPDS clients: feeds, downloads and book files.
+// Only reading is allowed there, a change made with the credentials cached by a browser need the CSRF token.
+func isFeedRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	ext := path.Ext(req.URL.Path)
+	if ext == "."+atomExt || ext == "."+jsonExt || req.URL.Path == "/opensearch.xml" {
+		return true
+	}
+	if strings.HasPrefix(req.URL.Path, "/books/") && strings.Contains(req.URL.Path, "/download") {
+		return true
+	}
+	// resized covers and placeholders
+	if strings.HasPrefix(req.URL.Path, "/books/") && strings.Contains(req.URL.Path, "/cover/") && ext == ".jpg" {
+		return true
+	}
+	// book files and covers served from public/books
+	return strings.HasPrefix(req.URL.Path, "/books/") && strings.Count(req.URL.Path, "/") == 3 && ext != "" && ext != ".html"
+}
+
+func isPublicRequest(req *http.Request) bool {
+	for _, prefix := range publicPrefixes {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenUser return the user owning the client token
+func tokenUser(token string) User {
+	var clientToken ClientToken
+	var user User
+
+	db.Where("token = ? AND revoked_at IS NULL", token).First(&clientToken)
+	if clientToken.ID == 0 {
+		return user
+	}
+	if clientToken.LastUsedAt == nil || time.Since(*clientToken.LastUsedAt) > time.Minute {
+		now := time.Now()
+		db.Model(&clientToken).UpdateColumn("last_used_at", now)
+	}
+	db.First(&user, clientToken.UserID)
+	return user
+}
+
+// basicAuthUser return the user matching the basic auth credentials of the request
+func basicAuthUser(req *http.Request) User {
+	var user User
+
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return user
+	}
+
+	hash := sha256.Sum256([]byte(name + ":" + password))
+	key := hex.EncodeToString(hash[:])
+
+	basicAuthMutex.Lock()
+	entry, found := basicAuthCache[key]
+	basicAuthMutex.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		db.First(&user, entry.userID)
+		return user
+	}
+
+	if loginBlocked(req) {
+		return user
+	}
+	db.Where("name = ?", name).First(&user)
+	if user.ID == 0 || !user.CheckPassword(password) {
+		loginFailed(req)
+		return User{}
+	}
+	loginSucceeded(req)
+
+	basicAuthMutex.Lock()
+	basicAuthCache[key] = basicAuthEntry{userID: user.ID, expires: time.Now().Add(basicAuthCacheDuration)}
+	basicAuthMutex.Unlock()
+	return user
+}
+
+// clearBasicAuthCache forget checked passwords, called when a password change
+func clearBasicAuthCache() {
+	basicAuthMutex.Lock()
+	basicAuthCache = map[string]basicAuthEntry{}
+	basicAuthMutex.Unlock()
+}
+
+// clientAddress return the ip address of the client, used as key for login rate limiting
+func clientAddress(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// loginBlocked return true when the client failed to log in too many times
+func loginBlocked(req *http.Request) bool {
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+
+	failure, ok := loginFailures[clientAddress(req)]
+	if !ok {
+		return false
+	}
+	if time.Since(failure.since) > loginBlockDuration {
+		delete(loginFailures, clientAddress(req))
+		return false
+	}
+	return failure.count >= maxLoginFailures
+}
+
+func loginFailed(req *http.Request) {
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+
+	failure, ok := loginFailures[clientAddress(req)]
+	if !ok || time.Since(failure.since) > loginBlockDuration {
+		failure = &loginFailure{since: time.Now()}
+		loginFailures[clientAddress(req)] = failure
+	}
+	failure.count++
+	fmt.Println("failed login from " + clientAddress(req))
+}
+
+func loginSucceeded(req *http.Request) {
+	loginMutex.Lock()
+	delete(loginFailures, clientAddress(req))
+	loginMutex.Unlock()
+}
+
+// authMiddleware authenticate every request and store the user in the request context.
+// HTML pages use the session, OPDS feeds, downloads, book files and the REST API also accept
+// HTTP basic auth and client tokens. Requests changing something from a session need a CSRF token.
+func authMiddleware(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	var user User
+
+	// the KOReader sync API authenticate with its own headers
+	if isKosyncRequest(req) {
+		next(res, req)
+		return
+	}
+
+	if isPublicRequest(req) {
+		if csrfProtected(req) && !validCSRF(req) {
+			http.Error(res, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next(res, req)
+		return
+	}
+
+	if isAPIRequest(req) {
+		user, fromSession := apiUser(req)
+		if user.ID != 0 && fromSession && csrfProtected(req) && !validCSRF(req) {
+			writeAPIError(res, http.StatusForbidden, "invalid CSRF token")
+			return
+		}
+		if user.ID == 0 && !authRequired() {
+			user = defaultUser()
+		}
+		if user.ID == 0 {
+			res.Header().Set("WWW-Authenticate", `Bearer realm="`+options.Name+`"`)
+			writeAPIError(res, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(res, req.WithContext(context.WithValue(req.Context(), userContextKey, user)))
+		return
+	}
+
+	if isFeedRequest(req) {
+		if token := req.URL.Query().Get("token"); token != "" {
+			user = tokenUser(token)
+		} else if _, _, ok := req.BasicAuth(); ok {
+			user = basicAuthUser(req)
+		} else {
+			user = sessionUser(req)
+			if user.ID != 0 && csrfProtected(req) && !validCSRF(req) {
+				http.Error(res, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+		if user.ID == 0 && !feedAuthRequired() {
+			user = defaultUser()
+		}
+		if user.ID == 0 {
+			res.Header().Set("WWW-Authenticate", `Basic realm="`+options.Name+`", charset="UTF-8"`)
+			http.Error(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		user = sessionUser(req)
+		if user.ID == 0 && !authRequired() {
+			user = defaultUser()
+		}
+		if user.ID == 0 {
+			http.Redirect(res, req, "/login.html", http.StatusFound)
+			return
+		}
+		if csrfProtected(req) && !validCSRF(req) {
+			http.Error(res, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+	}
+
+	next(res, req.WithContext(context.WithValue(req.Context(), userContextKey, user)))
+}
+
+// withToken add the client token of the request to a feed link
+func withToken(href string, token string) string {
+	if token == "" {
+		return href
+	}
+	if strings.Contains(href, "?") {
+		return href + "&token=" + url.QueryEscape(token)
+	}
+	return href + "?token=" + url.QueryEscape(token)
+}
+
+func tokensHandler(res http.ResponseWriter, req *http.Request) {
+	var tokens []ClientToken
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	user := currentUser(req)
+
+	if req.Method == http.MethodPost {
+		name := req.FormValue("name")
+		if name == "" {
+			name = "OPDS"
+		}
+		db.Save(&ClientToken{UserID: user.ID, Name: name, Token: uuid.NewRandom().String()})
+
+		res.Header().Set("Location", "/tokens.html")
+		res.WriteHeader(302)
+		return
+	}
+
+	db.Where("user_id = ?", user.ID).Order("revoked_at asc, id desc").Find(&tokens)
+
+	tokensTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+	templateFile, _ := pkger.Open("/template/tokens.html")
+	templateData, _ := ioutil.ReadAll(templateFile)
+	tokensTemplate = template.Must(tokensTemplate.Parse(string(templateData)))
+	tokensTemplate.Execute(res, Page{Content: struct {
+		Tokens  []ClientToken
+		RootURL string
+	}{tokens, RootURL(req)}, Title: serverOption.Name})
+}
+
+func tokenRevokeHandler(res http.ResponseWriter, req *http.Request) {
+	var token ClientToken
+
+	user := currentUser(req)
+	vars := mux.Vars(req)
+	tokenID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.Where("user_id = ?", user.ID).First(&token, tokenID)
+	if token.ID != 0 && token.RevokedAt == nil {
+		now := time.Now()
+		token.RevokedAt = &now
+		db.Save(&token)
+		fmt.Println("revoked token " + token.Name)
+	}
+	http.Redirect(res, req, "/tokens.html", http.StatusTemporaryRedirect)
+}
+
+func logoutHandler(res http.ResponseWriter, req *http.Request) {
+	session := sessions.GetSession(req)
+	session.Delete("user_id")
+	session.Delete(csrfField)
+
+	http.Redirect(res, req, "/login.html", http.StatusFound)
+}
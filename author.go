@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/beevik/etree"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+)
+
+// AuthorAlias store another name of an author, used to match authors on import
+type AuthorAlias struct {
+	gorm.Model
+	AuthorID uint   `gorm:"index"`
+	Name     string `gorm:"unique_index"`
+	Key      string `gorm:"index"`
+}
+
+// AuthorCount is an author with the number of its books
+type AuthorCount struct {
+	Author
+	Count int
+}
+
+// authorMutex avoid two import jobs creating the same author
+var authorMutex sync.Mutex
+
+// displayName turn "Hugo, Victor" into "Victor Hugo"
+func displayName(name string) string {
+	parts := strings.SplitN(name, ",", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return strings.TrimSpace(name)
+	}
+	return strings.TrimSpace(parts[1]) + " " + strings.TrimSpace(parts[0])
+}
+
+// defaultSortName turn "Victor Hugo" into "Hugo, Victor"
+func defaultSortName(name string) string {
+	if strings.Contains(name, ",") {
+		return strings.TrimSpace(name)
+	}
+	words := strings.Fields(name)
+	if len(words) < 2 {
+		return strings.TrimSpace(name)
+	}
+	return words[len(words)-1] + ", " + strings.Join(words[:len(words)-1], " ")
+}
+
+// authorKey is used to match the same author written differently
+func authorKey(name string) string {
+	return normalizeTitle(displayName(name))
+}
+
+// BeforeSave callback to keep the author sort name and key up to date
+func (author *Author) BeforeSave() error {
+	if author.SortName == "" {
+		author.SortName = defaultSortName(author.Name)
+	}
+	author.Key = authorKey(author.Name)
+	return nil
+}
+
+// BeforeSave callback to keep the alias key up to date
+func (alias *AuthorAlias) BeforeSave() error {
+	alias.Key = authorKey(alias.Name)
+	return nil
+}
+
+// setupAuthors fill the sort name and key of authors created before they existed
+func setupAuthors() {
+	var authors []Author
+
+	db.Where("key IS NULL OR key = ''").Find(&authors)
+	for _, author := range authors {
+		db.Save(&author)
+	}
+}
+
+// findOrCreateAuthor return the author with this name or alias, written as is or as "Last, First"
+func findOrCreateAuthor(name string, sortName string) Author {
+	var author Author
+	var alias AuthorAlias
+
+	authorMutex.Lock()
+	defer authorMutex.Unlock()
+
+	name = strings.TrimSpace(name)
+	if strings.Contains(name, ",") {
+		if sortName == "" {
+			sortName = name
+		}
+		name = displayName(name)
+	}
+
+	db.Where("name = ?", name).First(&author)
+	if author.ID == 0 {
+		db.Where("name = ?", name).First(&alias)
+		if alias.ID == 0 {
+			db.Where("key = ?", authorKey(name)).First(&alias)
+		}
+		if alias.ID != 0 {
+			db.First(&author, alias.AuthorID)
+		}
+	}
+	if author.ID == 0 {
+		db.Where("key = ?", authorKey(name)).First(&author)
+	}
+
+	if author.ID == 0 {
+		author.Name = name
+		author.SortName = sortName
+		db.Save(&author)
+	} else if sortName != "" && author.SortName == defaultSortName(author.Name) && sortName != author.SortName {
+		// the sort name from the book is better than the guessed one
+		author.SortName = sortName
+		db.Save(&author)
+	}
+	return author
+}
+
+// authorsWithCount return authors ordered by sort name with the number of their books
+func authorsWithCount(limit int, offset int) ([]AuthorCount, int) {
+	var authors []AuthorCount
+	var count int
+
+	db.Model(&Author{}).Where("id IN (SELECT author_id FROM book_authors INNER JOIN books ON books.id = book_authors.book_id WHERE books.deleted_at IS NULL)").Count(&count)
+
+	query := db.Table("authors").
+		Select("authors.*, count(books.id) AS count").
+		Joins("INNER JOIN book_authors ON book_authors.author_id = authors.id INNER JOIN books ON books.id = book_authors.book_id AND books.deleted_at IS NULL").
+		Where("authors.deleted_at IS NULL").
+		Group("authors.id").
+		Order("authors.sort_name COLLATE NOCASE asc")
+	if limit > 0 {
+		query = query.Limit(limit).Offset(offset)
+	}
+	query.Scan(&authors)
+	return authors, count
+}
+
+// reindexAuthorBooks update the search index of the books of the author
+func reindexAuthorBooks(authorID uint) {
+	var books []Book
+
+	db.Scopes(BookwithAuthorID(int(authorID))).Find(&books)
+	for _, book := range books {
+		indexBook(db, &book)
+	}
+}
+
+// mergeAuthors move the books of other to keep, the name of other become an alias of keep
+func mergeAuthors(keep *Author, other *Author) error {
+	if keep.ID == other.ID {
+		return nil
+	}
+
+	tx := db.Begin()
+	if err := mergeAuthorsTx(tx, keep, other); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	reindexAuthorBooks(keep.ID)
+	fmt.Println("merged author " + other.Name + " in " + keep.Name)
+	return nil
+}
+
+// mergeAuthorsTx save the merge of other in keep inside the transaction
+func mergeAuthorsTx(tx *gorm.DB, keep *Author, other *Author) error {
+	// books already linked to keep would have it twice
+	if err := tx.Exec("DELETE FROM book_authors WHERE author_id = ? AND book_id IN (SELECT book_id FROM book_authors WHERE author_id = ?)", other.ID, keep.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("UPDATE book_authors SET author_id = ? WHERE author_id = ?", keep.ID, other.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&AuthorAlias{}).Where("author_id = ?", other.ID).Update("author_id", keep.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("name = ?", other.Name).Delete(AuthorAlias{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Save(&AuthorAlias{AuthorID: keep.ID, Name: other.Name}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(other).Error
+}
+
+// catalogEntry return the entry of the author in the authors navigation feed
+func (author AuthorCount) catalogEntry() CatalogEntry {
+	return CatalogEntry{
+		ID:      "urn:myopds:author:" + strconv.Itoa(int(author.ID)),
+		Title:   author.Name,
+		Content: strconv.Itoa(author.Count) + " livres",
+		Path:    "/authors/" + strconv.Itoa(int(author.ID)),
+		Kind:    "acquisition",
+		Rel:     "subsection",
+		Count:   author.Count,
+	}
+}
+
+// authorLinkOpds return the link to the feed of the author
+func authorLinkOpds(author Author, ext string, token string) string {
+	return withToken("/authors/"+strconv.Itoa(int(author.ID))+"."+ext, token)
+}
+
+func authorsHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+	var pageInt = 1
+
+	db.First(&serverOption)
+	vars := mux.Vars(req)
+	token := req.URL.Query().Get("token")
+
+	if page := req.URL.Query().Get("page"); page != "" {
+		pageInt, _ = strconv.Atoi(page)
+		if pageInt < 1 {
+			pageInt = 1
+		}
+	}
+	limit := serverOption.NumberBookPerPage
+	offset := limit * (pageInt - 1)
+
+	if vars["format"] == atomExt {
+		authors, count := authorsWithCount(limit, offset)
+		_, prevLink, nextLink, _ := paginationLinks(req.URL, pageInt, limit, count)
+
+		res.Header().Set("Content-Type", opdsNavigationType)
+		baseDoc := etree.NewDocument()
+		baseDoc.Indent(2)
+		feed := baseOpds(baseDoc, serverOption.UUID+":authors", "Auteurs", count, limit, offset+1, RootURL(req), req.URL.String(), "/index.atom", prevLink, nextLink, opdsNavigationType, token)
+		for _, author := range authors {
+			navigationEntryOpds(feed, author.catalogEntry(), RootURL(req), token)
+		}
+		xmlString, _ := baseDoc.WriteToString()
+		fmt.Fprintf(res, xmlString)
+	} else if vars["format"] == jsonExt {
+		authors, count := authorsWithCount(limit, offset)
+		firstLink, prevLink, nextLink, lastLink := paginationLinks(req.URL, pageInt, limit, count)
+
+		feed := baseOpds2(serverOption.UUID+":authors", "Auteurs", count, limit, pageInt, RootURL(req)+req.URL.String(), prevLink, nextLink, firstLink, lastLink, token)
+		for _, author := range authors {
+			feed.Navigation = append(feed.Navigation, navigationLinkOpds2(author.catalogEntry(), RootURL(req), token))
+		}
+		writeOpds2(res, opds2MediaType, feed)
+	} else {
+		authors, _ := authorsWithCount(0, 0)
+
+		authorsTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+		templateFile, _ := pkger.Open("/template/authors.html")
+		templateData, _ := ioutil.ReadAll(templateFile)
+		authorsTemplate = template.Must(authorsTemplate.Parse(string(templateData)))
+		authorsTemplate.Execute(res, Page{Content: authors, Title: serverOption.Name})
+	}
+}
+
+func authorHandler(res http.ResponseWriter, req *http.Request) {
+	var author Author
+	var books []Book
+	var aliases []AuthorAlias
+	var serverOption ServerOption
+	var pageInt = 1
+
+	db.First(&serverOption)
+	vars := mux.Vars(req)
+	token := req.URL.Query().Get("token")
+	authorID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.First(&author, authorID)
+	if author.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+
+	if page := req.URL.Query().Get("page"); page != "" {
+		pageInt, _ = strconv.Atoi(page)
+		if pageInt < 1 {
+			pageInt = 1
+		}
+	}
+	limit := serverOption.NumberBookPerPage
+	offset := limit * (pageInt - 1)
+
+	var count int
+	db.Model(&Book{}).Scopes(BookwithAuthorID(int(author.ID))).Count(&count)
+	query := db.Scopes(BookwithAuthorID(int(author.ID))).Order("serie asc, serie_number asc, title asc")
+	if vars["format"] != "html" {
+		query = query.Limit(limit).Offset(offset)
+	}
+	query.Find(&books)
+	firstLink, prevLink, nextLink, lastLink := paginationLinks(req.URL, pageInt, limit, count)
+
+	if vars["format"] == atomExt {
+		res.Header().Set("Content-Type", opdsAcquisitionType)
+		baseDoc := etree.NewDocument()
+		baseDoc.Indent(2)
+		feed := baseOpds(baseDoc, "urn:myopds:author:"+strconv.Itoa(int(author.ID)), author.Name, count, limit, offset+1, RootURL(req), req.URL.String(), "/authors.atom", prevLink, nextLink, opdsAcquisitionType, token)
+		for _, book := range books {
+			entryOpds(&book, feed, RootURL(req), token)
+		}
+		xmlString, _ := baseDoc.WriteToString()
+		fmt.Fprintf(res, xmlString)
+	} else if vars["format"] == jsonExt {
+		feed := baseOpds2("urn:myopds:author:"+strconv.Itoa(int(author.ID)), author.Name, count, limit, pageInt, RootURL(req)+req.URL.String(), prevLink, nextLink, firstLink, lastLink, token)
+		feed.Publications = []Opds2Publication{}
+		for _, book := range books {
+			feed.Publications = append(feed.Publications, publicationOpds2(&book, RootURL(req), token))
+		}
+		writeOpds2(res, opds2MediaType, feed)
+	} else {
+		db.Where("author_id = ?", author.ID).Order("name asc").Find(&aliases)
+
+		authorTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+		templateFile, _ := pkger.Open("/template/author.html")
+		templateData, _ := ioutil.ReadAll(templateFile)
+		authorTemplate = template.Must(authorTemplate.Parse(string(templateData)))
+		authorTemplate.Execute(res, Page{Content: struct {
+			Author  Author
+			Aliases []AuthorAlias
+			Books   []Book
+		}{author, aliases, books}, Title: serverOption.Name})
+	}
+}
+
+// authorEditHandler change the name and sort name of the author and add an alias
+func authorEditHandler(res http.ResponseWriter, req *http.Request) {
+	var author Author
+
+	vars := mux.Vars(req)
+	authorID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.First(&author, authorID)
+	if author.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+
+	if name := strings.TrimSpace(req.FormValue("name")); name != "" && name != author.Name {
+		var existing Author
+		db.Where("name = ? AND id <> ?", name, author.ID).First(&existing)
+		if existing.ID != 0 {
+			// renaming to an existing author is a merge
+			if err := mergeAuthors(&existing, &author); err != nil {
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(res, req, "/authors/"+strconv.Itoa(int(existing.ID))+".html", http.StatusFound)
+			return
+		}
+		db.Unscoped().Where("name = ?", author.Name).Delete(AuthorAlias{})
+		db.Save(&AuthorAlias{AuthorID: author.ID, Name: author.Name})
+		author.Name = name
+	}
+	author.SortName = strings.TrimSpace(req.FormValue("sort_name"))
+	db.Save(&author)
+
+	if alias := strings.TrimSpace(req.FormValue("alias")); alias != "" && alias != author.Name {
+		var existing AuthorAlias
+		db.Where("name = ?", alias).First(&existing)
+		existing.AuthorID = author.ID
+		existing.Name = alias
+		db.Save(&existing)
+	}
+	reindexAuthorBooks(author.ID)
+
+	http.Redirect(res, req, "/authors/"+vars["id"]+".html", http.StatusFound)
+}
+
+func authorAliasDeleteHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	aliasID, _ := strconv.ParseInt(vars["alias"], 10, 64)
+
+	authorID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.Unscoped().Where("author_id = ?", authorID).Delete(&AuthorAlias{}, aliasID)
+	reindexAuthorBooks(uint(authorID))
+
+	http.Redirect(res, req, "/authors/"+vars["id"]+".html", http.StatusFound)
+}
+
+// authorsMergeHandler merge the selected authors in the author to keep
+func authorsMergeHandler(res http.ResponseWriter, req *http.Request) {
+	var keep Author
+
+	keepID, _ := strconv.ParseInt(req.FormValue("keep"), 10, 64)
+	db.First(&keep, keepID)
+	if keep.ID == 0 {
+		http.Error(res, "Choisir l'auteur à garder", http.StatusBadRequest)
+		return
+	}
+
+	req.ParseForm()
+	for _, value := range req.Form["authors"] {
+		var other Author
+		otherID, _ := strconv.ParseInt(value, 10, 64)
+		db.First(&other, otherID)
+		if other.ID != 0 && other.ID != keep.ID {
+			if err := mergeAuthors(&keep, &other); err != nil {
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	http.Redirect(res, req, "/authors/"+strconv.Itoa(int(keep.ID))+".html", http.StatusFound)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+)
+
+// actions which can be done on a selection of books
+const (
+	batchAddTag      = "add_tag"
+	batchRemoveTag   = "remove_tag"
+	batchSeries      = "series"
+	batchAuthor      = "author"
+	batchRead        = "read"
+	batchUnread      = "unread"
+	batchFavorite    = "favorite"
+	batchUnfavorite  = "unfavorite"
+	batchRefreshMeta = "refresh"
+	batchDelete      = "delete"
+	batchShelf       = "shelf"
+)
+
+var batchLabels = map[string]string{
+	batchAddTag:      "Ajout du tag",
+	batchRemoveTag:   "Retrait du tag",
+	batchSeries:      "Changement de série",
+	batchAuthor:      "Changement d'auteur",
+	batchRead:        "Marqué comme lu",
+	batchUnread:      "Marqué comme non lu",
+	batchFavorite:    "Ajout aux favoris",
+	batchUnfavorite:  "Retrait des favoris",
+	batchRefreshMeta: "Mise à jour des métadonnées",
+	batchDelete:      "Suppression",
+	batchShelf:       "Ajout à l'étagère",
+}
+
+// BatchBook is a book of the selection with what the action did on it
+type BatchBook struct {
+	ID    uint   `json:"id"`
+	Title string `json:"title"`
+}
+
+// BatchResult is the summary of an action on a selection of books
+type BatchResult struct {
+	Action    string      `json:"action"`
+	Label     string      `json:"label"`
+	Value     string      `json:"value,omitempty"`
+	Changed   []BatchBook `json:"changed"`
+	Unchanged []BatchBook `json:"unchanged"`
+	Missing   []uint      `json:"missing"`
+	Back      string      `json:"-"`
+}
+
+// runBatch do the action on all the books, the changes are saved in one transaction
+func runBatch(action string, value string, bookIDs []uint, userID uint) (BatchResult, error) {
+	var books []Book
+	var tag Tag
+	var author Author
+	var series Series
+	var shelf Shelf
+
+	value = strings.TrimSpace(value)
+	result := BatchResult{Action: action, Label: batchLabels[action], Value: value, Changed: []BatchBook{}, Unchanged: []BatchBook{}, Missing: []uint{}}
+	if result.Label == "" {
+		return result, errors.New("unknown action " + action)
+	}
+	if len(bookIDs) == 0 {
+		return result, errors.New("no book selected")
+	}
+
+	// the tags, authors and series are shared, they are created before the transaction
+	switch action {
+	case batchAddTag:
+		if value == "" {
+			return result, errors.New("tag can't be empty")
+		}
+		tag = findOrCreateTag(value)
+	case batchRemoveTag:
+		db.Where("name = ?", value).First(&tag)
+	case batchAuthor:
+		if value == "" {
+			return result, errors.New("author can't be empty")
+		}
+		author = findOrCreateAuthor(value, "")
+	case batchSeries:
+		series = findOrCreateSeries(value)
+	case batchShelf:
+		if value == "" {
+			return result, errors.New("shelf can't be empty")
+		}
+		shelf = findOrCreateShelf(userID, value)
+	}
+
+	db.Where("id IN (?)", bookIDs).Find(&books)
+	found := map[uint]bool{}
+	for _, book := range books {
+		found[book.ID] = true
+	}
+	for _, bookID := range bookIDs {
+		if !found[bookID] {
+			result.Missing = append(result.Missing, bookID)
+		}
+	}
+
+	tx := db.Begin()
+	for i := range books {
+		book := &books[i]
+		changed, err := batchBook(tx, book, action, userID, tag, author, series, shelf)
+		if err != nil {
+			tx.Rollback()
+			return result, errors.New(book.Title + ": " + err.Error())
+		}
+		if changed {
+			result.Changed = append(result.Changed, BatchBook{book.ID, book.Title})
+		} else {
+			result.Unchanged = append(result.Unchanged, BatchBook{book.ID, book.Title})
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return result, err
+	}
+
+	if action == batchRefreshMeta {
+		for _, book := range books {
+			enqueueJob(jobMetadata, "", book.ID)
+		}
+	}
+	return result, nil
+}
+
+// batchBook do the action on one book inside the transaction, it return false when the book has not changed
+func batchBook(tx *gorm.DB, book *Book, action string, userID uint, tag Tag, author Author, series Series, shelf Shelf) (bool, error) {
+	var count int
+
+	switch action {
+	case batchAddTag:
+		tx.Table("book_tags").Where("book_id = ? AND tag_id = ?", book.ID, tag.ID).Count(&count)
+		if count > 0 {
+			return false, nil
+		}
+		if err := tx.Model(book).Association("Tags").Append(tag).Error; err != nil {
+			return false, err
+		}
+		book.Edited = true
+		return true, tx.Save(book).Error
+	case batchRemoveTag:
+		if tag.ID == 0 {
+			return false, nil
+		}
+		del := tx.Unscoped().Where("book_id = ? AND tag_id = ?", book.ID, tag.ID).Delete(BookTag{})
+		if del.Error != nil || del.RowsAffected == 0 {
+			return false, del.Error
+		}
+		book.Edited = true
+		return true, tx.Save(book).Error
+	case batchAuthor:
+		var authorIDs []uint
+		tx.Table("book_authors").Where("book_id = ?", book.ID).Pluck("author_id", &authorIDs)
+		if len(authorIDs) == 1 && authorIDs[0] == author.ID {
+			return false, nil
+		}
+		if err := tx.Model(book).Association("Authors").Replace([]Author{author}).Error; err != nil {
+			return false, err
+		}
+		book.Edited = true
+		return true, tx.Save(book).Error
+	case batchSeries:
+		if book.SeriesID == series.ID && book.Serie == series.Name {
+			return false, nil
+		}
+		book.Serie = series.Name
+		book.SeriesID = series.ID
+		if series.ID == 0 {
+			book.SerieNumber = 0
+		}
+		book.Edited = true
+		return true, tx.Save(book).Error
+	case batchRead, batchUnread, batchFavorite, batchUnfavorite:
+		var state UserBook
+		tx.Where("user_id = ? AND book_id = ?", userID, book.ID).First(&state)
+		state.UserID = userID
+		state.BookID = book.ID
+		switch action {
+		case batchRead, batchUnread:
+			if state.Read == (action == batchRead) {
+				return false, nil
+			}
+			state.Read = action == batchRead
+			if state.Read {
+				now := time.Now()
+				state.ReadAt = &now
+			}
+		default:
+			if state.Favorite == (action == batchFavorite) {
+				return false, nil
+			}
+			state.Favorite = action == batchFavorite
+		}
+		return true, tx.Save(&state).Error
+	case batchRefreshMeta:
+		// the metadata are read again by the jobs once the selection is known
+		return true, nil
+	case batchDelete:
+		return true, tx.Delete(book).Error
+	case batchShelf:
+		return addToShelf(tx, shelf, book.ID)
+	}
+	return false, nil
+}
+
+// batchHandler do an action on the books selected in the grid and show what changed
+func batchHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+
+	result, err := runBatch(req.FormValue("action"), req.FormValue("value"), formBookIDs(req), currentUser(req).ID)
+	if err != nil {
+		http.Error(res, "Error on selection: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	result.Back = batchBack(req)
+
+	batchTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+	templateFile, _ := pkger.Open("/template/batch.html")
+	templateData, _ := ioutil.ReadAll(templateFile)
+	batchTemplate = template.Must(batchTemplate.Parse(string(templateData)))
+	batchTemplate.Execute(res, Page{Content: result, Title: serverOption.Name})
+}
+
+// batchBack return the local page where the selection was made
+func batchBack(req *http.Request) string {
+	back, err := url.Parse(req.FormValue("back"))
+	if err != nil || back.Host != "" || !strings.HasPrefix(back.Path, "/") {
+		return "/index.html"
+	}
+	return back.String()
+}
+
+// changeTagHandler add or remove a tag of one book
+func changeTagHandler(res http.ResponseWriter, req *http.Request) {
+	action := batchAddTag
+	if req.FormValue("action") == "remove" {
+		action = batchRemoveTag
+	}
+	bookID, _ := strconv.ParseUint(req.FormValue("id"), 10, 64)
+
+	if _, err := runBatch(action, req.FormValue("tag"), []uint{uint(bookID)}, currentUser(req).ID); err != nil {
+		http.Error(res, "Error changing tag: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(res, req, "/books/"+strconv.Itoa(int(bookID))+".html", http.StatusFound)
+}
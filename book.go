@@ -1,28 +1,31 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
-	"github.com/readium/r2-streamer-go/fetcher"
-	"github.com/readium/r2-streamer-go/parser"
 )
 
 // Author store author information
 type Author struct {
 	gorm.Model
-	Name string
+	Name     string
+	SortName string
+	Key      string `gorm:"index"`
 }
 
-// Tag store tag information
+// Tag store tag information, Name is the full path of the tag like "Fiction / Fantasy"
 type Tag struct {
 	gorm.Model
-	Name string
+	Name     string
+	ParentID uint `gorm:"index"`
 }
 
 // BookTag store link beetween book and tag
@@ -39,6 +42,19 @@ type BookAuthor struct {
 	AuthorID uint
 }
 
+// BookFile store a file of a book, a book can have one file per format
+type BookFile struct {
+	gorm.Model
+	BookID    uint
+	Format    string
+	MediaType string
+	Size      int64
+	Checksum  string
+	Path      string
+	// DocumentHash is the partial md5 used by KOReader to identify the file
+	DocumentHash string `gorm:"index"`
+}
+
 // Book store book information
 type Book struct {
 	gorm.Model
@@ -55,13 +71,24 @@ type Book struct {
 	CoverType          string
 	Serie              string
 	SerieNumber        float32
-	Favorite           bool
-	Read               bool
+	SeriesID           uint       `gorm:"index"`
+	PublishedAt        *time.Time `gorm:"index"`
+	Favorite           bool       `gorm:"-"`
+	Read               bool       `gorm:"-"`
+	Progress           float32    `gorm:"-"`
+	ProgressDevice     string     `gorm:"-"`
+	Devices            []Device   `gorm:"-"`
+	Format             string
+	MediaType          string
+	IsbnKey            string   `gorm:"index"`
+	TitleKey           string   `gorm:"index"`
+	TitleSort          string   `gorm:"index"`
 	Authors            []Author `gorm:"many2many:book_authors;"`
 	Tags               []Tag    `gorm:"many2many:book_tags;"`
+	Files              []BookFile
 }
 
-func (book *Book) getMetada() {
+func (book *Book) getMetada() error {
 	var authors []Author
 	var tags []Tag
 
@@ -69,100 +96,142 @@ func (book *Book) getMetada() {
 	fmt.Println("get Meta for Book " + bookIDStr)
 	filePath := book.FilePath()
 
-	publication, _ := parser.Parse(filePath)
-
-	authors = make([]Author, len(publication.Metadata.Author)+len(publication.Metadata.Contributor), len(publication.Metadata.Author)+len(publication.Metadata.Contributor))
-	for i, creator := range publication.Metadata.Author {
-		db.Where("name = ? ", creator.Name.String()).Find(&authors[i])
-		if authors[i].ID == 0 {
-			authors[i].Name = creator.Name.String()
-			db.Save(&authors[i])
-		}
+	meta, err := book.fileFormat().Handler.Metadata(filePath)
+	if err != nil {
+		fmt.Println(err)
+		return err
 	}
 
-	if len(authors) == 0 {
-		for i, creator := range publication.Metadata.Contributor {
-			db.Where("name = ? ", creator.Name.String()).Find(&authors[i])
-			if authors[i].ID == 0 {
-				authors[i].Name = creator.Name.String()
-				db.Save(&authors[i])
-			}
-		}
+	authors = make([]Author, len(meta.Authors), len(meta.Authors))
+	for i, name := range meta.Authors {
+		authors[i] = findOrCreateAuthor(name, meta.AuthorSort[name])
 	}
 
-	book.Title = publication.Metadata.Title.String()
-	book.Description = publication.Metadata.Description
+	if meta.Title != "" {
+		book.Title = meta.Title
+	}
+	book.Description = meta.Description
 	book.Authors = authors
-	book.Isbn = publication.Metadata.Identifier
-	if publication.Metadata.BelongsTo != nil && len(publication.Metadata.BelongsTo.Series) > 0 {
-		book.Serie = publication.Metadata.BelongsTo.Series[0].Name
-		book.SerieNumber = publication.Metadata.BelongsTo.Series[0].Position
-	}
-	for _, sub := range publication.Metadata.Subject {
-		tag := Tag{}
-		db.Where("name = ?", sub.Name).First(&tag)
-		if tag.ID == 0 {
-			tag.Name = sub.Name
-			db.Save(&tag)
+	book.Isbn = meta.Isbn
+	if meta.Language != "" {
+		book.Language = meta.Language
+	}
+	if meta.Publisher != "" {
+		book.Publisher = meta.Publisher
+	}
+	if meta.Serie != "" {
+		book.Serie = meta.Serie
+		book.SerieNumber = meta.SerieNumber
+	}
+	book.linkSeries()
+	if meta.PublishedAt != nil {
+		book.PublishedAt = meta.PublishedAt
+	}
+	for _, name := range meta.Tags {
+		if tag := findOrCreateTag(name); tag.ID != 0 {
+			tags = append(tags, tag)
 		}
-		tags = append(tags, tag)
 	}
 	book.Tags = tags
 
 	db.Save(&book)
 
-	linkCover, _ := publication.GetCover()
-	if linkCover.Href == "" && len(publication.Landmarks) > 0 {
-		if filepath.Ext(publication.Landmarks[0].Href) == ".jpg" || filepath.Ext(publication.Landmarks[0].Href) == ".jpeg" || filepath.Ext(publication.Landmarks[0].Href) == ".png" {
-			linkCover = publication.Landmarks[0]
-		}
+	return book.saveCover(meta, false)
+}
+
+// extractCover read the cover from the book file again and replace the current one
+func (book *Book) extractCover() error {
+	meta, err := book.fileFormat().Handler.Metadata(book.FilePath())
+	if err != nil {
+		return err
+	}
+	if len(meta.Cover) == 0 {
+		return errors.New("no cover in book file")
+	}
+	return book.saveCover(meta, true)
+}
+
+// saveCover write the cover found in the metadata, an existing cover is kept unless replace is true
+func (book *Book) saveCover(meta BookMetadata, replace bool) error {
+	if len(meta.Cover) == 0 {
+		return nil
 	}
 
+	bookIDStr := strconv.Itoa(int(book.ID))
 	coverFilePath := ""
-	if linkCover.Href != "" {
-		coverDirPath := "public/books/" + bookIDStr
-		if strings.ToLower(filepath.Ext(linkCover.Href)) == ".jpeg" || strings.ToLower(filepath.Ext(linkCover.Href)) == ".jpg" {
-			coverFilePath = coverDirPath + "/" + bookIDStr + ".jpg"
-		} else if strings.ToLower(filepath.Ext(linkCover.Href)) == ".png" {
-			coverFilePath = coverDirPath + "/" + bookIDStr + ".png"
+	coverType := meta.CoverType
+	if coverType != jpgMediaType && coverType != pngMediaType {
+		coverType = imageMediaType(meta.Cover)
+	}
+	coverDirPath := "public/books/" + bookIDStr
+	if coverType == jpgMediaType {
+		coverFilePath = coverDirPath + "/" + bookIDStr + ".jpg"
+	} else if coverType == pngMediaType {
+		coverFilePath = coverDirPath + "/" + bookIDStr + ".png"
+	}
+	fmt.Println(coverFilePath)
+	if coverFilePath == "" {
+		return nil
+	}
+
+	_, err := os.Stat(coverFilePath)
+	if os.IsNotExist(err) || replace {
+		os.MkdirAll(coverDirPath, os.ModePerm)
+		err = ioutil.WriteFile(coverFilePath, meta.Cover, 0644)
+		if err != nil {
+			fmt.Println(err)
+			return err
 		}
-		fmt.Println(coverFilePath)
-		if coverFilePath != "" {
-			_, err := os.Open(coverFilePath)
-			if os.IsNotExist(err) {
-
-				os.MkdirAll(coverDirPath, os.ModePerm)
-				coverReader, _, errFetch := fetcher.Fetch(&publication, linkCover.Href)
-				if errFetch == nil {
-					coverFile, err := os.Create(coverFilePath)
-					if err != nil {
-						fmt.Println(err)
-					}
-					io.Copy(coverFile, coverReader)
-					defer coverFile.Close()
-					book.CoverType = linkCover.TypeLink
-					book.CoverPath = coverFilePath
-				}
-			}
+		if replace && book.CoverPath != "" && book.CoverPath != coverFilePath {
+			os.Remove(book.CoverPath)
 		}
+		book.CoverType = coverType
+		book.CoverPath = coverFilePath
 	}
 	db.Save(&book)
+	return nil
+}
+
+// fileFormat get the format of the book file
+func (book *Book) fileFormat() Format {
+	return formatByName(book.Format)
 }
 
 // DownloadURL get url of the book
 func (book *Book) DownloadURL() string {
 	bookIDStr := strconv.Itoa(int(book.ID))
-	epubDirPath := "/books/" + bookIDStr
-	epubFilePath := epubDirPath + "/" + bookIDStr + ".epub"
-	return epubFilePath
+	bookDirPath := "/books/" + bookIDStr
+	bookFilePath := bookDirPath + "/" + bookIDStr + "." + book.fileFormat().Extension
+	return bookFilePath
 }
 
 // FilePath get filepath for the book on os
 func (book *Book) FilePath() string {
+	return book.filePathFor(book.fileFormat())
+}
+
+// FormatDownloadURL get url to download the file of the book in this format
+func (book *Book) FormatDownloadURL(format string) string {
+	return "/books/" + strconv.Itoa(int(book.ID)) + "/download/" + format
+}
+
+// bookFiles get the files of the book, the primary file first
+func (book *Book) bookFiles() []BookFile {
+	var files []BookFile
+
+	db.Where("book_id = ?", book.ID).Order("id asc").Find(&files)
+	return files
+}
+
+// filePathFor get filepath on os for the file of the book in this format
+func (book *Book) filePathFor(format Format) string {
 	bookIDStr := strconv.Itoa(int(book.ID))
-	epubDirPath := "public/books/" + bookIDStr
-	epubFilePath := epubDirPath + "/" + bookIDStr + ".epub"
-	return epubFilePath
+	return "public/books/" + bookIDStr + "/" + bookIDStr + "." + format.Extension
+}
+
+// FormatName return the display name of the format of the file
+func (file BookFile) FormatName() string {
+	return strings.ToUpper(file.Format)
 }
 
 // CoverDownloadURL get url for book cover
@@ -193,29 +262,29 @@ func (book Book) TagFormData() string {
 	return strings.Join(tagsString, ",")
 }
 
+// PublishedDate return the publication date as YYYY-MM-DD, empty when unknown
+func (book Book) PublishedDate() string {
+	if book.PublishedAt == nil {
+		return ""
+	}
+	return book.PublishedAt.Format("2006-01-02")
+}
+
 // ToURL return tag URL
 func (tag *Tag) ToURL() string {
-	return "/index.html?tag=" + strings.Replace(tag.Name, " ", "+", -1)
+	return "/index.html?tag=" + url.QueryEscape(tag.Name)
 }
 
 // BeforeDelete callback to clean assoction before deleting tag
 func (tag *Tag) BeforeDelete() (err error) {
+	var books []Book
+
 	if tag.ID != 0 {
-		db.Delete(BookTag{}, "tag_id =? ", tag.ID)
+		db.Joins("inner join book_tags on book_tags.book_id = books.id").Where("book_tags.tag_id = ?", tag.ID).Find(&books)
+		db.Unscoped().Delete(BookTag{}, "tag_id =? ", tag.ID)
+		for _, book := range books {
+			indexBook(db, &book)
+		}
 	}
 	return nil
 }
-
-// CountBooks get number of books by tag
-func (tag *Tag) CountBooks() int {
-	var count int
-
-	db.Model(&Book{}).Joins("inner join book_tags on book_tags.book_id = books.id inner join tags on book_tags.tag_id = tags.id").Where("tags.id = ?", tag.ID).Count(&count)
-	return count
-}
-
-type ByBookCount []Tag
-
-func (c ByBookCount) Len() int           { return len(c) }
-func (c ByBookCount) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
-func (c ByBookCount) Less(i, j int) bool { return c[i].CountBooks() > c[j].CountBooks() }
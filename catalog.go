@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/gorilla/mux"
+)
+
+// OPDS 1.2 feed types
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsEntryType       = "application/atom+xml;type=entry;profile=opds-catalog"
+)
+
+// CatalogEntry is a subsection of a navigation feed
+type CatalogEntry struct {
+	ID      string
+	Title   string
+	Content string
+	Path    string
+	Kind    string
+	Rel     string
+	Count   int
+}
+
+// valueCount is a value of a book column with the number of books having it
+type valueCount struct {
+	Value string
+	Count int
+}
+
+// rootCatalog return true when the request ask the root of the catalog, not a list of books
+func rootCatalog(req *http.Request) bool {
+	for key := range req.URL.Query() {
+		if key != "token" {
+			return false
+		}
+	}
+	return true
+}
+
+// rootCatalogEntries return the subsections of the root catalog, paths have no extension
+func rootCatalogEntries() []CatalogEntry {
+	return []CatalogEntry{
+		{ID: "new", Title: "Nouveautés", Content: "Les derniers livres ajoutés", Path: "/index?order=new", Kind: "acquisition", Rel: "http://opds-spec.org/sort/new"},
+		{ID: "favorite", Title: "Favoris", Content: "Vos livres favoris", Path: "/index?filter=favorite", Kind: "acquisition", Rel: "subsection"},
+		{ID: "unread", Title: "Non lus", Content: "Les livres que vous n'avez pas lus", Path: "/index?filter=notread", Kind: "acquisition", Rel: "subsection"},
+		{ID: "authors", Title: "Par auteur", Content: "Les livres classés par auteur", Path: "/authors", Kind: "navigation", Rel: "subsection"},
+		{ID: "shelves", Title: "Étagères", Content: "Vos étagères et les étagères publiques", Path: "/shelves", Kind: "navigation", Rel: "subsection"},
+		{ID: "series", Title: "Par série", Content: "Les livres classés par série", Path: "/series", Kind: "navigation", Rel: "subsection"},
+		{ID: "tags", Title: "Par tag", Content: "Les livres classés par tag", Path: "/tags", Kind: "navigation", Rel: "subsection"},
+		{ID: "languages", Title: "Par langue", Content: "Les livres classés par langue", Path: "/languages", Kind: "navigation", Rel: "subsection"},
+		{ID: "publishers", Title: "Par éditeur", Content: "Les livres classés par éditeur", Path: "/publishers", Kind: "navigation", Rel: "subsection"},
+	}
+}
+
+// catalogPath add the extension of the feed to a path without one, before the query
+func catalogPath(path string, ext string) string {
+	u, _ := url.Parse(path)
+	u.Path = u.Path + "." + ext
+	return u.String()
+}
+
+// navigationEntryOpds add a subsection entry to a navigation feed
+func navigationEntryOpds(feed *etree.Element, entry CatalogEntry, baseURL string, token string) {
+	kind := opdsAcquisitionType
+	if entry.Kind == "navigation" {
+		kind = opdsNavigationType
+	}
+
+	e := feed.CreateElement("entry")
+	e.CreateElement("title").SetText(entry.Title)
+	e.CreateElement("id").SetText(entry.ID)
+	e.CreateElement("updated").SetText(time.Now().Format(time.RFC3339))
+	if entry.Content != "" {
+		content := e.CreateElement("content")
+		content.CreateAttr("type", "text")
+		content.SetText(entry.Content)
+	}
+	link := e.CreateElement("link")
+	link.CreateAttr("rel", entry.Rel)
+	link.CreateAttr("type", kind)
+	link.CreateAttr("href", baseURL+withToken(catalogPath(entry.Path, atomExt), token))
+	if entry.Count > 0 {
+		link.CreateAttr("thr:count", strconv.Itoa(entry.Count))
+	}
+}
+
+// navigationLinkOpds2 return the link of a subsection entry in an OPDS 2.0 feed
+func navigationLinkOpds2(entry CatalogEntry, baseURL string, token string) Opds2Link {
+	return Opds2Link{
+		Href:  baseURL + withToken(catalogPath(entry.Path, jsonExt), token),
+		Type:  opds2MediaType,
+		Rel:   entry.Rel,
+		Title: entry.Title,
+	}
+}
+
+// rootCatalogHandler serve the root navigation catalog
+func rootCatalogHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	vars := mux.Vars(req)
+	token := req.URL.Query().Get("token")
+	baseURL := RootURL(req)
+
+	if vars["format"] == jsonExt {
+		feed := baseOpds2(serverOption.UUID, serverOption.Name, 0, 0, 0, baseURL+req.URL.String(), "", "", "", "", token)
+		for _, entry := range rootCatalogEntries() {
+			feed.Navigation = append(feed.Navigation, navigationLinkOpds2(entry, baseURL, token))
+		}
+		writeOpds2(res, opds2MediaType, feed)
+		return
+	}
+
+	res.Header().Set("Content-Type", opdsNavigationType)
+	baseDoc := etree.NewDocument()
+	baseDoc.Indent(2)
+	feed := baseOpds(baseDoc, serverOption.UUID, serverOption.Name, 0, 0, 0, baseURL, req.URL.String(), "", "", "", opdsNavigationType, token)
+	for _, entry := range rootCatalogEntries() {
+		entry.ID = serverOption.UUID + ":" + entry.ID
+		navigationEntryOpds(feed, entry, baseURL, token)
+	}
+	xmlString, _ := baseDoc.WriteToString()
+	fmt.Fprintf(res, xmlString)
+}
+
+// navigationFeedHandler serve a navigation feed listing the entries, each one leading to a list of books
+func navigationFeedHandler(res http.ResponseWriter, req *http.Request, id string, title string, entries []CatalogEntry) {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	vars := mux.Vars(req)
+	token := req.URL.Query().Get("token")
+	baseURL := RootURL(req)
+
+	if vars["format"] == jsonExt {
+		feed := baseOpds2(serverOption.UUID+":"+id, title, len(entries), 0, 1, baseURL+req.URL.String(), "", "", "", "", token)
+		for _, entry := range entries {
+			feed.Navigation = append(feed.Navigation, navigationLinkOpds2(entry, baseURL, token))
+		}
+		writeOpds2(res, opds2MediaType, feed)
+		return
+	}
+
+	res.Header().Set("Content-Type", opdsNavigationType)
+	baseDoc := etree.NewDocument()
+	baseDoc.Indent(2)
+	feed := baseOpds(baseDoc, serverOption.UUID+":"+id, title, len(entries), 0, 0, baseURL, req.URL.String(), "/index.atom", "", "", opdsNavigationType, token)
+	for _, entry := range entries {
+		navigationEntryOpds(feed, entry, baseURL, token)
+	}
+	xmlString, _ := baseDoc.WriteToString()
+	fmt.Fprintf(res, xmlString)
+}
+
+// bookValueCounts return the values of a column of books with their number of books
+func bookValueCounts(column string) []valueCount {
+	var values []valueCount
+
+	db.Table("books").Select(column + " AS value, count(*) AS count").
+		Where("deleted_at IS NULL AND " + column + " <> ''").
+		Group(column).Order(column + " COLLATE NOCASE asc").Scan(&values)
+	return values
+}
+
+// valueEntries turn column values into entries leading to the books filtered by param
+func valueEntries(values []valueCount, id string, param string) []CatalogEntry {
+	var entries []CatalogEntry
+
+	for _, value := range values {
+		entries = append(entries, CatalogEntry{
+			ID:      "urn:myopds:" + id + ":" + url.QueryEscape(value.Value),
+			Title:   value.Value,
+			Content: strconv.Itoa(value.Count) + " livres",
+			Path:    "/index?" + param + "=" + url.QueryEscape(value.Value),
+			Kind:    "acquisition",
+			Rel:     "subsection",
+			Count:   value.Count,
+		})
+	}
+	return entries
+}
+
+func languagesHandler(res http.ResponseWriter, req *http.Request) {
+	navigationFeedHandler(res, req, "languages", "Langues", valueEntries(bookValueCounts("language"), "language", "language"))
+}
+
+func publishersHandler(res http.ResponseWriter, req *http.Request) {
+	navigationFeedHandler(res, req, "publishers", "Éditeurs", valueEntries(bookValueCounts("publisher"), "publisher", "publisher"))
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // covers uploaded as gif are converted
+	"image/jpeg"
+	_ "image/png" // decode png covers
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/beevik/etree"
+	"github.com/gorilla/mux"
+)
+
+// coverCacheDir keep the resized covers and the generated placeholders
+const coverCacheDir = "db/cache/covers"
+
+// maxCoverSize is the size limit of a cover uploaded or downloaded from a url
+const maxCoverSize = 10 * 1024 * 1024
+
+// maxCoverPixels is the largest cover decoded, a small file can declare a huge image
+const maxCoverPixels = 40 * 1000 * 1000
+
+// CoverSize is a size of cover served to the grid and OPDS clients
+type CoverSize struct {
+	Name   string
+	Width  int
+	Height int
+}
+
+// coverSizes list the generated sizes, full is only generated for placeholders
+var coverSizes = []CoverSize{
+	{"thumb", 240, 360},
+	{"medium", 480, 720},
+	{"full", 800, 1200},
+}
+
+var errInvalidCover = errors.New("l'image n'est pas un JPEG, un PNG ou un GIF")
+
+var errCoverTooLarge = errors.New("l'image est trop grande")
+
+// decodeCoverConfig check the image and its dimensions before it is decoded
+func decodeCoverConfig(data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errInvalidCover
+	}
+	if int64(config.Width)*int64(config.Height) > maxCoverPixels {
+		return errCoverTooLarge
+	}
+	return nil
+}
+
+// coverSize return the size with this name
+func coverSize(name string) (CoverSize, bool) {
+	for _, size := range coverSizes {
+		if size.Name == name {
+			return size, true
+		}
+	}
+	return CoverSize{}, false
+}
+
+// CoverSizeURL return the url of the cover in this size, a placeholder is served for books without cover
+func (book Book) CoverSizeURL(size string) string {
+	return "/books/" + strconv.Itoa(int(book.ID)) + "/cover/" + size + ".jpg"
+}
+
+// ThumbnailURL return the url of the small cover used by the grid
+func (book Book) ThumbnailURL() string {
+	return book.CoverSizeURL("thumb")
+}
+
+// MediumURL return the url of the cover shown on the book page
+func (book Book) MediumURL() string {
+	return book.CoverSizeURL("medium")
+}
+
+// ImageURL return the url of the full cover, the placeholder when the book has none
+func (book Book) ImageURL() string {
+	if url := book.CoverDownloadURL(); url != "" {
+		return url
+	}
+	return book.CoverSizeURL("full")
+}
+
+// ImageType return the media type of the full cover
+func (book Book) ImageType() string {
+	if book.CoverDownloadURL() != "" {
+		return book.CoverType
+	}
+	return jpgMediaType
+}
+
+// replaceCover store an uploaded cover, other formats than jpeg and png are converted to jpeg
+func (book *Book) replaceCover(data []byte) error {
+	if err := decodeCoverConfig(data); err != nil {
+		return err
+	}
+	coverType := imageMediaType(data)
+	if coverType == "" {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return errInvalidCover
+		}
+		var buf bytes.Buffer
+		jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+		data = buf.Bytes()
+		coverType = jpgMediaType
+	}
+	if err := book.saveCover(BookMetadata{Cover: data, CoverType: coverType}, true); err != nil {
+		return err
+	}
+	// the resized covers and the placeholders of the previous cover are no longer used
+	old, _ := filepath.Glob(filepath.Join(coverCacheDir, strconv.Itoa(int(book.ID))+"-*"))
+	for _, oldPath := range old {
+		os.Remove(oldPath)
+	}
+	return nil
+}
+
+// uploadedCover return the cover sent with the edit form, as a file or as a url, nil when there is none
+func uploadedCover(req *http.Request) ([]byte, error) {
+	file, _, err := req.FormFile("cover")
+	if err == nil {
+		defer file.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(file, maxCoverSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxCoverSize {
+			return nil, errors.New("couverture trop grosse")
+		}
+		return data, nil
+	}
+	if coverURL := strings.TrimSpace(req.FormValue("cover_url")); coverURL != "" {
+		return downloadCover(coverURL)
+	}
+	return nil, nil
+}
+
+// publicAddress refuse the connections to the server itself and to the local network,
+// the address is checked after the name resolution and for each redirect
+func publicAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return errors.New("adresse non autorisée " + host)
+	}
+	return nil
+}
+
+// downloadCover fetch a cover from a url
+func downloadCover(coverURL string) ([]byte, error) {
+	if !strings.HasPrefix(coverURL, "http://") && !strings.HasPrefix(coverURL, "https://") {
+		return nil, errors.New("url invalide")
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicAddress}
+	client := http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{DialContext: dialer.DialContext}}
+	resp, err := client.Get(coverURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("téléchargement de la couverture: " + resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCoverSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCoverSize {
+		return nil, errors.New("couverture trop grosse")
+	}
+	return data, nil
+}
+
+// resizeImage reduce the image to fit in the size, each pixel is the average of the pixels it covers
+func resizeImage(src image.Image, maxWidth int, maxHeight int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxWidth && height <= maxHeight {
+		return src
+	}
+	ratio := float64(maxWidth) / float64(width)
+	if r := float64(maxHeight) / float64(height); r < ratio {
+		ratio = r
+	}
+	dstWidth := int(float64(width)*ratio + 0.5)
+	dstHeight := int(float64(height)*ratio + 0.5)
+	if dstWidth < 1 {
+		dstWidth = 1
+	}
+	if dstHeight < 1 {
+		dstHeight = 1
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0 := y * height / dstHeight
+		y1 := (y + 1) * height / dstHeight
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dstWidth; x++ {
+			x0 := x * width / dstWidth
+			x1 := (x + 1) * width / dstWidth
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				offset := rgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(rgba.Pix[offset])
+					g += int(rgba.Pix[offset+1])
+					b += int(rgba.Pix[offset+2])
+					a += int(rgba.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// placeholderColors are the background of generated covers, chosen from the title
+var placeholderColors = []color.RGBA{
+	{0x2c, 0x3e, 0x50, 0xff},
+	{0x7b, 0x24, 0x1c, 0xff},
+	{0x1e, 0x56, 0x4f, 0xff},
+	{0x4a, 0x23, 0x5a, 0xff},
+	{0x6e, 0x4b, 0x1f, 0xff},
+	{0x1b, 0x4f, 0x72, 0xff},
+	{0x51, 0x5a, 0x5a, 0xff},
+	{0x7d, 0x3c, 0x98, 0xff},
+}
+
+// placeholderCover draw a cover with the title and the authors of the book
+func placeholderCover(book Book, size CoverSize) image.Image {
+	hash := fnv.New32a()
+	hash.Write([]byte(book.Title))
+	background := placeholderColors[hash.Sum32()%uint32(len(placeholderColors))]
+	foreground := color.RGBA{0xf5, 0xf0, 0xe1, 0xff}
+
+	img := image.NewRGBA(image.Rect(0, 0, size.Width, size.Height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+	margin := size.Width / 12
+	border := size.Width / 80
+	if border < 1 {
+		border = 1
+	}
+	// frame
+	frame := image.Rect(margin/2, margin/2, size.Width-margin/2, size.Height-margin/2)
+	draw.Draw(img, frame, &image.Uniform{foreground}, image.Point{}, draw.Src)
+	draw.Draw(img, frame.Inset(border), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	titleScale := (size.Width - 2*margin) / (12 * glyphAdvance)
+	if titleScale < 1 {
+		titleScale = 1
+	}
+	authorScale := titleScale * 2 / 3
+	if authorScale < 1 {
+		authorScale = 1
+	}
+
+	y := size.Height / 5
+	for _, line := range wrapText(book.Title, (size.Width-2*margin)/(glyphAdvance*titleScale), 6) {
+		drawText(img, line, size.Width/2, y, titleScale, foreground)
+		y += glyphLineHeight * titleScale
+	}
+
+	var names []string
+	for _, author := range book.Authors {
+		names = append(names, author.Name)
+	}
+	y = size.Height * 3 / 4
+	for _, line := range wrapText(strings.Join(names, ", "), (size.Width-2*margin)/(glyphAdvance*authorScale), 3) {
+		drawText(img, line, size.Width/2, y, authorScale, foreground)
+		y += glyphLineHeight * authorScale
+	}
+	return img
+}
+
+// wrapText cut the text in lines of at most width characters, the last line end with an ellipsis when the text is too long
+func wrapText(text string, width int, maxLines int) []string {
+	var lines []string
+	line := ""
+
+	if width < 1 {
+		width = 1
+	}
+	for _, word := range strings.Fields(fontText(text)) {
+		for len(word) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			lines = append(lines, word[:width])
+			word = word[width:]
+		}
+		if line == "" {
+			line = word
+		} else if len(line)+1+len(word) <= width {
+			line += " " + word
+		} else {
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+		last := lines[maxLines-1]
+		if len(last)+3 > width && width > 3 {
+			last = last[:width-3]
+		}
+		lines[maxLines-1] = last + "..."
+	}
+	return lines
+}
+
+// fontAccents replace the letters the bitmap font doesn't have
+var fontAccents = strings.NewReplacer(
+	"À", "A", "Â", "A", "Ä", "A", "Á", "A", "Ã", "A", "Å", "A",
+	"Ç", "C", "É", "E", "È", "E", "Ê", "E", "Ë", "E",
+	"Î", "I", "Ï", "I", "Í", "I", "Ì", "I", "Ñ", "N",
+	"Ô", "O", "Ö", "O", "Ó", "O", "Ò", "O", "Õ", "O", "Ø", "O",
+	"Ù", "U", "Û", "U", "Ü", "U", "Ú", "U", "Ÿ", "Y", "Ý", "Y",
+	"Œ", "OE", "Æ", "AE", "ß", "SS", "’", "'", "«", "", "»", "", "–", "-", "—", "-",
+)
+
+// fontText return the text in upper case with only the characters of the bitmap font
+func fontText(text string) string {
+	text = fontAccents.Replace(strings.ToUpper(text))
+	return strings.Map(func(r rune) rune {
+		if _, ok := glyphs[r]; ok {
+			return r
+		}
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return -1
+	}, text)
+}
+
+const glyphAdvance = 6
+const glyphLineHeight = 10
+
+// glyphs is a 5x7 bitmap font, one byte per column with the top row in the lowest bit
+var glyphs = map[rune][5]byte{
+	' ':  {0x00, 0x00, 0x00, 0x00, 0x00},
+	'!':  {0x00, 0x00, 0x5F, 0x00, 0x00},
+	'&':  {0x36, 0x49, 0x55, 0x22, 0x50},
+	'\'': {0x00, 0x05, 0x03, 0x00, 0x00},
+	'(':  {0x00, 0x1C, 0x22, 0x41, 0x00},
+	')':  {0x00, 0x41, 0x22, 0x1C, 0x00},
+	',':  {0x00, 0x50, 0x30, 0x00, 0x00},
+	'-':  {0x08, 0x08, 0x08, 0x08, 0x08},
+	'.':  {0x00, 0x60, 0x60, 0x00, 0x00},
+	'0':  {0x3E, 0x51, 0x49, 0x45, 0x3E},
+	'1':  {0x00, 0x42, 0x7F, 0x40, 0x00},
+	'2':  {0x42, 0x61, 0x51, 0x49, 0x46},
+	'3':  {0x21, 0x41, 0x45, 0x4B, 0x31},
+	'4':  {0x18, 0x14, 0x12, 0x7F, 0x10},
+	'5':  {0x27, 0x45, 0x45, 0x45, 0x39},
+	'6':  {0x3C, 0x4A, 0x49, 0x49, 0x30},
+	'7':  {0x01, 0x71, 0x09, 0x05, 0x03},
+	'8':  {0x36, 0x49, 0x49, 0x49, 0x36},
+	'9':  {0x06, 0x49, 0x49, 0x29, 0x1E},
+	':':  {0x00, 0x36, 0x36, 0x00, 0x00},
+	'?':  {0x02, 0x01, 0x51, 0x09, 0x06},
+	'A':  {0x7E, 0x11, 0x11, 0x11, 0x7E},
+	'B':  {0x7F, 0x49, 0x49, 0x49, 0x36},
+	'C':  {0x3E, 0x41, 0x41, 0x41, 0x22},
+	'D':  {0x7F, 0x41, 0x41, 0x22, 0x1C},
+	'E':  {0x7F, 0x49, 0x49, 0x49, 0x41},
+	'F':  {0x7F, 0x09, 0x09, 0x09, 0x01},
+	'G':  {0x3E, 0x41, 0x49, 0x49, 0x7A},
+	'H':  {0x7F, 0x08, 0x08, 0x08, 0x7F},
+	'I':  {0x00, 0x41, 0x7F, 0x41, 0x00},
+	'J':  {0x20, 0x40, 0x41, 0x3F, 0x01},
+	'K':  {0x7F, 0x08, 0x14, 0x22, 0x41},
+	'L':  {0x7F, 0x40, 0x40, 0x40, 0x40},
+	'M':  {0x7F, 0x02, 0x0C, 0x02, 0x7F},
+	'N':  {0x7F, 0x04, 0x08, 0x10, 0x7F},
+	'O':  {0x3E, 0x41, 0x41, 0x41, 0x3E},
+	'P':  {0x7F, 0x09, 0x09, 0x09, 0x06},
+	'Q':  {0x3E, 0x41, 0x51, 0x21, 0x5E},
+	'R':  {0x7F, 0x09, 0x19, 0x29, 0x46},
+	'S':  {0x46, 0x49, 0x49, 0x49, 0x31},
+	'T':  {0x01, 0x01, 0x7F, 0x01, 0x01},
+	'U':  {0x3F, 0x40, 0x40, 0x40, 0x3F},
+	'V':  {0x1F, 0x20, 0x40, 0x20, 0x1F},
+	'W':  {0x3F, 0x40, 0x38, 0x40, 0x3F},
+	'X':  {0x63, 0x14, 0x08, 0x14, 0x63},
+	'Y':  {0x07, 0x08, 0x70, 0x08, 0x07},
+	'Z':  {0x61, 0x51, 0x49, 0x45, 0x43},
+}
+
+// drawText draw a line of text centered on x, y is the top of the line
+func drawText(img *image.RGBA, text string, x int, y int, scale int, c color.RGBA) {
+	left := x - (len(text)*glyphAdvance-1)*scale/2
+	for i, r := range text {
+		glyph := glyphs[r]
+		for column, bits := range glyph {
+			for row := 0; row < 7; row++ {
+				if bits&(1<<uint(row)) == 0 {
+					continue
+				}
+				px := left + (i*glyphAdvance+column)*scale
+				py := y + row*scale
+				draw.Draw(img, image.Rect(px, py, px+scale, py+scale), &image.Uniform{c}, image.Point{}, draw.Src)
+			}
+		}
+	}
+}
+
+// coverImage return the path of the cover of the book in the size, resized or generated on first use
+func coverImage(book Book, size CoverSize) (string, error) {
+	source := ""
+	key := sha256.New()
+	fmt.Fprintln(key, size.Name, size.Width, size.Height)
+	if info, err := os.Stat(book.CoverPath); err == nil && book.CoverPath != "" {
+		source = book.CoverPath
+		fmt.Fprintln(key, book.CoverPath, info.ModTime().UnixNano(), info.Size())
+	} else {
+		db.Model(&book).Related(&book.Authors, "Authors")
+		fmt.Fprintln(key, "placeholder", book.Title)
+		for _, author := range book.Authors {
+			fmt.Fprintln(key, author.Name)
+		}
+	}
+
+	prefix := filepath.Join(coverCacheDir, strconv.Itoa(int(book.ID))+"-"+size.Name+"-")
+	cachePath := prefix + hex.EncodeToString(key.Sum(nil))[:16] + ".jpg"
+	if _, err := os.Stat(cachePath); err == nil {
+		return cachePath, nil
+	}
+
+	var img image.Image
+	if source != "" {
+		data, err := ioutil.ReadFile(source)
+		if err != nil {
+			return "", err
+		}
+		if err := decodeCoverConfig(data); err != nil {
+			return "", err
+		}
+		decoded, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		img = resizeImage(decoded, size.Width, size.Height)
+	} else {
+		img = placeholderCover(book, size)
+	}
+
+	os.MkdirAll(coverCacheDir, os.ModePerm)
+	old, _ := filepath.Glob(prefix + "*")
+	for _, oldPath := range old {
+		os.Remove(oldPath)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return "", err
+	}
+	// written aside then renamed, a request running at the same time never see a partial file
+	tmpPath := cachePath + ".tmp" + randomHex(4)
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return cachePath, os.Rename(tmpPath, cachePath)
+}
+
+// coverImageHandler serve the cover of the book in a size, the full size of a real cover is the original file
+func coverImageHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+
+	vars := mux.Vars(req)
+	db.Find(&book, vars["id"])
+	size, ok := coverSize(vars["size"])
+	if book.ID == 0 || !ok {
+		http.NotFound(res, req)
+		return
+	}
+
+	imagePath := book.CoverPath
+	if _, err := os.Stat(imagePath); size.Name != "full" || err != nil || imagePath == "" {
+		var err error
+		imagePath, err = coverImage(book, size)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	f, err := os.Open(imagePath)
+	if err != nil {
+		http.NotFound(res, req)
+		return
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+
+	res.Header().Set("Cache-Control", "private,max-age=3600")
+	http.ServeContent(res, req, filepath.Base(imagePath), info.ModTime(), f)
+}
+
+// coverLinksOpds add the cover and thumbnail links to an OPDS entry
+func coverLinksOpds(entry *etree.Element, book Book, baseURL string, token string) {
+	linkCover := entry.CreateElement("link")
+	linkCover.CreateAttr("rel", "http://opds-spec.org/image")
+	linkCover.CreateAttr("type", book.ImageType())
+	linkCover.CreateAttr("href", baseURL+withToken(book.ImageURL(), token))
+
+	linkThumbnail := entry.CreateElement("link")
+	linkThumbnail.CreateAttr("rel", "http://opds-spec.org/image/thumbnail")
+	linkThumbnail.CreateAttr("type", jpgMediaType)
+	linkThumbnail.CreateAttr("href", baseURL+withToken(book.ThumbnailURL(), token))
+}
+
+// coverImagesOpds2 return the images of an OPDS 2.0 publication, from the biggest
+func coverImagesOpds2(book Book, baseURL string, token string) []Opds2Link {
+	images := []Opds2Link{{Href: baseURL + withToken(book.ImageURL(), token), Type: book.ImageType()}}
+	for _, name := range []string{"medium", "thumb"} {
+		size, _ := coverSize(name)
+		images = append(images, Opds2Link{
+			Href:   baseURL + withToken(book.CoverSizeURL(name), token),
+			Type:   jpgMediaType,
+			Width:  size.Width,
+			Height: size.Height,
+		})
+	}
+	return images
+}
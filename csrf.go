@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"text/template"
+
+	sessions "github.com/goincremental/negroni-sessions"
+)
+
+const csrfField = "csrf_token"
+
+// csrfActions match the GET routes changing something, they need a token like POST forms
+var csrfActions = regexp.MustCompile(`/(delete|favorite|readed|refresh|extract|retry|revoke|logout)$`)
+
+// randomHex return n random bytes encoded in hexadecimal
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// csrfToken return the CSRF token of the session, it is created on first use
+func csrfToken(req *http.Request) string {
+	session := sessions.GetSession(req)
+	token, ok := session.Get(csrfField).(string)
+	if !ok || token == "" {
+		token = randomHex(32)
+		session.Set(csrfField, token)
+	}
+	return token
+}
+
+// csrfProtected return true for requests changing the library
+func csrfProtected(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return true
+	}
+	return csrfActions.MatchString(req.URL.Path)
+}
+
+// validCSRF compare the token sent in the form or the query with the token of the session
+func validCSRF(req *http.Request) bool {
+	sent := req.Header.Get("X-CSRF-Token")
+	if sent == "" {
+		sent = req.FormValue(csrfField)
+	}
+	token, _ := sessions.GetSession(req).Get(csrfField).(string)
+	if token == "" || sent == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+// csrfFuncs give templates the CSRF token of the request, as a value for links and as a hidden field for forms
+func csrfFuncs(req *http.Request) template.FuncMap {
+	// the token is read before rendering, the session cookie is written with the headers
+	value := ""
+	if req != nil {
+		value = csrfToken(req)
+	}
+	token := func() string {
+		return value
+	}
+	return template.FuncMap{
+		"csrfToken": token,
+		"csrfField": func() string {
+			return `<input type="hidden" name="` + csrfField + `" value="` + token() + `">`
+		},
+	}
+}
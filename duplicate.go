@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+)
+
+// policies for an imported file already in the library
+const (
+	duplicateSkip   = "skip"
+	duplicateMerge  = "merge"
+	duplicateImport = "import"
+)
+
+// reasons of a duplicate
+const (
+	duplicateSameFile  = "Fichier identique"
+	duplicateSameIsbn  = "Même ISBN"
+	duplicateSameTitle = "Même titre et auteur"
+)
+
+// maxTitleDuplicates limit the titles checked for duplicates on the review page
+const maxTitleDuplicates = 50
+
+var accentReplacer = strings.NewReplacer(
+	"à", "a", "â", "a", "ä", "a", "á", "a", "ã", "a",
+	"ç", "c",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"î", "i", "ï", "i", "í", "i", "ì", "i",
+	"ô", "o", "ö", "o", "ó", "o", "ò", "o", "õ", "o",
+	"û", "u", "ü", "u", "ú", "u", "ù", "u",
+	"ÿ", "y", "ñ", "n", "œ", "oe", "æ", "ae",
+)
+
+// DuplicateIgnore store two books marked as not duplicates on the review page
+type DuplicateIgnore struct {
+	gorm.Model
+	BookID  uint `gorm:"index"`
+	OtherID uint
+}
+
+// DuplicateGroup is a set of books which may be the same book
+type DuplicateGroup struct {
+	Reason string
+	Books  []Book
+}
+
+// normalizeIsbn return the ISBN-13 of an ISBN-10 or ISBN-13, an empty string if it is not an ISBN
+func normalizeIsbn(isbn string) string {
+	var digits []byte
+
+	isbn = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(isbn)), "urn:isbn:")
+	for _, c := range []byte(isbn) {
+		if c >= '0' && c <= '9' || (c == 'x' && len(digits) == 9) {
+			digits = append(digits, c)
+		}
+	}
+
+	if len(digits) == 10 {
+		digits = append([]byte("978"), digits[:9]...)
+		sum := 0
+		for i, c := range digits {
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += int(c-'0') * weight
+		}
+		digits = append(digits, byte('0'+(10-sum%10)%10))
+	}
+	if len(digits) != 13 || bytes.IndexByte(digits, 'x') >= 0 {
+		return ""
+	}
+	return string(digits)
+}
+
+// normalizeTitle return the title in lower case without accents nor punctuation
+func normalizeTitle(title string) string {
+	title = accentReplacer.Replace(strings.ToLower(title))
+	words := strings.FieldsFunc(title, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// BeforeSave callback to keep the duplicate keys and the sort title of the book up to date
+func (book *Book) BeforeSave() error {
+	book.IsbnKey = normalizeIsbn(book.Isbn)
+	book.TitleKey = normalizeTitle(book.Title)
+	book.TitleSort = sortTitle(book.Title)
+	return nil
+}
+
+// setupDuplicateKeys fill the duplicate keys of books imported before they existed
+func setupDuplicateKeys() {
+	var books []Book
+
+	db.Where("title_key IS NULL OR title_key = ''").Find(&books)
+	for _, book := range books {
+		db.Model(&book).UpdateColumns(map[string]interface{}{"isbn_key": normalizeIsbn(book.Isbn), "title_key": normalizeTitle(book.Title)})
+	}
+}
+
+// duplicatePolicy return the policy for imported duplicates, the command line flag win over the settings
+func duplicatePolicy() string {
+	var serverOption ServerOption
+
+	if *duplicatesFlag != "" {
+		return *duplicatesFlag
+	}
+	db.First(&serverOption)
+	if serverOption.DuplicatePolicy == "" {
+		return duplicateSkip
+	}
+	return serverOption.DuplicatePolicy
+}
+
+// findDuplicate return the book having the same file, the same ISBN or the same title and author than the file
+func findDuplicate(filePath string, format Format) (Book, string) {
+	var book Book
+	var books []Book
+	var bookFile BookFile
+
+	db.Where("checksum = ?", fileChecksum(filePath)).First(&bookFile)
+	if bookFile.ID != 0 {
+		db.Find(&book, bookFile.BookID)
+		if book.ID != 0 {
+			return book, duplicateSameFile
+		}
+	}
+
+	meta, err := format.Handler.Metadata(filePath)
+	if err != nil {
+		return book, ""
+	}
+	if isbn := normalizeIsbn(meta.Isbn); isbn != "" {
+		db.Where("isbn_key = ?", isbn).First(&book)
+		if book.ID != 0 {
+			return book, duplicateSameIsbn
+		}
+	}
+
+	title := meta.Title
+	if title == "" {
+		title = titleFromFilename(filePath)
+	}
+	titleKey := normalizeTitle(title)
+	if titleKey == "" {
+		return book, ""
+	}
+	// like on the review page, books with the same title are duplicates when they share an author
+	authors := map[string]bool{}
+	for _, author := range meta.Authors {
+		authors[normalizeTitle(author)] = true
+	}
+	db.Preload("Authors").Where("title_key = ?", titleKey).Order("id asc").Find(&books)
+	for _, candidate := range books {
+		if len(candidate.Authors) == 0 && len(authors) == 0 {
+			return candidate, duplicateSameTitle
+		}
+		for _, author := range candidate.Authors {
+			if authors[normalizeTitle(author.Name)] {
+				return candidate, duplicateSameTitle
+			}
+		}
+	}
+	return Book{}, ""
+}
+
+// duplicateGroups return the books with the same file, the same ISBN or the same title and author
+func duplicateGroups() []DuplicateGroup {
+	var groups []DuplicateGroup
+	var ignores []DuplicateIgnore
+
+	seen := map[string]bool{}
+	ignored := map[[2]uint]bool{}
+	db.Find(&ignores)
+	for _, ignore := range ignores {
+		ignored[[2]uint{ignore.BookID, ignore.OtherID}] = true
+		ignored[[2]uint{ignore.OtherID, ignore.BookID}] = true
+	}
+
+	add := func(reason string, bookIDs []uint) {
+		if len(bookIDs) < 2 {
+			return
+		}
+		sort.Slice(bookIDs, func(i, j int) bool { return bookIDs[i] < bookIDs[j] })
+		key := fmt.Sprint(bookIDs)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+
+		allIgnored := true
+		for i := range bookIDs {
+			for j := i + 1; j < len(bookIDs); j++ {
+				if !ignored[[2]uint{bookIDs[i], bookIDs[j]}] {
+					allIgnored = false
+				}
+			}
+		}
+		if allIgnored {
+			return
+		}
+
+		var books []Book
+		db.Preload("Authors").Preload("Files").Where("id IN (?)", bookIDs).Order("id asc").Find(&books)
+		if len(books) > 1 {
+			groups = append(groups, DuplicateGroup{Reason: reason, Books: books})
+		}
+	}
+
+	rows, err := db.Raw("SELECT checksum FROM book_files WHERE deleted_at IS NULL AND checksum <> '' GROUP BY checksum HAVING count(DISTINCT book_id) > 1").Rows()
+	if err == nil {
+		var checksums []string
+		for rows.Next() {
+			var checksum string
+			rows.Scan(&checksum)
+			checksums = append(checksums, checksum)
+		}
+		rows.Close()
+		for _, checksum := range checksums {
+			var bookIDs []uint
+			db.Model(&BookFile{}).Where("checksum = ?", checksum).Pluck("DISTINCT book_id", &bookIDs)
+			add(duplicateSameFile, bookIDs)
+		}
+	}
+
+	var isbns []string
+	db.Model(&Book{}).Where("isbn_key <> ''").Group("isbn_key").Having("count(*) > 1").Pluck("isbn_key", &isbns)
+	for _, isbn := range isbns {
+		var bookIDs []uint
+		db.Model(&Book{}).Where("isbn_key = ?", isbn).Pluck("id", &bookIDs)
+		add(duplicateSameIsbn, bookIDs)
+	}
+
+	var titles []string
+	db.Model(&Book{}).Where("title_key <> ''").Group("title_key").Having("count(*) > 1").Limit(maxTitleDuplicates).Pluck("title_key", &titles)
+	for _, title := range titles {
+		var books []Book
+		db.Preload("Authors").Where("title_key = ?", title).Find(&books)
+		// books with the same title are duplicates when they share an author
+		byAuthor := map[string][]uint{}
+		for _, book := range books {
+			if len(book.Authors) == 0 {
+				byAuthor[""] = append(byAuthor[""], book.ID)
+			}
+			for _, author := range book.Authors {
+				name := normalizeTitle(author.Name)
+				byAuthor[name] = append(byAuthor[name], book.ID)
+			}
+		}
+		for _, bookIDs := range byAuthor {
+			add(duplicateSameTitle, bookIDs)
+		}
+	}
+
+	return groups
+}
+
+// mergeBooks move the files, authors, tags, reading states and shelves of other to keep and delete other
+func mergeBooks(keep *Book, other *Book) error {
+	var files []BookFile
+
+	if keep.ID == other.ID || db.Preload("Authors").Preload("Tags").First(keep, keep.ID).RecordNotFound() || db.Preload("Authors").Preload("Tags").First(other, other.ID).RecordNotFound() {
+		return errJobBookNotFound
+	}
+
+	// the files are copied before the transaction, they are removed if it fail
+	otherFiles := other.bookFiles()
+	for _, file := range otherFiles {
+		var existing BookFile
+		db.Where("book_id = ? AND format = ?", keep.ID, file.Format).First(&existing)
+		if existing.ID == 0 {
+			var copied BookFile
+			if err := copyBookFile(file.Path, keep, formatByName(file.Format), &copied); err != nil {
+				removeBookFiles(files)
+				return err
+			}
+			files = append(files, copied)
+		}
+	}
+	// the cover and the series are shared with the files on disk, they are set before too
+	if keep.CoverPath == "" && other.CoverPath != "" {
+		data, err := ioutil.ReadFile(other.CoverPath)
+		if err == nil {
+			keep.saveCover(BookMetadata{Cover: data, CoverType: other.CoverType}, true)
+		}
+	}
+	if keep.Serie == "" && other.Serie != "" {
+		keep.Serie = other.Serie
+		keep.SerieNumber = other.SerieNumber
+		keep.linkSeries()
+	}
+
+	authorIDs := map[uint]bool{}
+	for _, author := range keep.Authors {
+		authorIDs[author.ID] = true
+	}
+	for _, author := range other.Authors {
+		if !authorIDs[author.ID] {
+			keep.Authors = append(keep.Authors, author)
+		}
+	}
+	tagIDs := map[uint]bool{}
+	for _, tag := range keep.Tags {
+		tagIDs[tag.ID] = true
+	}
+	for _, tag := range other.Tags {
+		if !tagIDs[tag.ID] {
+			keep.Tags = append(keep.Tags, tag)
+		}
+	}
+
+	if keep.Description == "" {
+		keep.Description = other.Description
+	}
+	if keep.Isbn == "" {
+		keep.Isbn = other.Isbn
+	}
+	if keep.Language == "" {
+		keep.Language = other.Language
+	}
+	if keep.Publisher == "" {
+		keep.Publisher = other.Publisher
+	}
+	if keep.Collection == "" {
+		keep.Collection = other.Collection
+	}
+	if keep.PublishedAt == nil {
+		keep.PublishedAt = other.PublishedAt
+	}
+
+	tx := db.Begin()
+	if err := mergeBooksTx(tx, keep, other, files, otherFiles); err != nil {
+		tx.Rollback()
+		removeBookFiles(files)
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		removeBookFiles(files)
+		return err
+	}
+
+	os.RemoveAll(filepath.Join("public/books", strconv.Itoa(int(other.ID))))
+	fmt.Println("merged book " + strconv.Itoa(int(other.ID)) + " in " + strconv.Itoa(int(keep.ID)))
+	return nil
+}
+
+// mergeBooksTx save the merge of other in keep inside the transaction
+func mergeBooksTx(tx *gorm.DB, keep *Book, other *Book, files []BookFile, otherFiles []BookFile) error {
+	var states []UserBook
+
+	for i := range files {
+		if err := tx.Save(&files[i]).Error; err != nil {
+			return err
+		}
+	}
+	for _, file := range otherFiles {
+		if err := tx.Unscoped().Delete(&file).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Save(keep).Error; err != nil {
+		return err
+	}
+
+	tx.Where("book_id = ?", other.ID).Find(&states)
+	for _, state := range states {
+		var keepState UserBook
+
+		tx.Where("user_id = ? AND book_id = ?", state.UserID, keep.ID).First(&keepState)
+		keepState.UserID = state.UserID
+		keepState.BookID = keep.ID
+		keepState.Favorite = keepState.Favorite || state.Favorite
+		keepState.Read = keepState.Read || state.Read
+		if state.Progress > keepState.Progress {
+			keepState.Progress = state.Progress
+			keepState.Position = state.Position
+		}
+		if state.ReadAt != nil && (keepState.ReadAt == nil || state.ReadAt.After(*keepState.ReadAt)) {
+			keepState.ReadAt = state.ReadAt
+		}
+		if err := tx.Save(&keepState).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Unscoped().Where("book_id = ?", other.ID).Delete(UserBook{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("book_id = ? OR other_id = ?", other.ID, other.ID).Delete(DuplicateIgnore{}).Error; err != nil {
+		return err
+	}
+
+	// other take the place of keep on the shelves without keep
+	if err := tx.Model(&ShelfBook{}).Where("book_id = ? AND shelf_id NOT IN (SELECT shelf_id FROM shelf_books WHERE book_id = ? AND deleted_at IS NULL)", other.ID, keep.ID).
+		UpdateColumn("book_id", keep.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("book_id = ?", other.ID).Delete(ShelfBook{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Model(other).Association("Authors").Clear().Error; err != nil {
+		return err
+	}
+	if err := tx.Model(other).Association("Tags").Clear().Error; err != nil {
+		return err
+	}
+	return tx.Delete(other).Error
+}
+
+// removeBookFiles remove the copied files of a merge which failed
+func removeBookFiles(files []BookFile) {
+	for _, file := range files {
+		os.Remove(file.Path)
+	}
+}
+
+// formBookIDs return the book ids of the books field of the form
+func formBookIDs(req *http.Request) []uint {
+	var bookIDs []uint
+
+	req.ParseForm()
+	for _, value := range req.Form["books"] {
+		bookID, err := strconv.ParseUint(value, 10, 64)
+		if err == nil {
+			bookIDs = append(bookIDs, uint(bookID))
+		}
+	}
+	return bookIDs
+}
+
+func duplicatesHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+
+	duplicatesTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+	templateFile, _ := pkger.Open("/template/duplicates.html")
+	templateData, _ := ioutil.ReadAll(templateFile)
+	duplicatesTemplate = template.Must(duplicatesTemplate.Parse(string(templateData)))
+	duplicatesTemplate.Execute(res, Page{Content: duplicateGroups(), Title: serverOption.Name})
+}
+
+// duplicatesMergeHandler merge the books of the form in the book to keep
+func duplicatesMergeHandler(res http.ResponseWriter, req *http.Request) {
+	keepID, _ := strconv.ParseUint(req.FormValue("keep"), 10, 64)
+
+	for _, bookID := range formBookIDs(req) {
+		if bookID == uint(keepID) {
+			continue
+		}
+		keep := Book{}
+		keep.ID = uint(keepID)
+		other := Book{}
+		other.ID = bookID
+		if err := mergeBooks(&keep, &other); err != nil {
+			http.Error(res, "Error merging books: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	http.Redirect(res, req, "/duplicates.html", http.StatusFound)
+}
+
+// duplicatesIgnoreHandler mark the books of the form as different books
+func duplicatesIgnoreHandler(res http.ResponseWriter, req *http.Request) {
+	bookIDs := formBookIDs(req)
+
+	for i := range bookIDs {
+		for j := i + 1; j < len(bookIDs); j++ {
+			db.Save(&DuplicateIgnore{BookID: bookIDs[i], OtherID: bookIDs[j]})
+		}
+	}
+	http.Redirect(res, req, "/duplicates.html", http.StatusFound)
+}
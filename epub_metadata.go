@@ -0,0 +1,362 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// embedCacheDir keep the EPUB files rewritten with the metadata of the database
+const embedCacheDir = "db/cache/epub"
+
+// embedCoverID is the manifest id of the cover added to the EPUB
+const embedCoverID = "myopds-cover"
+
+// servedFilePath return the path of the file sent to readers, for EPUB it is a copy with the
+// metadata of the database when the option is set, the stored file is never modified
+func servedFilePath(book Book, file BookFile) (string, time.Time) {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	if !serverOption.EmbedMetadata || (file.Format != "epub" && file.Format != "kepub") {
+		return file.Path, file.UpdatedAt
+	}
+
+	// the copy is named after the metadata, an author renamed or a new cover give a new copy
+	db.Preload("Authors").Preload("Tags").Find(&book, book.ID)
+	key := embedKey(book, file)
+	prefix := filepath.Join(embedCacheDir, strconv.Itoa(int(book.ID))+"-")
+	cachePath := prefix + key + "." + formatByName(file.Format).Extension
+	if info, err := os.Stat(cachePath); err == nil {
+		return cachePath, info.ModTime()
+	}
+
+	os.MkdirAll(embedCacheDir, os.ModePerm)
+	old, _ := filepath.Glob(prefix + "*")
+	for _, oldPath := range old {
+		os.Remove(oldPath)
+	}
+	// written aside then renamed, a download running at the same time never see a partial file
+	tmpPath := cachePath + ".tmp" + randomHex(4)
+	err := writeEpubMetadata(file.Path, tmpPath, book)
+	if err == nil {
+		err = os.Rename(tmpPath, cachePath)
+	}
+	if err != nil {
+		fmt.Println("embed metadata of book " + strconv.Itoa(int(book.ID)) + ": " + err.Error())
+		os.Remove(tmpPath)
+		return file.Path, file.UpdatedAt
+	}
+	return cachePath, time.Now()
+}
+
+// embedKey return a hash of everything written in the EPUB
+func embedKey(book Book, file BookFile) string {
+	hash := sha256.New()
+	fmt.Fprintln(hash, file.Checksum, book.Title, book.Description, book.Publisher, book.Language, book.Isbn, book.Serie, book.SerieNumber)
+	for _, author := range book.Authors {
+		fmt.Fprintln(hash, author.Name, author.SortName)
+	}
+	for _, tag := range book.Tags {
+		fmt.Fprintln(hash, tag.Name)
+	}
+	if info, err := os.Stat(book.CoverPath); err == nil {
+		fmt.Fprintln(hash, book.CoverPath, info.ModTime().UnixNano(), info.Size())
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// writeEpubMetadata copy the EPUB with the metadata of the book in its OPF and its cover
+func writeEpubMetadata(srcPath string, dstPath string, book Book) error {
+	reader, err := zip.OpenReader(srcPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	opfPath := ""
+	for _, f := range reader.File {
+		if f.Name == "META-INF/container.xml" {
+			container, err := readZipXML(f)
+			if err != nil {
+				return err
+			}
+			if rootfile := container.FindElement("//rootfile"); rootfile != nil {
+				opfPath = rootfile.SelectAttrValue("full-path", "")
+			}
+		}
+	}
+
+	var opf *etree.Document
+	for _, f := range reader.File {
+		if f.Name == opfPath {
+			opf, err = readZipXML(f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if opf == nil {
+		return errUnknownFormat
+	}
+
+	cover, _ := ioutil.ReadFile(book.CoverPath)
+	coverName := ""
+	if len(cover) > 0 {
+		coverName = embedCoverID + filepath.Ext(book.CoverPath)
+	}
+	updateOpf(opf, book, coverName)
+	opfData, err := opf.WriteToBytes()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	writer := zip.NewWriter(out)
+
+	// the mimetype must be the first entry, stored without extra field so readers find it at its offset
+	mimetype := []byte("application/epub+zip")
+	w, err := writer.CreateRaw(&zip.FileHeader{
+		Name:               "mimetype",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(mimetype),
+		CompressedSize64:   uint64(len(mimetype)),
+		UncompressedSize64: uint64(len(mimetype)),
+	})
+	if err != nil {
+		return err
+	}
+	w.Write(mimetype)
+
+	coverPath := path.Join(path.Dir(opfPath), coverName)
+	for _, f := range reader.File {
+		if f.Name == "mimetype" {
+			continue
+		}
+		header := f.FileHeader
+		header.Extra = nil
+		header.Modified = time.Time{}
+		w, err := writer.CreateHeader(&header)
+		if err != nil {
+			return err
+		}
+		if f.Name == opfPath {
+			w.Write(opfData)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if coverName != "" {
+		header := &zip.FileHeader{Name: coverPath, Method: zip.Deflate}
+		header.SetModTime(time.Now())
+		w, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		w.Write(cover)
+	}
+	return writer.Close()
+}
+
+// readZipXML parse a xml file of the archive
+func readZipXML(f *zip.File) (*etree.Document, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	doc := etree.NewDocument()
+	_, err = doc.ReadFrom(rc)
+	return doc, err
+}
+
+// removeElements remove the elements matching the path and the metas refining them
+func removeElements(metadata *etree.Element, elementPath string) {
+	for _, element := range metadata.FindElements(elementPath) {
+		if id := element.SelectAttrValue("id", ""); id != "" {
+			for _, refine := range metadata.FindElements("meta[@refines='#" + id + "']") {
+				metadata.RemoveChild(refine)
+			}
+		}
+		metadata.RemoveChild(element)
+	}
+}
+
+// addMeta add an EPUB 3 meta refining an element
+func addMeta(metadata *etree.Element, property string, refines string, value string) *etree.Element {
+	meta := metadata.CreateElement("meta")
+	meta.CreateAttr("property", property)
+	if refines != "" {
+		meta.CreateAttr("refines", "#"+refines)
+	}
+	meta.SetText(value)
+	return meta
+}
+
+// addCalibreMeta add a meta in the EPUB 2 way, also read by calibre and KOReader in EPUB 3
+func addCalibreMeta(metadata *etree.Element, name string, content string) {
+	meta := metadata.CreateElement("meta")
+	meta.CreateAttr("name", name)
+	meta.CreateAttr("content", content)
+}
+
+// setDC replace the dublin core elements with one element having the value, nothing when the value is empty
+func setDC(metadata *etree.Element, name string, value string) {
+	removeElements(metadata, "dc:"+name)
+	if value != "" {
+		metadata.CreateElement("dc:" + name).SetText(value)
+	}
+}
+
+// updateOpf write the metadata of the book in the OPF, coverName is the cover added next to the OPF
+func updateOpf(opf *etree.Document, book Book, coverName string) {
+	pkg := opf.SelectElement("package")
+	if pkg == nil {
+		return
+	}
+	epub3 := strings.HasPrefix(pkg.SelectAttrValue("version", "2.0"), "3")
+	metadata := pkg.SelectElement("metadata")
+	if metadata == nil {
+		metadata = pkg.CreateElement("metadata")
+	}
+	if metadata.SelectAttr("xmlns:dc") == nil && pkg.SelectAttr("xmlns:dc") == nil {
+		metadata.CreateAttr("xmlns:dc", "http://purl.org/dc/elements/1.1/")
+	}
+	if !epub3 && metadata.SelectAttr("xmlns:opf") == nil && pkg.SelectAttr("xmlns:opf") == nil {
+		metadata.CreateAttr("xmlns:opf", "http://www.idpf.org/2007/opf")
+	}
+
+	setDC(metadata, "title", book.Title)
+	setDC(metadata, "description", book.Description)
+	setDC(metadata, "publisher", book.Publisher)
+	if book.Language != "" {
+		setDC(metadata, "language", book.Language)
+	}
+
+	removeElements(metadata, "dc:creator")
+	for i, author := range book.Authors {
+		creator := metadata.CreateElement("dc:creator")
+		creator.SetText(author.Name)
+		if epub3 {
+			id := "myopds-creator" + strconv.Itoa(i+1)
+			creator.CreateAttr("id", id)
+			addMeta(metadata, "role", id, "aut").CreateAttr("scheme", "marc:relators")
+			if author.SortName != "" {
+				addMeta(metadata, "file-as", id, author.SortName)
+			}
+		} else {
+			creator.CreateAttr("opf:role", "aut")
+			if author.SortName != "" {
+				creator.CreateAttr("opf:file-as", author.SortName)
+			}
+		}
+	}
+
+	removeElements(metadata, "dc:subject")
+	for _, tag := range book.Tags {
+		metadata.CreateElement("dc:subject").SetText(tag.Name)
+	}
+
+	// the isbn replace an identifier marked as isbn, the unique identifier is kept
+	if book.Isbn != "" {
+		var isbn *etree.Element
+		for _, identifier := range metadata.FindElements("dc:identifier") {
+			value := strings.ToLower(strings.TrimSpace(identifier.Text()))
+			if strings.EqualFold(identifier.SelectAttrValue("opf:scheme", ""), "isbn") || strings.HasPrefix(value, "urn:isbn:") || normalizeIsbn(value) == normalizeIsbn(book.Isbn) {
+				isbn = identifier
+			}
+		}
+		if isbn == nil {
+			isbn = metadata.CreateElement("dc:identifier")
+			if !epub3 {
+				isbn.CreateAttr("opf:scheme", "ISBN")
+			}
+		}
+		if epub3 {
+			isbn.SetText("urn:isbn:" + book.Isbn)
+		} else {
+			isbn.SetText(book.Isbn)
+		}
+	}
+
+	for _, meta := range metadata.FindElements("meta") {
+		name := meta.SelectAttrValue("name", "")
+		if name == "calibre:series" || name == "calibre:series_index" {
+			metadata.RemoveChild(meta)
+		}
+	}
+	removeElements(metadata, "meta[@property='belongs-to-collection']")
+	if book.Serie != "" {
+		position := strconv.FormatFloat(float64(book.SerieNumber), 'f', -1, 32)
+		addCalibreMeta(metadata, "calibre:series", book.Serie)
+		addCalibreMeta(metadata, "calibre:series_index", position)
+		if epub3 {
+			addMeta(metadata, "belongs-to-collection", "", book.Serie).CreateAttr("id", "myopds-series")
+			addMeta(metadata, "collection-type", "myopds-series", "series")
+			addMeta(metadata, "group-position", "myopds-series", position)
+		}
+	}
+
+	if coverName != "" {
+		updateOpfCover(pkg, metadata, book, coverName, epub3)
+	}
+}
+
+// updateOpfCover declare the added image as the cover of the EPUB
+func updateOpfCover(pkg *etree.Element, metadata *etree.Element, book Book, coverName string, epub3 bool) {
+	manifest := pkg.SelectElement("manifest")
+	if manifest == nil {
+		return
+	}
+	for _, item := range manifest.FindElements("item[@properties]") {
+		properties := strings.Fields(item.SelectAttrValue("properties", ""))
+		kept := properties[:0]
+		for _, property := range properties {
+			if property != "cover-image" {
+				kept = append(kept, property)
+			}
+		}
+		if len(kept) == 0 {
+			item.RemoveAttr("properties")
+		} else {
+			item.CreateAttr("properties", strings.Join(kept, " "))
+		}
+	}
+	item := manifest.CreateElement("item")
+	item.CreateAttr("id", embedCoverID)
+	item.CreateAttr("href", coverName)
+	item.CreateAttr("media-type", book.CoverType)
+	if epub3 {
+		item.CreateAttr("properties", "cover-image")
+	}
+
+	for _, meta := range metadata.FindElements("meta[@name='cover']") {
+		metadata.RemoveChild(meta)
+	}
+	addCalibreMeta(metadata, "cover", embedCoverID)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/beevik/etree"
+	"github.com/jinzhu/gorm"
+)
+
+// Facet is a link of an acquisition feed changing one parameter of the query
+type Facet struct {
+	Group  string
+	Title  string
+	Key    string
+	Value  string
+	Active bool
+	Count  int
+}
+
+// readFacets list the reading state filters offered as facets
+var readFacets = []struct {
+	Value string
+	Title string
+}{
+	{"", "Tous"},
+	{"favorite", "Favoris"},
+	{"notread", "Non lus"},
+	{"read", "Lus"},
+}
+
+// bookQuery apply the filters of the query string, without order and pagination
+func bookQuery(query url.Values, userID uint) *gorm.DB {
+	authorID, _ := strconv.Atoi(query.Get("author_id"))
+
+	return db.Model(&Book{}).
+		Scopes(BookwithCat(query.Get("tag"))).
+		Scopes(BookwithAuthorID(authorID)).
+		Scopes(BookwithAuthor(query.Get("author"))).
+		Scopes(BookwithSerie(query.Get("serie"))).
+		Scopes(BookwithLanguage(query.Get("language"))).
+		Scopes(BookwithPublisher(query.Get("publisher"))).
+		Scopes(BookFilter(query.Get("filter"), userID))
+}
+
+// bookList return a page of books, q is a full text search combined with the other filters
+func bookList(query url.Values, userID uint, limit int, offset int) ([]Book, int) {
+	var books []Book
+	var total int
+
+	list := bookQuery(query, userID)
+	if search := query.Get("q"); search != "" {
+		match := searchMatch(search)
+		if match == "" {
+			return books, 0
+		}
+		list = list.Where("books.id IN (SELECT docid FROM book_search WHERE book_search MATCH ?)", match)
+	}
+	list.Count(&total)
+	list.Scopes(BookOrder(query.Get("order"), query.Get("dir"), userID)).Limit(limit).Offset(offset).Preload("Authors").Find(&books)
+	return books, total
+}
+
+// without return a copy of the query without the keys
+func without(query url.Values, keys ...string) url.Values {
+	copied := url.Values{}
+	for key, values := range query {
+		copied[key] = append([]string{}, values...)
+	}
+	for _, key := range keys {
+		copied.Del(key)
+	}
+	return copied
+}
+
+// bookFacets return the sort, language and reading state facets of a list of books
+func bookFacets(query url.Values, userID uint) []Facet {
+	var facets []Facet
+	var languages []valueCount
+
+	sort, desc := findBookSort(query.Get("order"), query.Get("dir"))
+	for _, option := range bookSorts {
+		facets = append(facets, Facet{
+			Group:  "Trier par",
+			Title:  option.Title,
+			Key:    "order",
+			Value:  option.Value,
+			Active: sort.Value == option.Value,
+		})
+	}
+	facets = append(facets, Facet{Group: "Sens", Title: "Croissant", Key: "dir", Value: "asc", Active: !desc})
+	facets = append(facets, Facet{Group: "Sens", Title: "Décroissant", Key: "dir", Value: "desc", Active: desc})
+
+	// number of books per language with the other filters
+	language := query.Get("language")
+	bookQuery(without(query, "language"), userID).
+		Select("books.language AS value, count(*) AS count").
+		Where("books.language <> ''").
+		Group("books.language").Order("books.language asc").Scan(&languages)
+	if len(languages) > 1 || language != "" {
+		facets = append(facets, Facet{Group: "Langue", Title: "Toutes", Key: "language", Active: language == ""})
+		for _, value := range languages {
+			facets = append(facets, Facet{
+				Group:  "Langue",
+				Title:  value.Value,
+				Key:    "language",
+				Value:  value.Value,
+				Active: language == value.Value,
+				Count:  value.Count,
+			})
+		}
+	}
+
+	filter := query.Get("filter")
+	for _, option := range readFacets {
+		var count int
+		filtered := without(query, "filter")
+		filtered.Set("filter", option.Value)
+		bookQuery(filtered, userID).Count(&count)
+		facets = append(facets, Facet{
+			Group:  "Lecture",
+			Title:  option.Title,
+			Key:    "filter",
+			Value:  option.Value,
+			Active: filter == option.Value,
+			Count:  count,
+		})
+	}
+
+	return facets
+}
+
+// href return the link of the facet from the current query, back to the first page
+func (facet Facet) href(path string, query url.Values) string {
+	values := without(query, "page", facet.Key)
+	if facet.Key == "order" {
+		// each order has its own default direction
+		values.Del("dir")
+	}
+	if facet.Value != "" {
+		values.Set(facet.Key, facet.Value)
+	}
+	// without filter the path is the root navigation catalog
+	if len(without(values, "token")) == 0 {
+		values.Set("order", bookSorts[0].Value)
+	}
+	return path + "?" + values.Encode()
+}
+
+// facetLinksOpds add the facets to an acquisition feed
+func facetLinksOpds(feed *etree.Element, facets []Facet, baseURL string, path string, query url.Values) {
+	for _, facet := range facets {
+		link := feed.CreateElement("link")
+		link.CreateAttr("rel", "http://opds-spec.org/facet")
+		link.CreateAttr("type", opdsAcquisitionType)
+		link.CreateAttr("href", baseURL+facet.href(path, query))
+		link.CreateAttr("title", facet.Title)
+		link.CreateAttr("opds:facetGroup", facet.Group)
+		if facet.Active {
+			link.CreateAttr("opds:activeFacet", "true")
+		}
+		if facet.Count > 0 {
+			link.CreateAttr("thr:count", strconv.Itoa(facet.Count))
+		}
+	}
+}
+
+// facetGroupsOpds2 return the facets grouped for an OPDS 2.0 feed
+func facetGroupsOpds2(facets []Facet, baseURL string, path string, query url.Values) []Opds2Group {
+	var groups []Opds2Group
+
+	for _, facet := range facets {
+		if len(groups) == 0 || groups[len(groups)-1].Metadata.Title != facet.Group {
+			groups = append(groups, Opds2Group{Metadata: Opds2Metadata{Title: facet.Group}})
+		}
+		link := Opds2Link{Href: baseURL + facet.href(path, query), Type: opds2MediaType, Title: facet.Title}
+		if facet.Active {
+			link.Rel = "self"
+		}
+		if facet.Count > 0 {
+			link.Properties = &Opds2LinkProperties{NumberOfItems: facet.Count}
+		}
+		groups[len(groups)-1].Links = append(groups[len(groups)-1].Links, link)
+	}
+	return groups
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BookMetadata store the metadata read from a book file
+type BookMetadata struct {
+	Title       string
+	Authors     []string
+	AuthorSort  map[string]string
+	Description string
+	Publisher   string
+	Language    string
+	Isbn        string
+	Serie       string
+	SerieNumber float32
+	Tags        []string
+	PublishedAt *time.Time
+	Cover       []byte
+	CoverType   string
+}
+
+// FormatHandler detect a file format and read its metadata
+type FormatHandler interface {
+	Detect(header []byte, filePath string) bool
+	Metadata(filePath string) (BookMetadata, error)
+}
+
+// Format describe a supported book file format
+type Format struct {
+	Name      string
+	Extension string
+	MediaType string
+	Handler   FormatHandler
+}
+
+// formats list supported formats, in detection order
+var formats = []Format{
+	{Name: "kepub", Extension: "kepub.epub", MediaType: "application/kepub+zip", Handler: kepubHandler{}},
+	{Name: "epub", Extension: "epub", MediaType: "application/epub+zip", Handler: epubHandler{}},
+	{Name: "cbz", Extension: "cbz", MediaType: "application/vnd.comicbook+zip", Handler: cbzHandler{}},
+	{Name: "cbr", Extension: "cbr", MediaType: "application/vnd.comicbook-rar", Handler: cbrHandler{}},
+	{Name: "pdf", Extension: "pdf", MediaType: "application/pdf", Handler: pdfHandler{}},
+	{Name: "azw3", Extension: "azw3", MediaType: "application/vnd.amazon.mobi8-ebook", Handler: mobiHandler{kf8: true}},
+	{Name: "mobi", Extension: "mobi", MediaType: "application/x-mobipocket-ebook", Handler: mobiHandler{}},
+}
+
+var errUnknownFormat = errors.New("unknown book format")
+
+// detectFormat find the format of a file from its first bytes
+func detectFormat(filePath string) (Format, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return Format{}, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 4096)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return Format{}, err
+	}
+	header = header[:n]
+
+	for _, format := range formats {
+		if format.Handler.Detect(header, filePath) {
+			return format, nil
+		}
+	}
+	return Format{}, errUnknownFormat
+}
+
+// formatByName return the format with this name, epub is the default for books imported before formats
+func formatByName(name string) Format {
+	for _, format := range formats {
+		if format.Name == name {
+			return format
+		}
+	}
+	for _, format := range formats {
+		if format.Name == "epub" {
+			return format
+		}
+	}
+	return Format{}
+}
+
+// titleFromFilename build a title from the file name when the file has no metadata
+func titleFromFilename(filePath string) string {
+	filename := filepath.Base(filePath)
+	filename = strings.TrimSuffix(filename, filepath.Ext(filename))
+	filename = strings.TrimSuffix(filename, ".kepub")
+	title := strings.Replace(filename, "_", " ", -1)
+
+	return strings.TrimSpace(title)
+}
+
+// imageMediaType return the media type of an image from its content
+func imageMediaType(data []byte) string {
+	if bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}) {
+		return jpgMediaType
+	}
+	if bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return pngMediaType
+	}
+	return ""
+}
+
+// coverData return the image as a cover, other formats than jpeg and png are converted to jpeg,
+// nil when the image can't be decoded (webp)
+func coverData(data []byte) ([]byte, string) {
+	if decodeCoverConfig(data) != nil {
+		return nil, ""
+	}
+	if coverType := imageMediaType(data); coverType != "" {
+		return data, coverType
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ""
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	return buf.Bytes(), jpgMediaType
+}
+
+func isImageName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+func isZip(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("PK\x03\x04"))
+}
+
+// zipImages return the images of a zip archive in reading order
+func zipImages(reader *zip.Reader) []*zip.File {
+	var images []*zip.File
+
+	for _, f := range reader.File {
+		if isImageName(f.Name) && !strings.HasPrefix(f.Name, "__MACOSX") {
+			images = append(images, f)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+
+	return images
+}
+
+func splitList(value string, separators string) []string {
+	var values []string
+
+	for _, v := range strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(separators, r) }) {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
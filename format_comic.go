@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nwaples/rardecode"
+)
+
+// comicInfo store the ComicInfo.xml metadata of comic archives
+type comicInfo struct {
+	Title       string `xml:"Title"`
+	Series      string `xml:"Series"`
+	Number      string `xml:"Number"`
+	Volume      string `xml:"Volume"`
+	Summary     string `xml:"Summary"`
+	Writer      string `xml:"Writer"`
+	Penciller   string `xml:"Penciller"`
+	Publisher   string `xml:"Publisher"`
+	Genre       string `xml:"Genre"`
+	Tags        string `xml:"Tags"`
+	LanguageISO string `xml:"LanguageISO"`
+	GTIN        string `xml:"GTIN"`
+	Year        int    `xml:"Year"`
+	Month       int    `xml:"Month"`
+	Day         int    `xml:"Day"`
+	Pages       []struct {
+		Image int    `xml:"Image,attr"`
+		Type  string `xml:"Type,attr"`
+	} `xml:"Pages>Page"`
+}
+
+// coverIndex return the index of the front cover page, 0 when not specified
+func (info comicInfo) coverIndex() int {
+	for _, page := range info.Pages {
+		if page.Type == "FrontCover" {
+			return page.Image
+		}
+	}
+	return 0
+}
+
+func (info comicInfo) apply(meta *BookMetadata) {
+	meta.Title = info.Title
+	meta.Serie = info.Series
+	number, err := strconv.ParseFloat(info.Number, 32)
+	if err == nil {
+		meta.SerieNumber = float32(number)
+	}
+	if meta.Title == "" && info.Series != "" {
+		meta.Title = info.Series
+		if info.Number != "" {
+			meta.Title = meta.Title + " - " + info.Number
+		}
+	}
+	meta.Description = info.Summary
+	meta.Publisher = info.Publisher
+	meta.Language = info.LanguageISO
+	meta.Isbn = info.GTIN
+	meta.Authors = splitList(info.Writer, ",;")
+	if len(meta.Authors) == 0 {
+		meta.Authors = splitList(info.Penciller, ",;")
+	}
+	meta.Tags = append(splitList(info.Genre, ",;"), splitList(info.Tags, ",;")...)
+	if info.Year > 0 {
+		month, day := info.Month, info.Day
+		if month < 1 || month > 12 {
+			month = 1
+		}
+		if day < 1 || day > 31 {
+			day = 1
+		}
+		published := time.Date(info.Year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+		meta.PublishedAt = &published
+	}
+}
+
+func parseComicInfo(reader io.Reader) (comicInfo, error) {
+	var info comicInfo
+
+	err := xml.NewDecoder(reader).Decode(&info)
+	return info, err
+}
+
+type cbzHandler struct{}
+
+func (cbzHandler) Detect(header []byte, filePath string) bool {
+	if !isZip(header) {
+		return false
+	}
+
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	return len(zipImages(&reader.Reader)) > 0
+}
+
+func (cbzHandler) Metadata(filePath string) (BookMetadata, error) {
+	var meta BookMetadata
+	var info comicInfo
+
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return meta, err
+	}
+	defer reader.Close()
+
+	for _, f := range reader.File {
+		if strings.EqualFold(f.Name, "ComicInfo.xml") {
+			fd, err := f.Open()
+			if err == nil {
+				info, _ = parseComicInfo(fd)
+				fd.Close()
+			}
+		}
+	}
+	info.apply(&meta)
+
+	images := zipImages(&reader.Reader)
+	coverIndex := info.coverIndex()
+	if coverIndex >= len(images) {
+		coverIndex = 0
+	}
+	if len(images) > 0 {
+		// the cover page, else the first page usable as a cover
+		candidates := append([]*zip.File{images[coverIndex]}, images...)
+		for _, f := range candidates {
+			fd, err := f.Open()
+			if err != nil {
+				continue
+			}
+			data, _ := ioutil.ReadAll(fd)
+			fd.Close()
+			if meta.Cover, meta.CoverType = coverData(data); meta.Cover != nil {
+				break
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+type cbrHandler struct{}
+
+func (cbrHandler) Detect(header []byte, filePath string) bool {
+	return bytes.HasPrefix(header, []byte("Rar!\x1a\x07"))
+}
+
+func (cbrHandler) Metadata(filePath string) (BookMetadata, error) {
+	var meta BookMetadata
+	var info comicInfo
+	var coverName string
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return meta, err
+	}
+	defer file.Close()
+
+	reader, err := rardecode.NewReader(file, "")
+	if err != nil {
+		return meta, err
+	}
+
+	// rar archives can only be read sequentially, keep the first image by name
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return meta, err
+		}
+		if header.IsDir {
+			continue
+		}
+		if strings.EqualFold(header.Name, "ComicInfo.xml") {
+			info, _ = parseComicInfo(reader)
+			continue
+		}
+		if isImageName(header.Name) && (coverName == "" || header.Name < coverName) {
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				continue
+			}
+			if cover, coverType := coverData(data); cover != nil {
+				coverName = header.Name
+				meta.Cover, meta.CoverType = cover, coverType
+			}
+		}
+	}
+	info.apply(&meta)
+
+	return meta, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/readium/r2-streamer-go/fetcher"
+	"github.com/readium/r2-streamer-go/parser"
+)
+
+type epubHandler struct{}
+
+func (epubHandler) Detect(header []byte, filePath string) bool {
+	if !isZip(header) {
+		return false
+	}
+	if len(header) > 58 && string(header[30:38]) == "mimetype" && bytes.HasPrefix(header[38:], []byte("application/epub+zip")) {
+		return true
+	}
+
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	for _, f := range reader.File {
+		if f.Name == "META-INF/container.xml" {
+			return true
+		}
+	}
+	return false
+}
+
+func (epubHandler) Metadata(filePath string) (BookMetadata, error) {
+	var meta BookMetadata
+
+	publication, err := parser.Parse(filePath)
+	if err != nil {
+		return meta, err
+	}
+	defer closePublication(publication)
+
+	for _, creator := range publication.Metadata.Author {
+		meta.Authors = append(meta.Authors, creator.Name.String())
+	}
+	meta.AuthorSort = epubFileAs(filePath)
+	if len(meta.Authors) == 0 {
+		for _, creator := range publication.Metadata.Contributor {
+			meta.Authors = append(meta.Authors, creator.Name.String())
+		}
+	}
+
+	meta.Title = publication.Metadata.Title.String()
+	meta.Description = publication.Metadata.Description
+	meta.Isbn = publication.Metadata.Identifier
+	if len(publication.Metadata.Language) > 0 {
+		meta.Language = publication.Metadata.Language[0]
+	}
+	if len(publication.Metadata.Publisher) > 0 {
+		meta.Publisher = publication.Metadata.Publisher[0].Name.String()
+	}
+	if publication.Metadata.BelongsTo != nil && len(publication.Metadata.BelongsTo.Series) > 0 {
+		meta.Serie = publication.Metadata.BelongsTo.Series[0].Name
+		meta.SerieNumber = publication.Metadata.BelongsTo.Series[0].Position
+	}
+	meta.PublishedAt = publication.Metadata.PublicationDate
+	for _, sub := range publication.Metadata.Subject {
+		meta.Tags = append(meta.Tags, sub.Name)
+	}
+
+	linkCover, _ := publication.GetCover()
+	if linkCover.Href == "" && len(publication.Landmarks) > 0 {
+		if filepath.Ext(publication.Landmarks[0].Href) == ".jpg" || filepath.Ext(publication.Landmarks[0].Href) == ".jpeg" || filepath.Ext(publication.Landmarks[0].Href) == ".png" {
+			linkCover = publication.Landmarks[0]
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(linkCover.Href))
+	if ext == ".jpeg" || ext == ".jpg" || ext == ".png" {
+		coverReader, _, errFetch := fetcher.Fetch(&publication, linkCover.Href)
+		if errFetch == nil {
+			meta.Cover, _ = ioutil.ReadAll(coverReader)
+			meta.CoverType = linkCover.TypeLink
+		}
+	}
+
+	return meta, nil
+}
+
+// epubFileAs read the file-as attribute of the creators in the OPF, the parser ignore it
+func epubFileAs(filePath string) map[string]string {
+	fileAs := map[string]string{}
+
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return fileAs
+	}
+	defer reader.Close()
+
+	readXML := func(name string) *etree.Document {
+		for _, f := range reader.File {
+			if f.Name == name {
+				rc, err := f.Open()
+				if err != nil {
+					return nil
+				}
+				defer rc.Close()
+				doc := etree.NewDocument()
+				if _, err := doc.ReadFrom(rc); err != nil {
+					return nil
+				}
+				return doc
+			}
+		}
+		return nil
+	}
+
+	container := readXML("META-INF/container.xml")
+	if container == nil {
+		return fileAs
+	}
+	rootfile := container.FindElement("//rootfile")
+	if rootfile == nil {
+		return fileAs
+	}
+	opf := readXML(rootfile.SelectAttrValue("full-path", ""))
+	if opf == nil {
+		return fileAs
+	}
+
+	// epub 3 refines the creator with a meta
+	refines := map[string]string{}
+	for _, meta := range opf.FindElements("//meta[@property='file-as']") {
+		refines[strings.TrimPrefix(meta.SelectAttrValue("refines", ""), "#")] = strings.TrimSpace(meta.Text())
+	}
+	for _, creator := range opf.FindElements("//creator") {
+		name := strings.TrimSpace(creator.Text())
+		sortName := creator.SelectAttrValue("file-as", "")
+		if sortName == "" {
+			sortName = refines[creator.SelectAttrValue("id", "")]
+		}
+		if name != "" && sortName != "" {
+			fileAs[name] = sortName
+		}
+	}
+	return fileAs
+}
+
+// kepubHandler handle kobo epub, they are detected by their file name
+type kepubHandler struct {
+	epubHandler
+}
+
+func (handler kepubHandler) Detect(header []byte, filePath string) bool {
+	name := strings.ToLower(filePath)
+	if !strings.HasSuffix(name, ".kepub.epub") && !strings.HasSuffix(name, ".kepub") {
+		return false
+	}
+	return handler.epubHandler.Detect(header, filePath)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// exth record types used for metadata
+const (
+	exthAuthor      = 100
+	exthPublisher   = 101
+	exthDescription = 103
+	exthIsbn        = 104
+	exthSubject     = 105
+	exthCoverOffset = 201
+	exthTitle       = 503
+	exthLanguage    = 524
+)
+
+var errInvalidMobi = errors.New("invalid mobi file")
+
+type mobiHandler struct {
+	kf8 bool
+}
+
+func (handler mobiHandler) Detect(header []byte, filePath string) bool {
+	if len(header) < 68 || string(header[60:68]) != "BOOKMOBI" {
+		return false
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return false
+	}
+	records := palmRecords(data)
+	if len(records) == 0 || len(records[0]) < 40 {
+		return false
+	}
+	version := binary.BigEndian.Uint32(records[0][36:40])
+	return (version >= 8) == handler.kf8
+}
+
+func (mobiHandler) Metadata(filePath string) (BookMetadata, error) {
+	var meta BookMetadata
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return meta, err
+	}
+	records := palmRecords(data)
+	if len(records) == 0 {
+		return meta, errInvalidMobi
+	}
+	header := records[0]
+	if len(header) < 132 || string(header[16:20]) != "MOBI" {
+		return meta, errInvalidMobi
+	}
+
+	mobiLength := int(binary.BigEndian.Uint32(header[20:24]))
+	utf8 := binary.BigEndian.Uint32(header[28:32]) == 65001
+	nameOffset := int(binary.BigEndian.Uint32(header[84:88]))
+	nameLength := int(binary.BigEndian.Uint32(header[88:92]))
+	firstImage := int(binary.BigEndian.Uint32(header[108:112]))
+	hasExth := binary.BigEndian.Uint32(header[128:132])&0x40 != 0
+
+	text := func(b []byte) string {
+		if utf8 {
+			return string(b)
+		}
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	}
+
+	if nameOffset+nameLength <= len(header) {
+		meta.Title = text(header[nameOffset : nameOffset+nameLength])
+	}
+
+	exthStart := 16 + mobiLength
+	if hasExth && exthStart+12 <= len(header) && string(header[exthStart:exthStart+4]) == "EXTH" {
+		count := int(binary.BigEndian.Uint32(header[exthStart+8 : exthStart+12]))
+		pos := exthStart + 12
+		for i := 0; i < count && pos+8 <= len(header); i++ {
+			recordType := binary.BigEndian.Uint32(header[pos : pos+4])
+			recordLength := int(binary.BigEndian.Uint32(header[pos+4 : pos+8]))
+			if recordLength < 8 || pos+recordLength > len(header) {
+				break
+			}
+			value := header[pos+8 : pos+recordLength]
+			pos += recordLength
+
+			switch recordType {
+			case exthAuthor:
+				meta.Authors = append(meta.Authors, strings.TrimSpace(text(value)))
+			case exthPublisher:
+				meta.Publisher = text(value)
+			case exthDescription:
+				meta.Description = text(value)
+			case exthIsbn:
+				meta.Isbn = text(value)
+			case exthSubject:
+				meta.Tags = append(meta.Tags, strings.TrimSpace(text(value)))
+			case exthTitle:
+				meta.Title = text(value)
+			case exthLanguage:
+				meta.Language = text(value)
+			case exthCoverOffset:
+				if len(value) == 4 && firstImage > 0 {
+					coverRecord := firstImage + int(binary.BigEndian.Uint32(value))
+					if coverRecord < len(records) {
+						meta.Cover = records[coverRecord]
+						meta.CoverType = imageMediaType(meta.Cover)
+					}
+				}
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+// palmRecords split a palm database in its records
+func palmRecords(data []byte) [][]byte {
+	var records [][]byte
+
+	if len(data) < 78 {
+		return nil
+	}
+	count := int(binary.BigEndian.Uint16(data[76:78]))
+	if 78+count*8 > len(data) {
+		return nil
+	}
+
+	offsets := make([]int, count)
+	for i := 0; i < count; i++ {
+		offsets[i] = int(binary.BigEndian.Uint32(data[78+i*8 : 82+i*8]))
+	}
+	for i, offset := range offsets {
+		end := len(data)
+		if i+1 < count {
+			end = offsets[i+1]
+		}
+		if offset > end || end > len(data) {
+			return nil
+		}
+		records = append(records, data[offset:end])
+	}
+
+	return records
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
+)
+
+var pdfInfoRef = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+var pdfIndirectRef = regexp.MustCompile(`^(\d+)\s+(\d+)\s+R`)
+
+type pdfHandler struct{}
+
+func (pdfHandler) Detect(header []byte, filePath string) bool {
+	return bytes.HasPrefix(header, []byte("%PDF-"))
+}
+
+// Metadata read the document information dictionary of the pdf.
+// Info dictionaries stored in compressed object streams are not supported.
+func (pdfHandler) Metadata(filePath string) (BookMetadata, error) {
+	var meta BookMetadata
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return meta, err
+	}
+
+	refs := pdfInfoRef.FindAllSubmatch(data, -1)
+	if len(refs) == 0 {
+		return meta, nil
+	}
+	// the last trailer is the most recent revision of the document
+	ref := refs[len(refs)-1]
+	info := pdfObject(data, string(ref[1]), string(ref[2]))
+	if info == nil {
+		return meta, nil
+	}
+
+	meta.Title = pdfInfoString(data, info, "Title")
+	meta.Authors = splitList(pdfInfoString(data, info, "Author"), ";&")
+	meta.Description = pdfInfoString(data, info, "Subject")
+	meta.Tags = splitList(pdfInfoString(data, info, "Keywords"), ",;")
+
+	return meta, nil
+}
+
+// pdfObject return the content of the indirect object "num gen obj ... endobj"
+func pdfObject(data []byte, num string, gen string) []byte {
+	objRegexp := regexp.MustCompile(`(?:^|\s)` + num + `\s+` + gen + `\s+obj\b`)
+	locs := objRegexp.FindAllIndex(data, -1)
+	if locs == nil {
+		return nil
+	}
+	// incremental updates append the new version of an object at the end
+	loc := locs[len(locs)-1]
+	object := data[loc[1]:]
+	end := bytes.Index(object, []byte("endobj"))
+	if end < 0 {
+		return nil
+	}
+	return object[:end]
+}
+
+// pdfInfoString return the text value of a key of the info dictionary
+func pdfInfoString(data []byte, info []byte, key string) string {
+	keyRegexp := regexp.MustCompile(`/` + key + `\s*`)
+	loc := keyRegexp.FindIndex(info)
+	if loc == nil {
+		return ""
+	}
+	value := info[loc[1]:]
+
+	if ref := pdfIndirectRef.FindSubmatch(value); ref != nil {
+		value = bytes.TrimSpace(pdfObject(data, string(ref[1]), string(ref[2])))
+	}
+	if len(value) == 0 {
+		return ""
+	}
+
+	var raw []byte
+	switch value[0] {
+	case '(':
+		raw = pdfLiteralString(value)
+	case '<':
+		end := bytes.IndexByte(value, '>')
+		if end < 0 {
+			return ""
+		}
+		raw, _ = hex.DecodeString(string(bytes.Join(bytes.Fields(value[1:end]), nil)))
+	default:
+		return ""
+	}
+
+	return pdfTextString(raw)
+}
+
+// pdfLiteralString decode a (literal) string with its escapes and balanced parentheses
+func pdfLiteralString(value []byte) []byte {
+	var out []byte
+	depth := 0
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value):
+			i++
+			switch value[i] {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b':
+				out = append(out, '\b')
+			case 'f':
+				out = append(out, '\f')
+			case '\r', '\n':
+			default:
+				if value[i] >= '0' && value[i] <= '7' {
+					j := i
+					for j < len(value) && j < i+3 && value[j] >= '0' && value[j] <= '7' {
+						j++
+					}
+					octal, _ := strconv.ParseUint(string(value[i:j]), 8, 8)
+					out = append(out, byte(octal))
+					i = j - 1
+				} else {
+					out = append(out, value[i])
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				out = append(out, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return out
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// pdfTextString convert a pdf text string (UTF-16BE with BOM or PDFDocEncoding) to utf-8
+func pdfTextString(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xFE && raw[1] == 0xFF {
+		var codes []uint16
+		for i := 2; i+1 < len(raw); i += 2 {
+			codes = append(codes, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		return string(utf16.Decode(codes))
+	}
+	if len(raw) >= 3 && raw[0] == 0xEF && raw[1] == 0xBB && raw[2] == 0xBF {
+		return string(raw[3:])
+	}
+
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
@@ -1,30 +1,40 @@
 module github.com/banux/myopds
 
-go 1.13
+go 1.17
+
+require (
+	github.com/beevik/etree v1.1.0
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/goincremental/negroni-sessions v0.0.0-20171223143234-40b49004abee
+	github.com/gorilla/mux v1.7.3
+	github.com/jinzhu/gorm v1.9.12
+	github.com/markbates/pkger v0.14.0
+	github.com/mattn/go-sqlite3 v2.0.2+incompatible
+	github.com/nwaples/rardecode v1.1.0
+	github.com/pborman/uuid v1.2.0
+	github.com/readium/r2-streamer-go v0.0.0-20170712153537-e4bf2ff6f829
+	github.com/stretchr/graceful v1.2.15
+	github.com/urfave/negroni v1.0.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+)
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.0 // indirect
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
 	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
 	github.com/andybalholm/cascadia v1.1.0 // indirect
-	github.com/beevik/etree v1.1.0
 	github.com/denisenkom/go-mssqldb v0.0.0-20191128021309-1d7a30a10f73 // indirect
 	github.com/go-sql-driver/mysql v1.5.0 // indirect
-	github.com/goincremental/negroni-sessions v0.0.0-20171223143234-40b49004abee
+	github.com/gobuffalo/here v0.6.0 // indirect
 	github.com/google/uuid v1.1.1 // indirect
 	github.com/gorilla/context v1.1.1 // indirect
-	github.com/gorilla/mux v1.7.3
+	github.com/gorilla/securecookie v1.1.1 // indirect
 	github.com/gorilla/sessions v1.2.0 // indirect
-	github.com/jinzhu/gorm v1.9.12
+	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.1 // indirect
 	github.com/lib/pq v1.3.0 // indirect
-	github.com/markbates/pkger v0.14.0
-	github.com/mattn/go-sqlite3 v2.0.2+incompatible
-	github.com/pborman/uuid v1.2.0
-	github.com/readium/r2-streamer-go v0.0.0-20170712153537-e4bf2ff6f829
 	github.com/smartystreets/goconvey v1.6.4 // indirect
-	github.com/stretchr/graceful v1.2.15
-	github.com/urfave/negroni v1.0.0
-	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553 // indirect
-	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 )
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// inbox subfolders receiving imported and rejected files
+const (
+	inboxDoneDir   = "done"
+	inboxFailedDir = "failed"
+)
+
+// inboxStableDelay is how long a file must stay unchanged before import, it may still be copied
+const inboxStableDelay = 5 * time.Second
+
+// inboxPollInterval is the scan interval, used alone when file notifications are not available
+const inboxPollInterval = 30 * time.Second
+
+// inboxFile remember the last size and modification time seen for a file of the inbox
+type inboxFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// the inbox can be changed in the settings, the watcher is then restarted
+var inboxMutex sync.Mutex
+var inboxWatched string
+var inboxStop chan struct{}
+
+// inboxUnmoved keep the imported files which could not be moved out of the inbox, they are not imported again
+// until they change
+var inboxUnmoved = map[string]inboxFile{}
+var inboxUnmovedMutex sync.Mutex
+
+// startInbox watch the directory in place of the previous inbox, an empty directory stop watching
+func startInbox(dir string) {
+	inboxMutex.Lock()
+	defer inboxMutex.Unlock()
+
+	dir = strings.TrimSpace(dir)
+	if dir != "" {
+		dir = filepath.Clean(dir)
+	}
+	options.InboxDir = dir
+	if dir == inboxWatched {
+		return
+	}
+	if inboxStop != nil {
+		close(inboxStop)
+		inboxStop = nil
+	}
+	inboxWatched = dir
+	if dir != "" {
+		inboxStop = make(chan struct{})
+		go watchInbox(dir, inboxStop)
+	}
+}
+
+// currentInbox return the watched inbox directory, empty when there is none
+func currentInbox() string {
+	inboxMutex.Lock()
+	defer inboxMutex.Unlock()
+
+	return inboxWatched
+}
+
+// watchInbox import the files added to the inbox directory and its subdirectories until stop is closed
+func watchInbox(dir string, stop chan struct{}) {
+	seen := map[string]inboxFile{}
+
+	dir = filepath.Clean(dir)
+	os.MkdirAll(filepath.Join(dir, inboxDoneDir), os.ModePerm)
+	os.MkdirAll(filepath.Join(dir, inboxFailedDir), os.ModePerm)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Println("inbox notifications unavailable, polling " + dir + " : " + err.Error())
+		watcher = nil
+	} else {
+		defer watcher.Close()
+		watchInboxDirs(watcher, dir, dir)
+	}
+	fmt.Println("watching inbox " + dir)
+
+	for {
+		wait := inboxPollInterval
+		if scanInbox(dir, seen) > 0 {
+			wait = inboxStableDelay
+		}
+
+		if watcher == nil {
+			select {
+			case <-stop:
+				fmt.Println("stop watching inbox " + dir)
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		select {
+		case <-stop:
+			fmt.Println("stop watching inbox " + dir)
+			return
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watchInboxDirs(watcher, dir, event.Name)
+				}
+			}
+			// a copy send many events, wait a little before scanning
+			time.Sleep(time.Second)
+		case err := <-watcher.Errors:
+			fmt.Println("inbox watcher: " + err.Error())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// watchInboxDirs add a watch on the directory and its subdirectories, done and failed excepted
+func watchInboxDirs(watcher *fsnotify.Watcher, inbox string, dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if skipInboxDir(inbox, path) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			fmt.Println("inbox watcher: " + err.Error())
+		}
+		return nil
+	})
+}
+
+// skipInboxDir return true for the done and failed folders and hidden directories
+func skipInboxDir(inbox string, path string) bool {
+	if path == inbox {
+		return false
+	}
+	if path == filepath.Join(inbox, inboxDoneDir) || path == filepath.Join(inbox, inboxFailedDir) {
+		return true
+	}
+	return strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// scanInbox queue an import for the stable files of the inbox and return the number of files still changing
+func scanInbox(dir string, seen map[string]inboxFile) int {
+	changing := 0
+	found := map[string]bool{}
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skipInboxDir(dir, path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || partialFile(info.Name()) {
+			return nil
+		}
+		found[path] = true
+
+		previous, ok := seen[path]
+		if !ok || previous.size != info.Size() || !previous.modTime.Equal(info.ModTime()) {
+			seen[path] = inboxFile{size: info.Size(), modTime: info.ModTime(), since: time.Now()}
+			changing++
+			return nil
+		}
+		if time.Since(previous.since) < inboxStableDelay || time.Since(info.ModTime()) < inboxStableDelay {
+			changing++
+			return nil
+		}
+
+		if !jobQueued(path) && !unmovedFile(path, info) {
+			fmt.Println("inbox: import " + path)
+			enqueueJob(jobImport, path, 0)
+		}
+		return nil
+	})
+
+	for path := range seen {
+		if !found[path] {
+			delete(seen, path)
+		}
+	}
+	inboxUnmovedMutex.Lock()
+	for path := range inboxUnmoved {
+		if !found[path] {
+			delete(inboxUnmoved, path)
+		}
+	}
+	inboxUnmovedMutex.Unlock()
+	return changing
+}
+
+// unmovedFile return true when the file was already imported but could not be moved, and has not changed since
+func unmovedFile(path string, info os.FileInfo) bool {
+	inboxUnmovedMutex.Lock()
+	defer inboxUnmovedMutex.Unlock()
+
+	unmoved, ok := inboxUnmoved[path]
+	return ok && unmoved.size == info.Size() && unmoved.modTime.Equal(info.ModTime())
+}
+
+// partialFile return true for hidden files and files being downloaded
+func partialFile(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".part", ".crdownload", ".tmp", ".partial":
+		return true
+	}
+	return false
+}
+
+// jobQueued return true when an import of the file is waiting or running
+func jobQueued(path string) bool {
+	var count int
+
+	db.Model(&Job{}).Where("path = ? AND status IN (?)", path, []string{jobPending, jobRunning}).Count(&count)
+	return count > 0
+}
+
+// moveInboxFile move the file of an inbox import job to the done or failed folder
+func (job *Job) moveInboxFile() {
+	inbox := currentInbox()
+	if inbox == "" || job.Kind != jobImport {
+		return
+	}
+	rel, err := filepath.Rel(inbox, job.Path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+
+	target := inboxDoneDir
+	if job.Status == jobFailed {
+		target = inboxFailedDir
+	}
+	// a retried file is already in failed
+	parts := strings.SplitN(rel, string(filepath.Separator), 2)
+	if len(parts) == 2 && (parts[0] == inboxDoneDir || parts[0] == inboxFailedDir) {
+		if parts[0] == target {
+			return
+		}
+		rel = parts[1]
+	}
+
+	dest := filepath.Join(inbox, target, rel)
+	if _, err := os.Stat(dest); err == nil {
+		ext := filepath.Ext(dest)
+		dest = strings.TrimSuffix(dest, ext) + "-" + strconv.FormatInt(time.Now().Unix(), 10) + ext
+	}
+	os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	if err := os.Rename(job.Path, dest); err != nil {
+		fmt.Println("inbox: " + err.Error())
+		if info, err := os.Stat(job.Path); err == nil {
+			inboxUnmovedMutex.Lock()
+			inboxUnmoved[job.Path] = inboxFile{size: info.Size(), modTime: info.ModTime()}
+			inboxUnmovedMutex.Unlock()
+		}
+		return
+	}
+	job.Path = dest
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+)
+
+// job kinds
+const (
+	jobImport   = "import"
+	jobAttach   = "attach"
+	jobMetadata = "metadata"
+	jobCover    = "cover"
+	jobSend     = "send"
+)
+
+// job status
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// uploadDir keep uploaded files until their import job is done
+const uploadDir = "db/uploads"
+
+// jobPollInterval is how often idle workers look for jobs added by another process
+const jobPollInterval = 5 * time.Second
+
+// Job store a background task on a book or a file to import
+type Job struct {
+	gorm.Model
+	Kind       string
+	Status     string `gorm:"index"`
+	Path       string
+	BookID     uint
+	DeviceID   uint
+	Progress   int
+	Attempts   int
+	Error      string
+	Message    string
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+var errJobBookNotFound = errors.New("book not found")
+
+// jobWakeup wake up idle workers when a job is queued
+var jobWakeup = make(chan struct{}, 1)
+
+// enqueueJob add a pending job to the queue
+func enqueueJob(kind string, path string, bookID uint) Job {
+	job := Job{Kind: kind, Status: jobPending, Path: path, BookID: bookID}
+	db.Save(&job)
+
+	wakeupJobWorkers()
+	return job
+}
+
+func wakeupJobWorkers() {
+	select {
+	case jobWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// resetRunningJobs put back in the queue jobs interrupted by a stop of the server
+func resetRunningJobs() {
+	db.Model(&Job{}).Where("status = ?", jobRunning).Updates(map[string]interface{}{"status": jobPending, "progress": 0})
+}
+
+// claimJob take the oldest pending job, ok is false when the queue is empty
+func claimJob() (Job, bool) {
+	var job Job
+
+	for {
+		job = Job{}
+		db.Where("status = ?", jobPending).Order("id asc").First(&job)
+		if job.ID == 0 {
+			return job, false
+		}
+		now := time.Now()
+		claim := db.Model(&Job{}).Where("id = ? AND status = ?", job.ID, jobPending).Updates(map[string]interface{}{"status": jobRunning, "started_at": now})
+		if claim.RowsAffected == 1 {
+			job.Status = jobRunning
+			job.StartedAt = &now
+			return job, true
+		}
+		// taken by another worker, try the next one
+	}
+}
+
+// startJobWorkers launch workers running queued jobs in background
+func startJobWorkers(count int) {
+	resetRunningJobs()
+	for i := 0; i < count; i++ {
+		go func() {
+			for {
+				job, ok := claimJob()
+				if ok {
+					job.run()
+					continue
+				}
+				select {
+				case <-jobWakeup:
+				case <-time.After(jobPollInterval):
+				}
+			}
+		}()
+	}
+}
+
+// runJobs run every pending job with count workers and return when the queue is empty
+func runJobs(count int) {
+	var wg sync.WaitGroup
+
+	resetRunningJobs()
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, ok := claimJob()
+				if !ok {
+					return
+				}
+				job.run()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// run execute the job and record its outcome
+func (job *Job) run() {
+	var err error
+
+	job.Attempts++
+	job.Error = ""
+	job.Message = ""
+	db.Save(job)
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+
+		switch job.Kind {
+		case jobImport:
+			err = job.importFile()
+		case jobAttach:
+			err = job.attachFile()
+		case jobMetadata:
+			err = job.refreshMetadata()
+		case jobCover:
+			err = job.extractCover()
+		case jobSend:
+			err = job.sendToDevice()
+		default:
+			err = errors.New("unknown job kind " + job.Kind)
+		}
+	}()
+
+	now := time.Now()
+	job.FinishedAt = &now
+	if err != nil {
+		fmt.Println("job " + strconv.Itoa(int(job.ID)) + " failed: " + err.Error())
+		job.Status = jobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = jobDone
+		job.Progress = 100
+		if strings.HasPrefix(job.Path, uploadDir+"/") {
+			os.RemoveAll(filepath.Dir(job.Path))
+		}
+	}
+	job.moveInboxFile()
+	db.Save(job)
+}
+
+// setProgress record the progress of the job, in percent
+func (job *Job) setProgress(progress int) {
+	job.Progress = progress
+	db.Model(job).UpdateColumn("progress", progress)
+}
+
+// book load the book of the job
+func (job *Job) book() (Book, error) {
+	var book Book
+
+	db.Find(&book, job.BookID)
+	if book.ID == 0 {
+		return book, errJobBookNotFound
+	}
+	return book, nil
+}
+
+// importFile create a book from the file of the job
+func (job *Job) importFile() error {
+	var book Book
+
+	// a previous attempt stopped before the file was stored
+	if job.BookID != 0 {
+		var count int
+		db.Model(&BookFile{}).Where("book_id = ?", job.BookID).Count(&count)
+		if count == 0 {
+			db.Delete(&Book{}, job.BookID)
+		}
+		job.BookID = 0
+	}
+
+	format, err := detectFormat(job.Path)
+	if err != nil {
+		return err
+	}
+	job.setProgress(10)
+
+	if policy := duplicatePolicy(); policy != duplicateImport {
+		duplicate, reason := findDuplicate(job.Path, format)
+		if duplicate.ID != 0 {
+			job.BookID = duplicate.ID
+			if policy == duplicateMerge && reason != duplicateSameFile {
+				var existing BookFile
+				db.Where("book_id = ? AND format = ?", duplicate.ID, format.Name).First(&existing)
+				if existing.ID == 0 {
+					job.Message = reason + ", ajouté au livre existant"
+					_, err = storeBookFile(job.Path, &duplicate, format)
+					return err
+				}
+			}
+			job.Message = reason + ", doublon ignoré"
+			return nil
+		}
+	}
+
+	book.Edited = false
+	book.Title = titleFromFilename(job.Path)
+	book.Format = format.Name
+	book.MediaType = format.MediaType
+	db.Save(&book)
+	job.BookID = book.ID
+	db.Save(job)
+
+	_, err = storeBookFile(job.Path, &book, format)
+	if err != nil {
+		db.Delete(&book)
+		job.BookID = 0
+		return err
+	}
+	job.setProgress(50)
+
+	book.getMetada()
+	return nil
+}
+
+// attachFile add the file of the job as another format of its book
+func (job *Job) attachFile() error {
+	book, err := job.book()
+	if err != nil {
+		return err
+	}
+	job.setProgress(10)
+
+	_, err = attachFile(job.Path, &book)
+	return err
+}
+
+func (job *Job) refreshMetadata() error {
+	book, err := job.book()
+	if err != nil {
+		return err
+	}
+	job.setProgress(10)
+
+	return book.getMetada()
+}
+
+func (job *Job) extractCover() error {
+	book, err := job.book()
+	if err != nil {
+		return err
+	}
+	job.setProgress(10)
+
+	return book.extractCover()
+}
+
+// Label return the description of the job shown on the jobs page
+func (job Job) Label() string {
+	switch job.Kind {
+	case jobImport:
+		return "Import de " + filepath.Base(job.Path)
+	case jobAttach:
+		return "Ajout de " + filepath.Base(job.Path)
+	case jobMetadata:
+		return "Métadonnées"
+	case jobCover:
+		return "Couverture"
+	case jobSend:
+		return "Envoi à une liseuse"
+	}
+	return job.Kind
+}
+
+// saveUpload copy an uploaded file in the upload directory, the file is removed once imported
+func saveUpload(req *http.Request, field string) (string, error) {
+	infile, header, err := req.FormFile(field)
+	if err != nil {
+		return "", err
+	}
+	defer infile.Close()
+
+	// one directory per upload keep the original file name, used as title when the book has no metadata
+	os.MkdirAll(uploadDir, os.ModePerm)
+	dir, err := ioutil.TempDir(uploadDir, "")
+	if err != nil {
+		return "", err
+	}
+	outfile, err := os.Create(filepath.Join(dir, filepath.Base(header.Filename)))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	defer outfile.Close()
+
+	_, err = outfile.ReadFrom(infile)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return outfile.Name(), nil
+}
+
+func jobsHandler(res http.ResponseWriter, req *http.Request) {
+	var jobs []Job
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	vars := mux.Vars(req)
+
+	query := db.Order("id desc").Limit(100)
+	if status := req.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	query.Find(&jobs)
+
+	if vars["format"] == jsonExt {
+		j, _ := json.Marshal(&jobs)
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(j)
+		return
+	}
+
+	active := false
+	for _, job := range jobs {
+		if job.Status == jobPending || job.Status == jobRunning {
+			active = true
+		}
+	}
+
+	jobsTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+	templateFile, _ := pkger.Open("/template/jobs.html")
+	templateData, _ := ioutil.ReadAll(templateFile)
+	jobsTemplate = template.Must(jobsTemplate.Parse(string(templateData)))
+	jobsTemplate.Execute(res, Page{Content: struct {
+		Jobs   []Job
+		Active bool
+	}{jobs, active}, Title: serverOption.Name})
+}
+
+// jobRetryHandler put a failed job back in the queue, or all failed jobs when no id is given
+func jobRetryHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	query := db.Model(&Job{}).Where("status = ?", jobFailed)
+	if vars["id"] != "" {
+		jobID, _ := strconv.ParseInt(vars["id"], 10, 64)
+		query = query.Where("id = ?", jobID)
+	}
+	query.Updates(map[string]interface{}{"status": jobPending, "progress": 0})
+
+	wakeupJobWorkers()
+	http.Redirect(res, req, "/jobs.html", http.StatusFound)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SyncProgress store the reading position sent by a KOReader device for a document
+type SyncProgress struct {
+	gorm.Model
+	UserID     uint   `gorm:"unique_index:idx_sync_user_document"`
+	Document   string `gorm:"unique_index:idx_sync_user_document"`
+	BookID     uint   `gorm:"index"`
+	Progress   string
+	Percentage float64
+	Device     string
+	DeviceID   string
+}
+
+// kosyncPrefixes are the routes of the KOReader sync API, they use their own authentication
+var kosyncPrefixes = []string{"/users/auth", "/users/create", "/syncs/", "/healthcheck"}
+
+// partialMD5 return the document hash used by KOReader, the md5 of 1 KiB samples taken at growing offsets
+func partialMD5(filePath string) string {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	sample := make([]byte, 1024)
+	for i := -1; i <= 10; i++ {
+		// KOReader compute 1024 << 2i with 32 bits shifts, the first offset is 0
+		var offset int64
+		if i >= 0 {
+			offset = 1024 << uint(2*i)
+		}
+		n, err := f.ReadAt(sample, offset)
+		if n == 0 {
+			break
+		}
+		hash.Write(sample[:n])
+		if err == io.EOF {
+			break
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// setupDocumentHashes compute the KOReader hash of files imported before it existed
+func setupDocumentHashes() {
+	var files []BookFile
+
+	db.Where("document_hash IS NULL OR document_hash = ''").Find(&files)
+	for _, file := range files {
+		db.Model(&file).UpdateColumn("document_hash", partialMD5(file.Path))
+	}
+}
+
+// md5Hex return the md5 of the string in hexadecimal, KOReader send the password this way
+func md5Hex(value string) string {
+	sum := md5.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// isKosyncRequest return true for the KOReader sync API
+func isKosyncRequest(req *http.Request) bool {
+	for _, prefix := range kosyncPrefixes {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSyncKey compare the key sent by KOReader, the md5 of the password, with the stored hash
+func (user *User) CheckSyncKey(key string) bool {
+	if user.SyncKeyHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.SyncKeyHash), []byte(strings.ToLower(key))) == nil
+}
+
+// kosyncUser return the user authenticated by the x-auth-user and x-auth-key headers,
+// the key is the md5 of the password or of an OPDS access token
+func kosyncUser(req *http.Request) User {
+	var user User
+	var tokens []ClientToken
+
+	name := req.Header.Get("x-auth-user")
+	key := strings.ToLower(req.Header.Get("x-auth-key"))
+	if name == "" {
+		return user
+	}
+
+	hash := sha256.Sum256([]byte("kosync:" + name + ":" + key))
+	cacheKey := hex.EncodeToString(hash[:])
+	basicAuthMutex.Lock()
+	entry, found := basicAuthCache[cacheKey]
+	basicAuthMutex.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		db.First(&user, entry.userID)
+		return user
+	}
+
+	if loginBlocked(req) {
+		return user
+	}
+	db.Where("name = ?", name).First(&user)
+	if user.ID == 0 {
+		loginFailed(req)
+		return user
+	}
+
+	valid := user.CheckSyncKey(key)
+	if !valid {
+		db.Where("user_id = ? AND revoked_at IS NULL", user.ID).Find(&tokens)
+		for _, token := range tokens {
+			if md5Hex(token.Token) == key {
+				valid = true
+			}
+		}
+	}
+	if !valid && feedAuthRequired() {
+		loginFailed(req)
+		return User{}
+	}
+	loginSucceeded(req)
+
+	basicAuthMutex.Lock()
+	basicAuthCache[cacheKey] = basicAuthEntry{userID: user.ID, expires: time.Now().Add(basicAuthCacheDuration)}
+	basicAuthMutex.Unlock()
+	return user
+}
+
+// writeKosync write a response of the KOReader sync API
+func writeKosync(res http.ResponseWriter, status int, value interface{}) {
+	j, _ := json.Marshal(value)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(j)
+}
+
+func kosyncUnauthorized(res http.ResponseWriter) {
+	writeKosync(res, http.StatusUnauthorized, map[string]interface{}{"code": 2001, "message": "Unauthorized"})
+}
+
+func kosyncHealthHandler(res http.ResponseWriter, req *http.Request) {
+	writeKosync(res, http.StatusOK, map[string]string{"state": "OK"})
+}
+
+// kosyncCreateHandler accept the registration of an existing user only, users are created in myopds
+func kosyncCreateHandler(res http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	json.NewDecoder(req.Body).Decode(&body)
+	req.Header.Set("x-auth-user", body.Username)
+	req.Header.Set("x-auth-key", body.Password)
+	user := kosyncUser(req)
+	if user.ID == 0 {
+		writeKosync(res, http.StatusPaymentRequired, map[string]interface{}{"code": 2005, "message": "Les utilisateurs sont créés dans myopds"})
+		return
+	}
+	writeKosync(res, http.StatusCreated, map[string]string{"username": user.Name})
+}
+
+func kosyncAuthHandler(res http.ResponseWriter, req *http.Request) {
+	if kosyncUser(req).ID == 0 {
+		kosyncUnauthorized(res)
+		return
+	}
+	writeKosync(res, http.StatusOK, map[string]string{"authorized": "OK"})
+}
+
+// kosyncUpdateHandler save the position sent by the device and update the reading state of the book
+func kosyncUpdateHandler(res http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Document   string  `json:"document"`
+		Progress   string  `json:"progress"`
+		Percentage float64 `json:"percentage"`
+		Device     string  `json:"device"`
+		DeviceID   string  `json:"device_id"`
+	}
+	var bookFile BookFile
+	var progress SyncProgress
+
+	user := kosyncUser(req)
+	if user.ID == 0 {
+		kosyncUnauthorized(res)
+		return
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Document == "" {
+		writeKosync(res, http.StatusForbidden, map[string]interface{}{"code": 2003, "message": "Invalid request"})
+		return
+	}
+
+	db.Where("document_hash = ?", body.Document).First(&bookFile)
+
+	db.Where("user_id = ? AND document = ?", user.ID, body.Document).First(&progress)
+	progress.UserID = user.ID
+	progress.Document = body.Document
+	progress.BookID = bookFile.BookID
+	progress.Progress = body.Progress
+	progress.Percentage = body.Percentage
+	progress.Device = body.Device
+	progress.DeviceID = body.DeviceID
+	db.Save(&progress)
+
+	if bookFile.BookID != 0 {
+		updateReadingProgress(user.ID, bookFile.BookID, float32(body.Percentage), body.Progress, body.Device)
+	}
+
+	writeKosync(res, http.StatusOK, map[string]interface{}{"document": progress.Document, "timestamp": progress.UpdatedAt.Unix()})
+}
+
+func kosyncProgressHandler(res http.ResponseWriter, req *http.Request) {
+	var progress SyncProgress
+
+	user := kosyncUser(req)
+	if user.ID == 0 {
+		kosyncUnauthorized(res)
+		return
+	}
+
+	vars := mux.Vars(req)
+	db.Where("user_id = ? AND document = ?", user.ID, vars["document"]).First(&progress)
+	if progress.ID == 0 {
+		writeKosync(res, http.StatusOK, map[string]string{})
+		return
+	}
+	writeKosync(res, http.StatusOK, map[string]interface{}{
+		"document":   progress.Document,
+		"progress":   progress.Progress,
+		"percentage": progress.Percentage,
+		"device":     progress.Device,
+		"device_id":  progress.DeviceID,
+		"timestamp":  progress.UpdatedAt.Unix(),
+	})
+}
+
+// updateReadingProgress record the position of the user in the book, the book is marked read past the threshold
+func updateReadingProgress(userID uint, bookID uint, percentage float32, position string, device string) {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	now := time.Now()
+
+	state := userBook(userID, bookID)
+	state.Progress = percentage
+	state.Position = position
+	state.Device = device
+	state.ProgressAt = &now
+	if serverOption.ReadThreshold > 0 && percentage*100 >= float32(serverOption.ReadThreshold) && !state.Read {
+		state.Read = true
+		state.ReadAt = &now
+	}
+	db.Save(&state)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+)
+
+// Device store an e-reader receiving books by mail, like a Kindle address
+type Device struct {
+	gorm.Model
+	UserID uint `gorm:"index"`
+	Name   string
+	Email  string
+	// Format is the preferred format of the device, empty to send the main file
+	Format string
+}
+
+// maxMailSize is the size limit of the attachment of most mail services
+const maxMailSize = 50 * 1024 * 1024
+
+var errSMTPNotConfigured = errors.New("serveur SMTP non configuré")
+var errDeviceNotFound = errors.New("liseuse introuvable")
+
+// userDevices return the devices of the user
+func userDevices(userID uint) []Device {
+	var devices []Device
+
+	db.Where("user_id = ?", userID).Order("name asc").Find(&devices)
+	return devices
+}
+
+// convertBook convert the file with calibre ebook-convert when it is installed
+func convertBook(filePath string, format Format) (string, error) {
+	command, err := exec.LookPath("ebook-convert")
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "myopds-convert")
+	if err != nil {
+		return "", err
+	}
+	output := filepath.Join(dir, "book."+format.Extension)
+	out, err := exec.Command(command, filePath, output).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("ebook-convert: %v %s", err, lastLine(string(out)))
+	}
+	return output, nil
+}
+
+// lastLine return the last non empty line of a command output
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
+
+// deliveryFile choose the file sent to the device, converted to its format when the book doesn't have it.
+// The returned cleanup remove the converted file.
+func deliveryFile(book Book, device Device) (string, Format, func(), string) {
+	files := book.bookFiles()
+	noop := func() {}
+	if len(files) == 0 {
+		return "", Format{}, noop, ""
+	}
+
+	if device.Format != "" {
+		for _, file := range files {
+			if file.Format == device.Format {
+				filePath, _ := servedFilePath(book, file)
+				return filePath, formatByName(file.Format), noop, ""
+			}
+		}
+		format := formatByName(device.Format)
+		converted, err := convertBook(files[0].Path, format)
+		if err == nil {
+			return converted, format, func() { os.RemoveAll(filepath.Dir(converted)) }, "converti en " + strings.ToUpper(format.Name)
+		}
+		return files[0].Path, formatByName(files[0].Format), noop, "conversion en " + strings.ToUpper(device.Format) + " impossible"
+	}
+	filePath, _ := servedFilePath(book, files[0])
+	return filePath, formatByName(files[0].Format), noop, ""
+}
+
+// mailMessage build a mail with the book as attachment
+func mailMessage(from string, to string, subject string, filename string, mediaType string, data []byte) []byte {
+	var body bytes.Buffer
+
+	writer := multipart.NewWriter(&body)
+	text, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	text.Write([]byte(subject + "\r\n"))
+
+	attachment, _ := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mediaType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+	})
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		attachment.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	attachment.Write([]byte(encoded + "\r\n"))
+	writer.Close()
+
+	var message bytes.Buffer
+	message.WriteString("From: " + from + "\r\n")
+	message.WriteString("To: " + to + "\r\n")
+	message.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	message.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: multipart/mixed; boundary=" + writer.Boundary() + "\r\n\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes()
+}
+
+// sendMail send the message with the SMTP server of the settings, STARTTLS is used when the server offer it
+func sendMail(serverOption ServerOption, to string, message []byte) error {
+	if serverOption.SMTPHost == "" || serverOption.SMTPFrom == "" {
+		return errSMTPNotConfigured
+	}
+	var auth smtp.Auth
+	if serverOption.SMTPUser != "" {
+		auth = smtp.PlainAuth("", serverOption.SMTPUser, serverOption.SMTPPassword, serverOption.SMTPHost)
+	}
+	addr := net.JoinHostPort(serverOption.SMTPHost, strconv.Itoa(serverOption.SMTPPort))
+	return smtp.SendMail(addr, auth, serverOption.SMTPFrom, []string{to}, message)
+}
+
+// sendToDevice mail the book of the job to its device
+func (job *Job) sendToDevice() error {
+	var device Device
+	var serverOption ServerOption
+
+	book, err := job.book()
+	if err != nil {
+		return err
+	}
+	db.First(&device, job.DeviceID)
+	if device.ID == 0 {
+		return errDeviceNotFound
+	}
+	db.First(&serverOption)
+	job.setProgress(10)
+
+	filePath, format, cleanup, note := deliveryFile(book, device)
+	defer cleanup()
+	if filePath == "" {
+		return errors.New("livre sans fichier")
+	}
+	job.setProgress(40)
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMailSize {
+		return errors.New("fichier trop gros pour être envoyé par mail")
+	}
+
+	filename := book.Title + "." + format.Extension
+	err = sendMail(serverOption, device.Email, mailMessage(serverOption.SMTPFrom, device.Email, book.Title, filename, format.MediaType, data))
+	if err != nil {
+		return err
+	}
+	job.Message = "envoyé à " + device.Name + " (" + device.Email + ")"
+	if note != "" {
+		job.Message += ", " + note
+	}
+	return nil
+}
+
+// enqueueSend queue the delivery of the book to the device
+func enqueueSend(bookID uint, deviceID uint) Job {
+	job := Job{Kind: jobSend, Status: jobPending, BookID: bookID, DeviceID: deviceID}
+	db.Save(&job)
+
+	wakeupJobWorkers()
+	return job
+}
+
+func devicesHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	user := currentUser(req)
+
+	if req.Method == http.MethodPost {
+		device := Device{
+			UserID: user.ID,
+			Name:   req.FormValue("name"),
+			Email:  strings.TrimSpace(req.FormValue("email")),
+			Format: req.FormValue("format"),
+		}
+		if device.Name == "" {
+			device.Name = device.Email
+		}
+		if strings.Contains(device.Email, "@") {
+			db.Save(&device)
+		}
+
+		res.Header().Set("Location", "/devices.html")
+		res.WriteHeader(302)
+		return
+	}
+
+	devicesTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+	templateFile, _ := pkger.Open("/template/devices.html")
+	templateData, _ := ioutil.ReadAll(templateFile)
+	devicesTemplate = template.Must(devicesTemplate.Parse(string(templateData)))
+	devicesTemplate.Execute(res, Page{Content: struct {
+		Devices    []Device
+		Formats    []Format
+		Configured bool
+		From       string
+	}{userDevices(user.ID), formats, serverOption.SMTPHost != "", serverOption.SMTPFrom}, Title: serverOption.Name})
+}
+
+func deviceDeleteHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	deviceID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.Where("user_id = ?", currentUser(req).ID).Delete(&Device{}, deviceID)
+	http.Redirect(res, req, "/devices.html", http.StatusFound)
+}
+
+// sendBookHandler queue the delivery of a book to a device of the user
+func sendBookHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+	var device Device
+
+	vars := mux.Vars(req)
+	db.Find(&book, vars["id"])
+	deviceID, _ := strconv.ParseInt(req.FormValue("device_id"), 10, 64)
+	db.Where("user_id = ?", currentUser(req).ID).First(&device, deviceID)
+	if book.ID == 0 || device.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+
+	enqueueSend(book.ID, device.ID)
+	http.Redirect(res, req, "/jobs.html", http.StatusFound)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// smtpEnvelope is what the fake SMTP server received
+type smtpEnvelope struct {
+	From string
+	To   []string
+	Data string
+}
+
+// fakeSMTP accept one mail on a local port, without STARTTLS nor AUTH
+func fakeSMTP(t *testing.T) (string, int, chan smtpEnvelope) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan smtpEnvelope, 1)
+
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var envelope smtpEnvelope
+		reader := bufio.NewReader(conn)
+		reply := func(line string) {
+			conn.Write([]byte(line + "\r\n"))
+		}
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(command, "MAIL FROM:"):
+				envelope.From = strings.Trim(strings.TrimSpace(line)[len("MAIL FROM:"):], "<>")
+				reply("250 OK")
+			case strings.HasPrefix(command, "RCPT TO:"):
+				envelope.To = append(envelope.To, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+				reply("250 OK")
+			case command == "DATA":
+				reply("354 end with .")
+				var data bytes.Buffer
+				for {
+					dataLine, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if dataLine == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(dataLine, "."))
+				}
+				envelope.Data = data.String()
+				reply("250 OK")
+			case command == "QUIT":
+				reply("221 bye")
+				received <- envelope
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, received
+}
+
+// testDB open an empty database in a temporary directory
+func testDB(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "myopds-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = gorm.Open("sqlite3", filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&ServerOption{}, &BookFile{})
+	return func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMailMessage(t *testing.T) {
+	data := bytes.Repeat([]byte("livre numérique "), 40)
+	message := mailMessage("bibliotheque@example.org", "liseuse@kindle.com", "Les Misérables", "Les Misérables.epub", "application/epub+zip", data)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("From") != "bibliotheque@example.org" || msg.Header.Get("To") != "liseuse@kindle.com" {
+		t.Fatalf("wrong addresses %q %q", msg.Header.Get("From"), msg.Header.Get("To"))
+	}
+	// the accents of the subject are Q-encoded
+	subject := msg.Header.Get("Subject")
+	if subject != "=?utf-8?q?Les_Mis=C3=A9rables?=" {
+		t.Fatalf("subject not Q-encoded: %q", subject)
+	}
+	decoded, _ := new(mime.WordDecoder).DecodeHeader(subject)
+	if decoded != "Les Misérables" {
+		t.Fatalf("subject decoded as %q", decoded)
+	}
+	if msg.Header.Get("MIME-Version") != "1.0" {
+		t.Fatal("missing MIME-Version")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("wrong content type %q", msg.Header.Get("Content-Type"))
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+
+	text, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("wrong text part %q", text.Header.Get("Content-Type"))
+	}
+
+	attachment, err := parts.NextRawPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.Header.Get("Content-Type") != "application/epub+zip" || attachment.Header.Get("Content-Transfer-Encoding") != "base64" {
+		t.Fatalf("wrong attachment headers %v", attachment.Header)
+	}
+	disposition, dispositionParams, err := mime.ParseMediaType(attachment.Header.Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" || dispositionParams["filename"] != "Les Misérables.epub" {
+		t.Fatalf("wrong disposition %q", attachment.Header.Get("Content-Disposition"))
+	}
+
+	body, _ := ioutil.ReadAll(attachment)
+	lines := strings.Split(strings.TrimRight(string(body), "\r\n"), "\r\n")
+	if len(lines) < 2 {
+		t.Fatalf("attachment not wrapped: %d lines", len(lines))
+	}
+	for i, line := range lines {
+		if len(line) > 76 || (i < len(lines)-1 && len(line) != 76) {
+			t.Fatalf("line %d is %d columns", i, len(line))
+		}
+	}
+	content, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+	if err != nil || !bytes.Equal(content, data) {
+		t.Fatal("attachment content changed")
+	}
+
+	if _, err := parts.NextPart(); err == nil {
+		t.Fatal("unexpected third part")
+	}
+}
+
+func TestSendMail(t *testing.T) {
+	host, port, received := fakeSMTP(t)
+	serverOption := ServerOption{SMTPHost: host, SMTPPort: port, SMTPFrom: "bibliotheque@example.org"}
+	message := mailMessage(serverOption.SMTPFrom, "liseuse@kindle.com", "Le Horla", "Le Horla.pdf", "application/pdf", []byte("%PDF-1.4"))
+
+	if err := sendMail(serverOption, "liseuse@kindle.com", message); err != nil {
+		t.Fatal(err)
+	}
+	envelope := <-received
+	if envelope.From != "bibliotheque@example.org" {
+		t.Fatalf("wrong sender %q", envelope.From)
+	}
+	if len(envelope.To) != 1 || envelope.To[0] != "liseuse@kindle.com" {
+		t.Fatalf("wrong recipients %v", envelope.To)
+	}
+	if envelope.Data != string(message) {
+		t.Fatal("the message was changed on the way")
+	}
+}
+
+func TestSendMailNotConfigured(t *testing.T) {
+	if err := sendMail(ServerOption{SMTPFrom: "bibliotheque@example.org"}, "liseuse@kindle.com", nil); err != errSMTPNotConfigured {
+		t.Fatalf("expected errSMTPNotConfigured, got %v", err)
+	}
+	if err := sendMail(ServerOption{SMTPHost: "localhost"}, "liseuse@kindle.com", nil); err != errSMTPNotConfigured {
+		t.Fatalf("expected errSMTPNotConfigured, got %v", err)
+	}
+}
+
+func TestDeliveryFile(t *testing.T) {
+	defer testDB(t)()
+
+	dir, err := ioutil.TempDir("", "myopds-books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var book Book
+	book.ID = 1
+	for _, name := range []string{"epub", "pdf"} {
+		format := formatByName(name)
+		filePath := filepath.Join(dir, "1."+format.Extension)
+		ioutil.WriteFile(filePath, []byte(name), 0644)
+		db.Save(&BookFile{BookID: book.ID, Format: format.Name, MediaType: format.MediaType, Path: filePath})
+	}
+
+	// no preferred format, the main file is sent
+	filePath, format, cleanup, note := deliveryFile(book, Device{})
+	cleanup()
+	if format.Name != "epub" || filepath.Base(filePath) != "1.epub" || note != "" {
+		t.Fatalf("main file: got %s %s %q", filePath, format.Name, note)
+	}
+
+	// the book has the format of the device
+	filePath, format, cleanup, note = deliveryFile(book, Device{Format: "pdf"})
+	cleanup()
+	if format.Name != "pdf" || filepath.Base(filePath) != "1.pdf" || note != "" {
+		t.Fatalf("device format: got %s %s %q", filePath, format.Name, note)
+	}
+
+	// a book without file has nothing to send
+	var empty Book
+	empty.ID = 2
+	if filePath, _, cleanup, _ := deliveryFile(empty, Device{}); filePath != "" {
+		cleanup()
+		t.Fatalf("book without file: got %s", filePath)
+	}
+
+	if _, err := exec.LookPath("ebook-convert"); err == nil {
+		t.Log("ebook-convert is installed, the failed conversion is not checked")
+		return
+	}
+	// without calibre the main file is sent with a note
+	filePath, format, cleanup, note = deliveryFile(book, Device{Format: "mobi"})
+	cleanup()
+	if format.Name != "epub" || filepath.Base(filePath) != "1.epub" || note != "conversion en MOBI impossible" {
+		t.Fatalf("failed conversion: got %s %s %q", filePath, format.Name, note)
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/gorilla/mux"
+)
+
+// MetadataQuery is what is known of a book to look it up online
+type MetadataQuery struct {
+	Isbn   string
+	Title  string
+	Author string
+}
+
+// MetadataCandidate is a record found by a provider
+type MetadataCandidate struct {
+	BookMetadata
+	Provider string
+	// URL is the page of the record on the provider site
+	URL      string
+	CoverURL string
+}
+
+// MetadataProvider look up books in an online catalog
+type MetadataProvider interface {
+	Name() string
+	Search(query MetadataQuery) ([]MetadataCandidate, error)
+}
+
+// maxCandidates is the number of records kept by provider
+const maxCandidates = 5
+
+// metadataProviders return the providers in the order their candidates are shown
+func metadataProviders() []MetadataProvider {
+	return []MetadataProvider{
+		&OpenLibraryProvider{BaseURL: "https://openlibrary.org", CoversURL: "https://covers.openlibrary.org"},
+		&GoogleBooksProvider{BaseURL: "https://www.googleapis.com"},
+		&BnfProvider{BaseURL: "https://catalogue.bnf.fr"},
+	}
+}
+
+// lookupQuery return the query to look up the book
+func lookupQuery(book Book) MetadataQuery {
+	query := MetadataQuery{Isbn: normalizeIsbn(book.Isbn), Title: book.Title}
+	if len(book.Authors) > 0 {
+		query.Author = book.Authors[0].Name
+	}
+	return query
+}
+
+// lookupMetadata query all the providers at the same time, a search by ISBN falling back on the title and author.
+// The errors of the providers are returned with the candidates of the others.
+func lookupMetadata(providers []MetadataProvider, query MetadataQuery) ([]MetadataCandidate, []error) {
+	results := make([][]MetadataCandidate, len(providers))
+	errs := make([]error, len(providers))
+
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func(i int, provider MetadataProvider) {
+			defer wg.Done()
+			candidates, err := provider.Search(query)
+			if err == nil && len(candidates) == 0 && query.Isbn != "" && query.Title != "" {
+				candidates, err = provider.Search(MetadataQuery{Title: query.Title, Author: query.Author})
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %v", provider.Name(), err)
+			}
+			if len(candidates) > maxCandidates {
+				candidates = candidates[:maxCandidates]
+			}
+			results[i] = candidates
+		}(i, provider)
+	}
+	wg.Wait()
+
+	var candidates []MetadataCandidate
+	var failures []error
+	for i := range providers {
+		candidates = append(candidates, results[i]...)
+		if errs[i] != nil {
+			failures = append(failures, errs[i])
+		}
+	}
+	return candidates, failures
+}
+
+// providerGet fetch a provider url
+func providerGet(rawURL string) ([]byte, error) {
+	client := http.Client{Timeout: 15 * time.Second}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "MyOPDS")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// languageCodes turn the MARC language codes used by the catalogs into the codes of the EPUB files
+var languageCodes = map[string]string{
+	"fre": "fr", "fra": "fr", "eng": "en", "ger": "de", "deu": "de", "spa": "es",
+	"ita": "it", "por": "pt", "dut": "nl", "nld": "nl", "lat": "la", "jpn": "ja",
+}
+
+func providerLanguage(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if short, ok := languageCodes[code]; ok {
+		return short
+	}
+	return code
+}
+
+var yearRegexp = regexp.MustCompile(`\b(1[5-9]|20)\d\d\b`)
+
+// providerDate parse the publication dates of the catalogs, often only a year
+func providerDate(value string) *time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{"2006-01-02", "2006-01", "January 2, 2006", "Jan 2, 2006", "January 2006", "Jan 2006", "2006"} {
+		if date, err := time.Parse(layout, value); err == nil {
+			return &date
+		}
+	}
+	if year := yearRegexp.FindString(value); year != "" {
+		date, _ := time.Parse("2006", year)
+		return &date
+	}
+	return nil
+}
+
+var tagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// plainText remove the html of a description
+func plainText(value string) string {
+	value = strings.Replace(value, "<br>", "\n", -1)
+	value = strings.Replace(value, "</p>", "\n", -1)
+	return strings.TrimSpace(html.UnescapeString(tagRegexp.ReplaceAllString(value, "")))
+}
+
+// OpenLibraryProvider search the Open Library catalog
+type OpenLibraryProvider struct {
+	BaseURL   string
+	CoversURL string
+}
+
+// Name of the provider
+func (provider *OpenLibraryProvider) Name() string {
+	return "Open Library"
+}
+
+type openLibraryDoc struct {
+	Key              string   `json:"key"`
+	Title            string   `json:"title"`
+	Subtitle         string   `json:"subtitle"`
+	AuthorName       []string `json:"author_name"`
+	Publisher        []string `json:"publisher"`
+	FirstPublishYear int      `json:"first_publish_year"`
+	Isbn             []string `json:"isbn"`
+	Language         []string `json:"language"`
+	Subject          []string `json:"subject"`
+	CoverI           int      `json:"cover_i"`
+}
+
+type openLibraryEdition struct {
+	Title       string                  `json:"title"`
+	Subtitle    string                  `json:"subtitle"`
+	URL         string                  `json:"url"`
+	Authors     []struct{ Name string } `json:"authors"`
+	Publishers  []struct{ Name string } `json:"publishers"`
+	PublishDate string                  `json:"publish_date"`
+	Subjects    []struct{ Name string } `json:"subjects"`
+	Notes       json.RawMessage         `json:"notes"`
+	Cover       struct {
+		Large  string `json:"large"`
+		Medium string `json:"medium"`
+	} `json:"cover"`
+}
+
+// Search look up the edition of the ISBN, or search the works by title and author
+func (provider *OpenLibraryProvider) Search(query MetadataQuery) ([]MetadataCandidate, error) {
+	if query.Isbn != "" {
+		return provider.searchIsbn(query.Isbn)
+	}
+	params := url.Values{"title": {query.Title}, "limit": {"5"}}
+	if query.Author != "" {
+		params.Set("author", query.Author)
+	}
+	data, err := providerGet(provider.BaseURL + "/search.json?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Docs []openLibraryDoc `json:"docs"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	var candidates []MetadataCandidate
+	for _, doc := range result.Docs {
+		candidate := MetadataCandidate{Provider: provider.Name(), URL: provider.BaseURL + doc.Key}
+		candidate.Title = joinSubtitle(doc.Title, doc.Subtitle)
+		candidate.Authors = doc.AuthorName
+		if len(doc.Publisher) > 0 {
+			candidate.Publisher = doc.Publisher[0]
+		}
+		if doc.FirstPublishYear != 0 {
+			candidate.PublishedAt = providerDate(fmt.Sprint(doc.FirstPublishYear))
+		}
+		for _, isbn := range doc.Isbn {
+			if normalized := normalizeIsbn(isbn); normalized != "" {
+				candidate.Isbn = normalized
+				break
+			}
+		}
+		if len(doc.Language) > 0 {
+			candidate.Language = providerLanguage(doc.Language[0])
+		}
+		candidate.Tags = firstStrings(doc.Subject, 8)
+		if doc.CoverI != 0 {
+			candidate.CoverURL = fmt.Sprintf("%s/b/id/%d-L.jpg", provider.CoversURL, doc.CoverI)
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+func (provider *OpenLibraryProvider) searchIsbn(isbn string) ([]MetadataCandidate, error) {
+	data, err := providerGet(provider.BaseURL + "/api/books?format=json&jscmd=data&bibkeys=ISBN:" + url.QueryEscape(isbn))
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]openLibraryEdition
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	edition, ok := result["ISBN:"+isbn]
+	if !ok {
+		return nil, nil
+	}
+
+	candidate := MetadataCandidate{Provider: provider.Name(), URL: edition.URL, CoverURL: edition.Cover.Large}
+	candidate.Title = joinSubtitle(edition.Title, edition.Subtitle)
+	for _, author := range edition.Authors {
+		candidate.Authors = append(candidate.Authors, author.Name)
+	}
+	if len(edition.Publishers) > 0 {
+		candidate.Publisher = edition.Publishers[0].Name
+	}
+	candidate.PublishedAt = providerDate(edition.PublishDate)
+	candidate.Isbn = isbn
+	for _, subject := range edition.Subjects {
+		candidate.Tags = append(candidate.Tags, subject.Name)
+	}
+	candidate.Tags = firstStrings(candidate.Tags, 8)
+	// notes is a string or a typed text object
+	var notes string
+	if json.Unmarshal(edition.Notes, &notes) != nil {
+		var text struct{ Value string }
+		json.Unmarshal(edition.Notes, &text)
+		notes = text.Value
+	}
+	candidate.Description = plainText(notes)
+	if candidate.CoverURL == "" {
+		candidate.CoverURL = edition.Cover.Medium
+	}
+	return []MetadataCandidate{candidate}, nil
+}
+
+// GoogleBooksProvider search the Google Books volumes
+type GoogleBooksProvider struct {
+	BaseURL string
+}
+
+// Name of the provider
+func (provider *GoogleBooksProvider) Name() string {
+	return "Google Books"
+}
+
+type googleVolume struct {
+	ID         string `json:"id"`
+	VolumeInfo struct {
+		Title               string   `json:"title"`
+		Subtitle            string   `json:"subtitle"`
+		Authors             []string `json:"authors"`
+		Publisher           string   `json:"publisher"`
+		PublishedDate       string   `json:"publishedDate"`
+		Description         string   `json:"description"`
+		Language            string   `json:"language"`
+		Categories          []string `json:"categories"`
+		InfoLink            string   `json:"infoLink"`
+		IndustryIdentifiers []struct {
+			Type       string `json:"type"`
+			Identifier string `json:"identifier"`
+		} `json:"industryIdentifiers"`
+		ImageLinks struct {
+			Thumbnail      string `json:"thumbnail"`
+			SmallThumbnail string `json:"smallThumbnail"`
+		} `json:"imageLinks"`
+	} `json:"volumeInfo"`
+}
+
+// Search query the volumes by isbn, or by title and author
+func (provider *GoogleBooksProvider) Search(query MetadataQuery) ([]MetadataCandidate, error) {
+	q := "isbn:" + query.Isbn
+	if query.Isbn == "" {
+		q = "intitle:" + query.Title
+		if query.Author != "" {
+			q += " inauthor:" + query.Author
+		}
+	}
+	params := url.Values{"q": {q}, "maxResults": {"5"}}
+	data, err := providerGet(provider.BaseURL + "/books/v1/volumes?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Items []googleVolume `json:"items"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	var candidates []MetadataCandidate
+	for _, volume := range result.Items {
+		info := volume.VolumeInfo
+		candidate := MetadataCandidate{Provider: provider.Name(), URL: info.InfoLink}
+		candidate.Title = joinSubtitle(info.Title, info.Subtitle)
+		candidate.Authors = info.Authors
+		candidate.Publisher = info.Publisher
+		candidate.PublishedAt = providerDate(info.PublishedDate)
+		candidate.Description = plainText(info.Description)
+		candidate.Language = providerLanguage(info.Language)
+		candidate.Tags = info.Categories
+		for _, identifier := range info.IndustryIdentifiers {
+			if strings.HasPrefix(identifier.Type, "ISBN") && candidate.Isbn == "" {
+				candidate.Isbn = normalizeIsbn(identifier.Identifier)
+			}
+		}
+		candidate.CoverURL = info.ImageLinks.Thumbnail
+		if candidate.CoverURL == "" {
+			candidate.CoverURL = info.ImageLinks.SmallThumbnail
+		}
+		candidate.CoverURL = strings.Replace(candidate.CoverURL, "&edge=curl", "", 1)
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// BnfProvider search the catalog of the Bibliothèque nationale de France with its SRU api, good for the french books
+type BnfProvider struct {
+	BaseURL string
+}
+
+// Name of the provider
+func (provider *BnfProvider) Name() string {
+	return "BnF"
+}
+
+// Search query the records in dublin core
+func (provider *BnfProvider) Search(query MetadataQuery) ([]MetadataCandidate, error) {
+	cql := `bib.isbn all "` + query.Isbn + `"`
+	if query.Isbn == "" {
+		cql = `bib.title all "` + cqlEscape(query.Title) + `"`
+		if query.Author != "" {
+			cql += ` and bib.author all "` + cqlEscape(query.Author) + `"`
+		}
+	}
+	params := url.Values{
+		"version":        {"1.2"},
+		"operation":      {"searchRetrieve"},
+		"recordSchema":   {"dublincore"},
+		"maximumRecords": {"5"},
+		"query":          {cql},
+	}
+	data, err := providerGet(provider.BaseURL + "/api/SRU?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, err
+	}
+
+	var candidates []MetadataCandidate
+	for _, record := range doc.FindElements("//record/recordData/dc") {
+		candidate := MetadataCandidate{Provider: provider.Name()}
+		if title := record.SelectElement("title"); title != nil {
+			// "Le Horla / Guy de Maupassant ; préface de ..."
+			candidate.Title = strings.TrimSpace(strings.SplitN(title.Text(), " / ", 2)[0])
+		}
+		for _, creator := range record.SelectElements("creator") {
+			candidate.Authors = append(candidate.Authors, bnfAuthor(creator.Text()))
+		}
+		if publisher := record.SelectElement("publisher"); publisher != nil {
+			// "Gallimard (Paris)"
+			candidate.Publisher = strings.TrimSpace(strings.SplitN(publisher.Text(), " (", 2)[0])
+		}
+		if date := record.SelectElement("date"); date != nil {
+			candidate.PublishedAt = providerDate(date.Text())
+		}
+		for _, description := range record.SelectElements("description") {
+			if candidate.Description != "" {
+				candidate.Description += "\n"
+			}
+			candidate.Description += strings.TrimSpace(description.Text())
+		}
+		if language := record.SelectElement("language"); language != nil {
+			candidate.Language = providerLanguage(language.Text())
+		}
+		for _, identifier := range record.SelectElements("identifier") {
+			value := strings.TrimSpace(identifier.Text())
+			if strings.HasPrefix(value, "http") && candidate.URL == "" {
+				candidate.URL = value
+			} else if strings.HasPrefix(strings.ToUpper(value), "ISBN") && candidate.Isbn == "" {
+				candidate.Isbn = normalizeIsbn(value[4:])
+			}
+		}
+		for _, subject := range record.SelectElements("subject") {
+			candidate.Tags = append(candidate.Tags, strings.TrimSpace(strings.SplitN(subject.Text(), " -- ", 2)[0]))
+		}
+		candidate.Tags = firstStrings(candidate.Tags, 8)
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// bnfAuthor turn "Maupassant, Guy de (1850-1893). Auteur du texte" into "Guy de Maupassant"
+func bnfAuthor(creator string) string {
+	name := strings.SplitN(creator, " (", 2)[0]
+	name = strings.SplitN(name, ". ", 2)[0]
+	return displayName(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+func cqlEscape(value string) string {
+	return strings.Replace(value, `"`, " ", -1)
+}
+
+// joinSubtitle add the subtitle after the title
+func joinSubtitle(title string, subtitle string) string {
+	if subtitle == "" {
+		return title
+	}
+	return title + " : " + subtitle
+}
+
+// firstStrings return the first values without the duplicates
+func firstStrings(values []string, max int) []string {
+	var kept []string
+	seen := map[string]bool{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[strings.ToLower(value)] {
+			continue
+		}
+		seen[strings.ToLower(value)] = true
+		kept = append(kept, value)
+		if len(kept) == max {
+			break
+		}
+	}
+	return kept
+}
+
+// MetadataField is a value of a candidate shown next to the value of the book
+type MetadataField struct {
+	Name    string
+	Label   string
+	Current string
+	Values  []string
+	// Checked is the default choice, a book edited by hand only get its empty fields filled
+	Checked bool
+}
+
+// Value return the values of the field for display
+func (field MetadataField) Value() string {
+	return strings.Join(field.Values, ", ")
+}
+
+// MetadataChoice is a candidate with its fields different from the book
+type MetadataChoice struct {
+	MetadataCandidate
+	Fields []MetadataField
+}
+
+// metadataChoice compare the candidate with the book
+func metadataChoice(book Book, tags []string, candidate MetadataCandidate) MetadataChoice {
+	var authors []string
+	for _, author := range book.Authors {
+		authors = append(authors, author.Name)
+	}
+	cover := ""
+	if book.CoverDownloadURL() != "" {
+		cover = book.ThumbnailURL()
+	}
+	published := ""
+	if candidate.PublishedAt != nil {
+		published = candidate.PublishedAt.Format("2006-01-02")
+	}
+
+	choice := MetadataChoice{MetadataCandidate: candidate}
+	add := func(name string, label string, current string, values ...string) {
+		values = firstStrings(values, len(values))
+		if len(values) == 0 || strings.Join(values, ", ") == current {
+			return
+		}
+		choice.Fields = append(choice.Fields, MetadataField{
+			Name:    name,
+			Label:   label,
+			Current: current,
+			Values:  values,
+			Checked: !book.Edited || current == "",
+		})
+	}
+	add("title", "Titre", book.Title, candidate.Title)
+	add("authors", "Auteurs", strings.Join(authors, ", "), candidate.Authors...)
+	add("isbn", "ISBN", book.Isbn, candidate.Isbn)
+	add("publisher", "Editeur", book.Publisher, candidate.Publisher)
+	add("published", "Date de publication", book.PublishedDate(), published)
+	add("language", "Langue", book.Language, candidate.Language)
+	add("tags", "Tags", strings.Join(tags, ", "), candidate.Tags...)
+	add("description", "Description", book.Description, candidate.Description)
+	add("cover", "Couverture", cover, candidate.CoverURL)
+	return choice
+}
+
+// metadataChoices look up the book and compare the candidates with it
+func metadataChoices(book Book, query MetadataQuery) ([]MetadataChoice, []error) {
+	var tags []string
+
+	if book.TagFormData() != "" {
+		tags = strings.Split(book.TagFormData(), ",")
+	}
+	candidates, errs := lookupMetadata(metadataProviders(), query)
+	choices := make([]MetadataChoice, 0, len(candidates))
+	for _, candidate := range candidates {
+		if choice := metadataChoice(book, tags, candidate); len(choice.Fields) > 0 {
+			choices = append(choices, choice)
+		}
+	}
+	return choices, errs
+}
+
+// applyMetadataHandler write the fields of a candidate chosen on the edit page in the book
+func applyMetadataHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+
+	vars := mux.Vars(req)
+	db.Preload("Authors").Find(&book, vars["id"])
+	if book.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+	req.ParseForm()
+
+	// the cover is downloaded first, nothing is changed when it fails
+	var cover []byte
+	for _, field := range req.Form["field"] {
+		if field == "cover" {
+			data, err := downloadCover(req.FormValue("value_cover"))
+			if err != nil {
+				http.Error(res, "Error saving cover: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			cover = data
+		}
+	}
+	for _, field := range req.Form["field"] {
+		values := req.Form["value_"+field]
+		value := strings.Join(values, "\n")
+		switch field {
+		case "title":
+			book.Title = value
+		case "isbn":
+			book.Isbn = value
+		case "publisher":
+			book.Publisher = value
+		case "language":
+			book.Language = value
+		case "description":
+			book.Description = value
+		case "published":
+			if published, err := time.Parse("2006-01-02", value); err == nil {
+				book.PublishedAt = &published
+			}
+		case "authors":
+			var authors []Author
+			for _, name := range values {
+				authors = append(authors, findOrCreateAuthor(name, ""))
+			}
+			db.Model(&book).Association("Authors").Clear()
+			book.Authors = authors
+		case "tags":
+			var tags []Tag
+			db.Unscoped().Where("book_id = ?", book.ID).Delete(BookTag{})
+			for _, name := range values {
+				if tag := findOrCreateTag(name); tag.ID != 0 {
+					tags = append(tags, tag)
+				}
+			}
+			book.Tags = tags
+		}
+	}
+	book.Edited = true
+	db.Save(&book)
+
+	if cover != nil {
+		if err := book.replaceCover(cover); err != nil {
+			http.Error(res, "Error saving cover: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	http.Redirect(res, req, "/books/"+vars["id"]+".html", http.StatusFound)
+}
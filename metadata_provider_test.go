@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fixtureServer answer the body of the path, the requests are kept to check the queries
+func fixtureServer(fixtures map[string]string) (*httptest.Server, *[]*http.Request) {
+	var requests []*http.Request
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req)
+		body, ok := fixtures[req.URL.Path]
+		if !ok {
+			http.NotFound(res, req)
+			return
+		}
+		res.Write([]byte(body))
+	}))
+	return server, &requests
+}
+
+const openLibraryEditionFixture = `{"ISBN:9782070360024": {
+	"title": "Le Horla", "subtitle": "et autres contes", "url": "https://openlibrary.org/books/OL1M",
+	"authors": [{"name": "Guy de Maupassant"}], "publishers": [{"name": "Gallimard"}],
+	"publish_date": "March 5, 1986", "subjects": [{"name": "Fantastique"}, {"name": "Nouvelles"}],
+	"notes": {"type": "/type/text", "value": "Recueil <b>fantastique</b>"},
+	"cover": {"medium": "https://covers.openlibrary.org/b/id/1-M.jpg"}}}`
+
+const openLibrarySearchFixture = `{"docs": [{"key": "/works/OL2W", "title": "Le Horla", "author_name": ["Guy de Maupassant"],
+	"publisher": ["Folio"], "first_publish_year": 1887, "isbn": ["bad", "2070360024"], "language": ["fre"],
+	"subject": ["Horreur", "horreur", "Folie"], "cover_i": 42}]}`
+
+func TestOpenLibraryIsbn(t *testing.T) {
+	server, requests := fixtureServer(map[string]string{"/api/books": openLibraryEditionFixture})
+	defer server.Close()
+	provider := &OpenLibraryProvider{BaseURL: server.URL, CoversURL: server.URL + "/covers"}
+
+	candidates, err := provider.Search(MetadataQuery{Isbn: "9782070360024", Title: "Le Horla"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	if got := (*requests)[0].URL.Query().Get("bibkeys"); got != "ISBN:9782070360024" {
+		t.Fatalf("wrong bibkeys %q", got)
+	}
+	candidate := candidates[0]
+	if candidate.Provider != "Open Library" || candidate.Title != "Le Horla : et autres contes" || candidate.Isbn != "9782070360024" {
+		t.Fatalf("wrong candidate %+v", candidate)
+	}
+	if len(candidate.Authors) != 1 || candidate.Authors[0] != "Guy de Maupassant" || candidate.Publisher != "Gallimard" {
+		t.Fatalf("wrong authors or publisher %v %q", candidate.Authors, candidate.Publisher)
+	}
+	if candidate.PublishedAt == nil || candidate.PublishedAt.Year() != 1986 || candidate.PublishedAt.Month() != 3 {
+		t.Fatalf("wrong date %v", candidate.PublishedAt)
+	}
+	if candidate.Description != "Recueil fantastique" {
+		t.Fatalf("wrong description %q", candidate.Description)
+	}
+	// without a large cover the medium one is used
+	if candidate.CoverURL != "https://covers.openlibrary.org/b/id/1-M.jpg" {
+		t.Fatalf("wrong cover %q", candidate.CoverURL)
+	}
+	if strings.Join(candidate.Tags, ",") != "Fantastique,Nouvelles" {
+		t.Fatalf("wrong tags %v", candidate.Tags)
+	}
+
+	// an unknown ISBN give no candidate and no error
+	candidates, err = provider.Search(MetadataQuery{Isbn: "9780000000002"})
+	if err != nil || len(candidates) != 0 {
+		t.Fatalf("unknown ISBN: %v %v", candidates, err)
+	}
+}
+
+func TestOpenLibrarySearch(t *testing.T) {
+	server, requests := fixtureServer(map[string]string{"/search.json": openLibrarySearchFixture})
+	defer server.Close()
+	provider := &OpenLibraryProvider{BaseURL: server.URL, CoversURL: server.URL + "/covers"}
+
+	candidates, err := provider.Search(MetadataQuery{Title: "Le Horla", Author: "Maupassant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := (*requests)[0].URL.Query()
+	if query.Get("title") != "Le Horla" || query.Get("author") != "Maupassant" {
+		t.Fatalf("wrong query %v", query)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	candidate := candidates[0]
+	if candidate.URL != server.URL+"/works/OL2W" || candidate.Isbn != "9782070360024" || candidate.Language != "fr" {
+		t.Fatalf("wrong candidate %+v", candidate)
+	}
+	if candidate.PublishedAt == nil || candidate.PublishedAt.Year() != 1887 {
+		t.Fatalf("wrong date %v", candidate.PublishedAt)
+	}
+	if candidate.CoverURL != server.URL+"/covers/b/id/42-L.jpg" {
+		t.Fatalf("wrong cover %q", candidate.CoverURL)
+	}
+	// the subjects written twice are kept once
+	if strings.Join(candidate.Tags, ",") != "Horreur,Folie" {
+		t.Fatalf("wrong tags %v", candidate.Tags)
+	}
+}
+
+func TestGoogleBooksSearch(t *testing.T) {
+	server, requests := fixtureServer(map[string]string{"/books/v1/volumes": `{"items": [{"id": "x", "volumeInfo": {
+		"title": "Le Horla", "authors": ["Guy de Maupassant"], "publisher": "Le Livre de Poche",
+		"publishedDate": "2000-05", "description": "<p>Un homme &amp; son double.</p>", "language": "fr",
+		"categories": ["Fiction"], "infoLink": "https://books.google.com/x",
+		"industryIdentifiers": [{"type": "OTHER", "identifier": "X"}, {"type": "ISBN_10", "identifier": "2253007900"}],
+		"imageLinks": {"thumbnail": "https://books.google.com/cover?id=x&edge=curl"}}}]}`})
+	defer server.Close()
+	provider := &GoogleBooksProvider{BaseURL: server.URL}
+
+	candidates, err := provider.Search(MetadataQuery{Title: "Le Horla", Author: "Maupassant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := (*requests)[0].URL.Query().Get("q"); got != "intitle:Le Horla inauthor:Maupassant" {
+		t.Fatalf("wrong query %q", got)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	candidate := candidates[0]
+	if candidate.Provider != "Google Books" || candidate.URL != "https://books.google.com/x" || candidate.Publisher != "Le Livre de Poche" {
+		t.Fatalf("wrong candidate %+v", candidate)
+	}
+	if candidate.Isbn != "9782253007906" {
+		t.Fatalf("wrong isbn %q", candidate.Isbn)
+	}
+	if candidate.Description != "Un homme & son double." {
+		t.Fatalf("wrong description %q", candidate.Description)
+	}
+	if candidate.PublishedAt == nil || candidate.PublishedAt.Year() != 2000 || candidate.PublishedAt.Month() != 5 {
+		t.Fatalf("wrong date %v", candidate.PublishedAt)
+	}
+	if candidate.CoverURL != "https://books.google.com/cover?id=x" {
+		t.Fatalf("wrong cover %q", candidate.CoverURL)
+	}
+
+	provider.Search(MetadataQuery{Isbn: "9782253007906"})
+	if got := (*requests)[1].URL.Query().Get("q"); got != "isbn:9782253007906" {
+		t.Fatalf("wrong isbn query %q", got)
+	}
+}
+
+func TestBnfSearch(t *testing.T) {
+	server, requests := fixtureServer(map[string]string{"/api/SRU": `<?xml version="1.0"?>
+<srw:searchRetrieveResponse xmlns:srw="http://www.loc.gov/zing/srw/"><srw:records><srw:record><srw:recordData>
+<oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:identifier>https://catalogue.bnf.fr/ark:/12148/cb1</dc:identifier>
+<dc:identifier>ISBN 2-07-036002-4</dc:identifier>
+<dc:title>Le Horla / Guy de Maupassant ; préface de X</dc:title>
+<dc:creator>Maupassant, Guy de (1850-1893). Auteur du texte</dc:creator>
+<dc:publisher>Gallimard (Paris)</dc:publisher>
+<dc:date>DL 1986</dc:date>
+<dc:description>Bibliogr.</dc:description>
+<dc:language>fre</dc:language>
+<dc:subject>Fantastique -- Romans</dc:subject>
+</oai_dc:dc></srw:recordData></srw:record></srw:records></srw:searchRetrieveResponse>`})
+	defer server.Close()
+	provider := &BnfProvider{BaseURL: server.URL}
+
+	candidates, err := provider.Search(MetadataQuery{Title: `Le "Horla"`, Author: "Maupassant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := (*requests)[0].URL.Query().Get("query"); got != `bib.title all "Le  Horla " and bib.author all "Maupassant"` {
+		t.Fatalf("wrong query %q", got)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("expected 1 candidate, got %d", len(candidates))
+	}
+	candidate := candidates[0]
+	if candidate.Title != "Le Horla" || candidate.Publisher != "Gallimard" || candidate.Language != "fr" {
+		t.Fatalf("wrong candidate %+v", candidate)
+	}
+	if len(candidate.Authors) != 1 || candidate.Authors[0] != "Guy de Maupassant" {
+		t.Fatalf("wrong authors %v", candidate.Authors)
+	}
+	if candidate.URL != "https://catalogue.bnf.fr/ark:/12148/cb1" || candidate.Isbn != "9782070360024" {
+		t.Fatalf("wrong url or isbn %q %q", candidate.URL, candidate.Isbn)
+	}
+	if candidate.PublishedAt == nil || candidate.PublishedAt.Year() != 1986 {
+		t.Fatalf("wrong date %v", candidate.PublishedAt)
+	}
+	if strings.Join(candidate.Tags, ",") != "Fantastique" {
+		t.Fatalf("wrong tags %v", candidate.Tags)
+	}
+}
+
+func TestLookupMetadata(t *testing.T) {
+	// Open Library doesn't know the ISBN but find the title, Google Books is down
+	openLibrary, _ := fixtureServer(map[string]string{"/api/books": `{}`, "/search.json": openLibrarySearchFixture})
+	defer openLibrary.Close()
+	google, _ := fixtureServer(map[string]string{})
+	defer google.Close()
+	providers := []MetadataProvider{
+		&OpenLibraryProvider{BaseURL: openLibrary.URL, CoversURL: openLibrary.URL},
+		&GoogleBooksProvider{BaseURL: google.URL},
+	}
+
+	candidates, errs := lookupMetadata(providers, MetadataQuery{Isbn: "9782070360024", Title: "Le Horla", Author: "Maupassant"})
+	if len(candidates) != 1 || candidates[0].Provider != "Open Library" {
+		t.Fatalf("expected the Open Library title search, got %+v", candidates)
+	}
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "Google Books: 404") {
+		t.Fatalf("expected the Google Books error, got %v", errs)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const opds2MediaType = "application/opds+json"
+const opds2PublicationMediaType = "application/opds-publication+json"
+const jsonExt = "json"
+
+// Opds2Feed store an OPDS 2.0 feed
+type Opds2Feed struct {
+	Metadata     Opds2Metadata      `json:"metadata"`
+	Links        []Opds2Link        `json:"links"`
+	Navigation   []Opds2Link        `json:"navigation,omitempty"`
+	Facets       []Opds2Group       `json:"facets,omitempty"`
+	Publications []Opds2Publication `json:"publications,omitempty"`
+}
+
+// Opds2Group store a group of links of an OPDS 2.0 feed, like a facet
+type Opds2Group struct {
+	Metadata Opds2Metadata `json:"metadata"`
+	Links    []Opds2Link   `json:"links"`
+}
+
+// Opds2Metadata store metadata of an OPDS 2.0 feed
+type Opds2Metadata struct {
+	Title         string `json:"title"`
+	Identifier    string `json:"identifier,omitempty"`
+	Modified      string `json:"modified,omitempty"`
+	NumberOfItems int    `json:"numberOfItems,omitempty"`
+	ItemsPerPage  int    `json:"itemsPerPage,omitempty"`
+	CurrentPage   int    `json:"currentPage,omitempty"`
+}
+
+// Opds2Link store a link of an OPDS 2.0 feed or publication
+type Opds2Link struct {
+	Href       string               `json:"href"`
+	Type       string               `json:"type,omitempty"`
+	Rel        string               `json:"rel,omitempty"`
+	Title      string               `json:"title,omitempty"`
+	Templated  bool                 `json:"templated,omitempty"`
+	Width      int                  `json:"width,omitempty"`
+	Height     int                  `json:"height,omitempty"`
+	Properties *Opds2LinkProperties `json:"properties,omitempty"`
+}
+
+// Opds2LinkProperties store the properties of a link, used by facets
+type Opds2LinkProperties struct {
+	NumberOfItems int `json:"numberOfItems,omitempty"`
+}
+
+// Opds2Publication store a publication of an OPDS 2.0 feed
+type Opds2Publication struct {
+	Metadata Opds2PublicationMetadata `json:"metadata"`
+	Links    []Opds2Link              `json:"links"`
+	Images   []Opds2Link              `json:"images,omitempty"`
+}
+
+// Opds2PublicationMetadata store metadata of a publication
+type Opds2PublicationMetadata struct {
+	Type        string             `json:"@type"`
+	Identifier  string             `json:"identifier"`
+	Title       string             `json:"title"`
+	Author      []Opds2Contributor `json:"author,omitempty"`
+	Language    string             `json:"language,omitempty"`
+	Publisher   string             `json:"publisher,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Modified    string             `json:"modified,omitempty"`
+	Published   string             `json:"published,omitempty"`
+	Subject     []Opds2Subject     `json:"subject,omitempty"`
+	BelongsTo   *Opds2BelongsTo    `json:"belongsTo,omitempty"`
+}
+
+// Opds2Contributor store an author of a publication
+type Opds2Contributor struct {
+	Name  string      `json:"name"`
+	Links []Opds2Link `json:"links,omitempty"`
+}
+
+// Opds2Subject store a subject (tag) of a publication
+type Opds2Subject struct {
+	Name  string      `json:"name"`
+	Links []Opds2Link `json:"links,omitempty"`
+}
+
+// Opds2CollectionRef store a serie or a collection of a publication
+type Opds2CollectionRef struct {
+	Name     string      `json:"name"`
+	Position float32     `json:"position,omitempty"`
+	Links    []Opds2Link `json:"links,omitempty"`
+}
+
+// Opds2BelongsTo store the series and collections of a publication
+type Opds2BelongsTo struct {
+	Series     []Opds2CollectionRef `json:"series,omitempty"`
+	Collection []Opds2CollectionRef `json:"collection,omitempty"`
+}
+
+func baseOpds2(uuid string, name string, totalResult int, perPage int, page int, selfLink string, prevLink string, nextLink string, firstLink string, lastLink string, token string) *Opds2Feed {
+	feed := &Opds2Feed{}
+
+	feed.Metadata.Title = name
+	feed.Metadata.Identifier = uuid
+	feed.Metadata.Modified = time.Now().Format(time.RFC3339)
+	feed.Metadata.NumberOfItems = totalResult
+	feed.Metadata.ItemsPerPage = perPage
+	feed.Metadata.CurrentPage = page
+
+	feed.Links = append(feed.Links, Opds2Link{Rel: "self", Href: selfLink, Type: opds2MediaType})
+	feed.Links = append(feed.Links, Opds2Link{Rel: "start", Href: withToken("/index.json", token), Type: opds2MediaType})
+	searchLink := "/search.json{?query}"
+	if token != "" {
+		searchLink = withToken("/search.json", token) + "{&query}"
+	}
+	feed.Links = append(feed.Links, Opds2Link{Rel: "search", Href: searchLink, Type: opds2MediaType, Templated: true})
+
+	if firstLink != "" {
+		feed.Links = append(feed.Links, Opds2Link{Rel: "first", Href: firstLink, Type: opds2MediaType})
+	}
+	if prevLink != "" {
+		feed.Links = append(feed.Links, Opds2Link{Rel: "previous", Href: prevLink, Type: opds2MediaType})
+	}
+	if nextLink != "" {
+		feed.Links = append(feed.Links, Opds2Link{Rel: "next", Href: nextLink, Type: opds2MediaType})
+	}
+	if lastLink != "" {
+		feed.Links = append(feed.Links, Opds2Link{Rel: "last", Href: lastLink, Type: opds2MediaType})
+	}
+
+	return feed
+}
+
+func publicationOpds2(book *Book, baseURL string, token string) Opds2Publication {
+	var authors []Author
+	var tags []Tag
+	var publication Opds2Publication
+
+	bookIDStr := strconv.Itoa(int(book.ID))
+
+	publication.Metadata.Type = "http://schema.org/Book"
+	publication.Metadata.Identifier = "urn:myopds:book:" + bookIDStr
+	if book.Isbn != "" {
+		publication.Metadata.Identifier = "urn:isbn:" + book.Isbn
+	}
+	publication.Metadata.Title = book.Title
+	publication.Metadata.Language = book.Language
+	publication.Metadata.Publisher = book.Publisher
+	publication.Metadata.Description = book.Description
+	publication.Metadata.Modified = book.UpdatedAt.Format(time.RFC3339)
+	publication.Metadata.Published = book.PublishedDate()
+
+	db.Model(book).Related(&authors, "Authors")
+	for _, author := range authors {
+		publication.Metadata.Author = append(publication.Metadata.Author, Opds2Contributor{
+			Name: author.Name,
+			Links: []Opds2Link{
+				{Href: withToken(baseURL+"/index.json?author_id="+strconv.Itoa(int(author.ID)), token), Type: opds2MediaType},
+			},
+		})
+	}
+
+	db.Model(book).Related(&tags, "Tags")
+	for _, tag := range tags {
+		publication.Metadata.Subject = append(publication.Metadata.Subject, Opds2Subject{
+			Name: tag.Name,
+			Links: []Opds2Link{
+				{Href: withToken(baseURL+"/index.json?tag="+strings.Replace(tag.Name, " ", "+", -1), token), Type: opds2MediaType},
+			},
+		})
+	}
+
+	if book.Serie != "" || book.Collection != "" {
+		publication.Metadata.BelongsTo = &Opds2BelongsTo{}
+		if book.Serie != "" {
+			publication.Metadata.BelongsTo.Series = append(publication.Metadata.BelongsTo.Series, Opds2CollectionRef{
+				Name:     book.Serie,
+				Position: book.SerieNumber,
+				Links: []Opds2Link{
+					{Href: baseURL + seriesLinkOpds(book.SeriesID, jsonExt, token), Type: opds2MediaType},
+				},
+			})
+		}
+		if book.Collection != "" {
+			publication.Metadata.BelongsTo.Collection = append(publication.Metadata.BelongsTo.Collection, Opds2CollectionRef{
+				Name: book.Collection,
+			})
+		}
+	}
+
+	publication.Links = append(publication.Links, Opds2Link{
+		Rel:  "self",
+		Href: withToken(baseURL+"/books/"+bookIDStr+".json", token),
+		Type: opds2PublicationMediaType,
+	})
+	files := book.bookFiles()
+	for _, file := range files {
+		publication.Links = append(publication.Links, Opds2Link{
+			Rel:   "http://opds-spec.org/acquisition/open-access",
+			Href:  withToken(baseURL+book.FormatDownloadURL(file.Format), token),
+			Type:  file.MediaType,
+			Title: file.FormatName(),
+		})
+	}
+	if len(files) == 0 {
+		publication.Links = append(publication.Links, Opds2Link{
+			Rel:  "http://opds-spec.org/acquisition/open-access",
+			Href: withToken(baseURL+book.DownloadURL(), token),
+			Type: book.fileFormat().MediaType,
+		})
+	}
+
+	publication.Images = coverImagesOpds2(*book, baseURL, token)
+
+	return publication
+}
+
+func writeOpds2(res http.ResponseWriter, mediaType string, v interface{}) {
+	res.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+
+	encoder := json.NewEncoder(res)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
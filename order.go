@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+// BookSort describe an order of the book lists
+type BookSort struct {
+	Value string
+	Title string
+	// Desc is the default direction
+	Desc bool
+}
+
+// bookSorts list the orders understood by BookOrder, the first one is the default
+var bookSorts = []BookSort{
+	{"added", "Date d'ajout", true},
+	{"title", "Titre", false},
+	{"author", "Auteur", false},
+	{"serie", "Série", false},
+	{"publisher", "Éditeur", false},
+	{"published", "Date de publication", true},
+	{"read", "Dernière lecture", true},
+	{"size", "Taille", true},
+	{"random", "Au hasard", false},
+}
+
+// leadingArticles are ignored when sorting by title
+var leadingArticles = []string{"le ", "la ", "les ", "l'", "l’", "un ", "une ", "des ", "the ", "a ", "an ", "der ", "die ", "das ", "el ", "los ", "las "}
+
+// sortTitle return the title without its leading article, used to sort by title
+func sortTitle(title string) string {
+	lower := strings.ToLower(strings.TrimSpace(title))
+	for _, article := range leadingArticles {
+		if strings.HasPrefix(lower, article) && len(lower) > len(article) {
+			return strings.TrimSpace(lower[len(article):])
+		}
+	}
+	return lower
+}
+
+// setupTitleSort fill the sort title of books imported before it existed
+func setupTitleSort() {
+	var books []Book
+
+	db.Where("title_sort IS NULL OR title_sort = ''").Find(&books)
+	for _, book := range books {
+		db.Model(&book).UpdateColumn("title_sort", sortTitle(book.Title))
+	}
+}
+
+// findBookSort return the order with this name, "new" and "old" are the former names of the date added order
+func findBookSort(order string, dir string) (BookSort, bool) {
+	sort := bookSorts[0]
+	desc := sort.Desc
+
+	alias := order
+	if order == "new" || order == "old" {
+		order = "added"
+	}
+	for _, candidate := range bookSorts {
+		if candidate.Value == order {
+			sort = candidate
+			desc = candidate.Desc
+		}
+	}
+	// the old names carry their direction
+	if alias == "old" {
+		desc = false
+	}
+	if dir == "asc" {
+		desc = false
+	} else if dir == "desc" {
+		desc = true
+	}
+	return sort, desc
+}
+
+// randomSeed return the seed of the random order, it change every day so pages stay stable
+func randomSeed() int64 {
+	return time.Now().Unix() / 86400 % 1000003
+}
+
+// SortBlock is the sort form of the book lists
+type SortBlock struct {
+	Order  string
+	Desc   bool
+	Sorts  []BookSort
+	Hidden map[string]string
+}
+
+// sortBlock return the sort form for the current query, other filters are kept as hidden fields
+func sortBlock(query url.Values) SortBlock {
+	sort, desc := findBookSort(query.Get("order"), query.Get("dir"))
+	block := SortBlock{Order: sort.Value, Desc: desc, Sorts: bookSorts, Hidden: map[string]string{}}
+	for key := range without(query, "order", "dir", "page") {
+		block.Hidden[key] = query.Get(key)
+	}
+	return block
+}
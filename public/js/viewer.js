@@ -0,0 +1,152 @@
+// Web reader of myopds, display the spine of a Readium Web Publication manifest
+// in an iframe and save the reading position on the server.
+(function () {
+  var body = document.body;
+  var manifestURL = new URL(body.dataset.manifest, window.location.href);
+  var frame = document.querySelector("main iframe");
+  var toc = document.getElementById("toc");
+  var spine = [];
+  var current = 0;
+  var saveTimer = null;
+
+  // position is "spine index:scroll fraction"
+  function parsePosition(position) {
+    var parts = (position || "").split(":");
+    var index = parseInt(parts[0], 10);
+    var fraction = parseFloat(parts[1]);
+    return {
+      index: isNaN(index) ? 0 : index,
+      fraction: isNaN(fraction) ? 0 : fraction
+    };
+  }
+
+  function scrollFraction() {
+    var doc = frame.contentDocument;
+    if (!doc || !doc.documentElement) {
+      return 0;
+    }
+    var max = doc.documentElement.scrollHeight - frame.clientHeight;
+    if (max <= 0) {
+      return 1;
+    }
+    return Math.min(1, Math.max(0, frame.contentWindow.scrollY / max));
+  }
+
+  function save() {
+    if (spine.length === 0) {
+      return;
+    }
+    var fraction = scrollFraction();
+    var data = new URLSearchParams();
+    data.set("position", current + ":" + fraction.toFixed(4));
+    data.set("progress", ((current + fraction) / spine.length).toFixed(4));
+    fetch(body.dataset.progress, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: { "X-CSRF-Token": body.dataset.csrf },
+      body: data
+    });
+  }
+
+  function scheduleSave() {
+    clearTimeout(saveTimer);
+    saveTimer = setTimeout(save, 1500);
+  }
+
+  function show(index, fraction) {
+    if (index < 0 || index >= spine.length) {
+      return;
+    }
+    current = index;
+    frame.onload = function () {
+      var doc = frame.contentDocument;
+      if (fraction && doc && doc.documentElement) {
+        var max = doc.documentElement.scrollHeight - frame.clientHeight;
+        frame.contentWindow.scrollTo(0, max * fraction);
+      }
+      frame.contentWindow.addEventListener("scroll", scheduleSave);
+      frame.contentWindow.addEventListener("keydown", keys);
+      selectToc();
+      scheduleSave();
+    };
+    frame.src = spine[index];
+  }
+
+  function selectToc() {
+    for (var i = 0; i < toc.options.length; i++) {
+      if (toc.options[i].dataset.index === String(current)) {
+        toc.selectedIndex = i;
+        return;
+      }
+    }
+  }
+
+  function spineIndex(href) {
+    var path = href.split("#")[0];
+    for (var i = 0; i < spine.length; i++) {
+      if (spine[i] === path) {
+        return i;
+      }
+    }
+    return -1;
+  }
+
+  function addToc(links, depth) {
+    (links || []).forEach(function (link) {
+      var href = new URL(link.href, manifestURL).href;
+      var option = document.createElement("option");
+      option.value = href;
+      option.dataset.index = spineIndex(href);
+      option.textContent = new Array(depth + 1).join("  ") + (link.title || link.href);
+      toc.appendChild(option);
+      addToc(link.children, depth + 1);
+    });
+  }
+
+  function keys(event) {
+    if (event.key === "ArrowRight") {
+      show(current + 1, 0);
+    } else if (event.key === "ArrowLeft") {
+      show(current - 1, 0);
+    }
+  }
+
+  document.querySelector("a[rel=start]").addEventListener("click", function (event) {
+    event.preventDefault();
+    show(0, 0);
+  });
+  document.querySelector("a[rel=prev]").addEventListener("click", function (event) {
+    event.preventDefault();
+    show(current - 1, 0);
+  });
+  document.querySelector("a[rel=next]").addEventListener("click", function (event) {
+    event.preventDefault();
+    show(current + 1, 0);
+  });
+  toc.addEventListener("change", function () {
+    var href = toc.value;
+    var index = spineIndex(href);
+    if (index >= 0) {
+      current = index;
+      frame.src = href;
+    }
+  });
+  document.addEventListener("keydown", keys);
+  window.addEventListener("beforeunload", save);
+
+  fetch(manifestURL.href, { credentials: "same-origin" })
+    .then(function (response) {
+      return response.json();
+    })
+    .then(function (manifest) {
+      spine = (manifest.spine || manifest.readingOrder || []).map(function (link) {
+        return new URL(link.href, manifestURL).href;
+      });
+      addToc(manifest.toc, 0);
+      if (toc.options.length === 0) {
+        toc.style.display = "none";
+      }
+      var position = parsePosition(body.dataset.position);
+      show(Math.min(position.index, spine.length - 1), position.fraction);
+    });
+})();
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/markbates/pkger"
+	"github.com/readium/r2-streamer-go/fetcher"
+	"github.com/readium/r2-streamer-go/models"
+	"github.com/readium/r2-streamer-go/parser"
+)
+
+const webpubMediaType = "application/webpub+json"
+
+// readerDevice is the device name of the progress saved by the web reader
+const readerDevice = "Navigateur"
+
+// readerCacheSize is the number of publications kept open for the web reader
+const readerCacheSize = 8
+
+// readerEntry is a parsed EPUB kept open while it is read
+type readerEntry struct {
+	publication models.Publication
+	path        string
+	checksum    string
+	used        time.Time
+	// users is the number of requests reading the publication, an evicted publication is closed when it reach 0
+	users   int
+	evicted bool
+}
+
+var errNotReadable = errors.New("book without epub file")
+
+var readerCache = map[uint]*readerEntry{}
+var readerMutex sync.Mutex
+
+// Readable return true when the book can be opened in the web reader
+func (book Book) Readable() bool {
+	for _, file := range book.Files {
+		if file.Format == "epub" {
+			return true
+		}
+	}
+	return false
+}
+
+// closePublication close the EPUB archive opened by the parser
+func closePublication(publication models.Publication) {
+	for _, data := range publication.Internal {
+		if reader, ok := data.Value.(*zip.ReadCloser); ok {
+			reader.Close()
+		}
+	}
+}
+
+// readerPublication return the parsed EPUB of the book, it must be given back with releasePublication
+func readerPublication(bookID uint) (*readerEntry, error) {
+	var bookFile BookFile
+
+	db.Where("book_id = ? AND format = ?", bookID, "epub").First(&bookFile)
+	if bookFile.ID == 0 {
+		return nil, errNotReadable
+	}
+
+	readerMutex.Lock()
+	defer readerMutex.Unlock()
+
+	entry, found := readerCache[bookID]
+	if found && entry.path == bookFile.Path && entry.checksum == bookFile.Checksum {
+		entry.used = time.Now()
+		entry.users++
+		return entry, nil
+	}
+	if found {
+		// the file was replaced
+		evictPublication(bookID)
+	}
+
+	publication, err := parser.Parse(bookFile.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(readerCache) >= readerCacheSize {
+		var oldest uint
+		for id, cached := range readerCache {
+			if oldest == 0 || cached.used.Before(readerCache[oldest].used) {
+				oldest = id
+			}
+		}
+		evictPublication(oldest)
+	}
+	entry = &readerEntry{publication: publication, path: bookFile.Path, checksum: bookFile.Checksum, used: time.Now(), users: 1}
+	readerCache[bookID] = entry
+	return entry, nil
+}
+
+// evictPublication remove the publication from the cache, it is closed once no request read it
+func evictPublication(bookID uint) {
+	entry := readerCache[bookID]
+	delete(readerCache, bookID)
+	entry.evicted = true
+	if entry.users == 0 {
+		closePublication(entry.publication)
+	}
+}
+
+// releasePublication give back a publication returned by readerPublication
+func releasePublication(entry *readerEntry) {
+	readerMutex.Lock()
+	defer readerMutex.Unlock()
+
+	entry.users--
+	if entry.evicted && entry.users == 0 {
+		closePublication(entry.publication)
+	}
+}
+
+// readerURL return the base url of the web reader of the book
+func readerURL(bookID uint) string {
+	return "/books/" + strconv.Itoa(int(bookID)) + "/read"
+}
+
+func readBookHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+
+	vars := mux.Vars(req)
+	bookID, _ := strconv.Atoi(vars["id"])
+	db.Preload("Files").Find(&book, bookID)
+	if book.ID == 0 || !book.Readable() {
+		http.NotFound(res, req)
+		return
+	}
+	state := userBook(currentUser(req).ID, book.ID)
+	// the position saved by KOReader is not understood by the web reader
+	position := ""
+	if state.Device == readerDevice {
+		position = state.Position
+	}
+
+	viewerTemplate := template.New("viewer").Funcs(csrfFuncs(req))
+	templateFile, _ := pkger.Open("/template/viewer_index.html")
+	templateData, _ := ioutil.ReadAll(templateFile)
+	viewerTemplate = template.Must(viewerTemplate.Parse(string(templateData)))
+	err := viewerTemplate.Execute(res, struct {
+		Book      Book
+		ReaderURL string
+		Position  string
+	}{book, readerURL(book.ID), position})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// readerManifestHandler serve the Readium Web Publication manifest of the EPUB, resources are relative to it
+func readerManifestHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	bookID, _ := strconv.Atoi(vars["id"])
+	entry, err := readerPublication(uint(bookID))
+	if err != nil {
+		http.NotFound(res, req)
+		return
+	}
+	defer releasePublication(entry)
+	publication := entry.publication
+
+	manifest := publication
+	manifest.Links = append([]models.Link{{
+		Href:     RootURL(req) + readerURL(uint(bookID)) + "/manifest.json",
+		TypeLink: webpubMediaType,
+		Rel:      []string{"self"},
+	}}, publication.Links...)
+	j, _ := json.Marshal(manifest)
+	res.Header().Set("Content-Type", webpubMediaType+"; charset=utf-8")
+	res.Write(j)
+}
+
+// readerWebManifestHandler serve the web app manifest of the reader, so it can be installed on a tablet
+func readerWebManifestHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+
+	vars := mux.Vars(req)
+	db.Find(&book, vars["id"])
+	if book.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+	j, _ := json.Marshal(map[string]interface{}{
+		"name":       book.Title,
+		"short_name": book.Title,
+		"start_url":  readerURL(book.ID),
+		"display":    "standalone",
+		"icons":      []map[string]string{{"src": book.CoverDownloadURL(), "type": book.CoverType}},
+	})
+	res.Header().Set("Content-Type", "application/manifest+json")
+	res.Write(j)
+}
+
+// readerAssetHandler serve a resource of the EPUB
+func readerAssetHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	bookID, _ := strconv.Atoi(vars["id"])
+	entry, err := readerPublication(uint(bookID))
+	if err != nil {
+		http.NotFound(res, req)
+		return
+	}
+	defer releasePublication(entry)
+
+	asset, mediaType, err := fetcher.Fetch(&entry.publication, vars["asset"])
+	if err != nil {
+		http.NotFound(res, req)
+		return
+	}
+	if mediaType != "" {
+		res.Header().Set("Content-Type", mediaType)
+	}
+	res.Header().Set("Cache-Control", "private,max-age=86400")
+	http.ServeContent(res, req, vars["asset"], time.Time{}, asset)
+}
+
+// readerProgressHandler save the position of the web reader, the progress is between 0 and 1
+func readerProgressHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+
+	vars := mux.Vars(req)
+	db.Find(&book, vars["id"])
+	if book.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+	progress, err := strconv.ParseFloat(req.FormValue("progress"), 32)
+	if err != nil || progress < 0 || progress > 1 {
+		http.Error(res, "Invalid progress", http.StatusBadRequest)
+		return
+	}
+
+	updateReadingProgress(currentUser(req).ID, book.ID, float32(progress), req.FormValue("position"), readerDevice)
+	res.WriteHeader(http.StatusNoContent)
+}
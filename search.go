@@ -1,13 +1,238 @@
 package main
 
-import "strings"
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
 
-func findBookBySearch(search string) []Book {
+	"github.com/jinzhu/gorm"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+const sqliteDriver = "sqlite3_myopds"
+
+// searchColumns list the columns of the search index, the order is used by bm25 weights
+var searchColumns = []string{"title", "authors", "tags", "serie", "publisher", "description"}
+
+// searchQualifiers map the field qualifiers accepted in a query to the index columns
+var searchQualifiers = map[string]string{
+	"title":     "title",
+	"titre":     "title",
+	"author":    "authors",
+	"auteur":    "authors",
+	"tag":       "tags",
+	"serie":     "serie",
+	"series":    "serie",
+	"publisher": "publisher",
+	"editeur":   "publisher",
+}
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("bm25", bm25, true)
+		},
+	})
+}
+
+// setupSearchIndex create the full text index and fill it when it's empty
+func setupSearchIndex() {
+	var indexCount int
+	var bookCount int
 	var books []Book
 
-	search = strings.TrimLeft(search, " ")
-	search = strings.Replace(search, "''", " ", -1)
-	search = "%" + strings.Replace(search, " ", "%", -1) + "%"
-	db.Joins("left join book_authors on books.id = book_authors.book_id left join authors on book_authors.author_id = authors.id").Where("title LIKE ? OR description like ? OR authors.name LIKE ?", search, search, search).Find(&books)
-	return books
+	db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS book_search USING fts4(" + strings.Join(searchColumns, ", ") + ", tokenize=unicode61)")
+
+	db.Raw("SELECT count(*) FROM book_search").Row().Scan(&indexCount)
+	db.Model(&Book{}).Count(&bookCount)
+	if indexCount == 0 && bookCount > 0 {
+		fmt.Println("build search index")
+		db.Find(&books)
+		for _, book := range books {
+			indexBook(db, &book)
+		}
+	}
+}
+
+// indexBook store the book in the full text index
+func indexBook(tx *gorm.DB, book *Book) error {
+	var authors []Author
+	var tags []Tag
+	var authorsName []string
+	var tagsName []string
+
+	if book.ID == 0 {
+		return nil
+	}
+
+	tx.Model(book).Related(&authors, "Authors")
+	for _, author := range authors {
+		var aliases []AuthorAlias
+		authorsName = append(authorsName, author.Name)
+		// a search by another name of the author find the book too
+		tx.Where("author_id = ?", author.ID).Find(&aliases)
+		for _, alias := range aliases {
+			authorsName = append(authorsName, alias.Name)
+		}
+	}
+	tx.Model(book).Related(&tags, "Tags")
+	for _, tag := range tags {
+		tagsName = append(tagsName, tag.Name)
+	}
+
+	unindexBook(tx, book.ID)
+	return tx.Exec("INSERT INTO book_search(docid, title, authors, tags, serie, publisher, description) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		book.ID, book.Title, strings.Join(authorsName, " "), strings.Join(tagsName, " "), book.Serie, book.Publisher, book.Description).Error
+}
+
+// unindexBook remove the book from the full text index
+func unindexBook(tx *gorm.DB, bookID uint) error {
+	return tx.Exec("DELETE FROM book_search WHERE docid = ?", bookID).Error
+}
+
+// AfterSave callback to keep the search index in sync
+func (book *Book) AfterSave(tx *gorm.DB) error {
+	return indexBook(tx, book)
+}
+
+// AfterDelete callback to remove the book from the search index
+func (book *Book) AfterDelete(tx *gorm.DB) error {
+	return unindexBook(tx, book.ID)
+}
+
+// searchMatch convert a user query into a fts MATCH expression.
+// Words are prefix matched, "quoted text" is matched as a phrase and
+// author:, tag:, serie:, title: and publisher: restrict the next word or phrase to a field.
+func searchMatch(search string) string {
+	var terms []string
+
+	for _, token := range splitSearch(search) {
+		column := ""
+		if i := strings.Index(token, ":"); i > 0 {
+			if c, ok := searchQualifiers[strings.ToLower(token[:i])]; ok {
+				column = c + ":"
+				token = token[i+1:]
+			}
+		}
+
+		words := strings.FieldsFunc(strings.ToLower(token), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		if len(words) == 0 {
+			continue
+		}
+
+		if len(words) > 1 && strings.HasPrefix(token, "\"") {
+			terms = append(terms, column+"\""+strings.Join(words, " ")+"*\"")
+			continue
+		}
+		for _, word := range words {
+			terms = append(terms, column+word+"*")
+		}
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// splitSearch split the query on spaces keeping "quoted text" together
+func splitSearch(search string) []string {
+	var tokens []string
+	var current []rune
+	inQuote := false
+
+	for _, r := range search {
+		if r == '"' {
+			inQuote = !inQuote
+		}
+		if unicode.IsSpace(r) && !inQuote {
+			if len(current) > 0 {
+				tokens = append(tokens, string(current))
+			}
+			current = nil
+			continue
+		}
+		current = append(current, r)
+	}
+	if len(current) > 0 {
+		tokens = append(tokens, string(current))
+	}
+
+	return tokens
+}
+
+// searchBooks return the books matching the query ordered by relevance and the total number of results
+func searchBooks(search string, limit int, offset int) ([]Book, int) {
+	var books []Book
+	var count int
+
+	match := searchMatch(search)
+	if match == "" {
+		return books, 0
+	}
+
+	db.Raw("SELECT count(*) FROM book_search INNER JOIN books ON books.id = book_search.docid WHERE books.deleted_at IS NULL AND book_search MATCH ?", match).Row().Scan(&count)
+
+	db.Raw(`SELECT books.* FROM books
+		INNER JOIN (SELECT docid, bm25(matchinfo(book_search, 'pcnalx'), 10.0, 6.0, 4.0, 4.0, 2.0, 1.0) AS score FROM book_search WHERE book_search MATCH ?) AS results ON results.docid = books.id
+		WHERE books.deleted_at IS NULL
+		ORDER BY results.score DESC, books.id DESC
+		LIMIT ? OFFSET ?`, match, limit, offset).Scan(&books)
+
+	return books, count
+}
+
+// bm25 compute the relevance of a row from the fts matchinfo 'pcnalx' blob with a weight per column
+func bm25(matchinfo []byte, weights ...float64) float64 {
+	const k1 = 1.2
+	const b = 0.75
+	var score float64
+
+	info := make([]uint32, len(matchinfo)/4)
+	for i := range info {
+		info[i] = binary.LittleEndian.Uint32(matchinfo[i*4:])
+	}
+	if len(info) < 3 {
+		return 0
+	}
+
+	phraseCount := int(info[0])
+	columnCount := int(info[1])
+	totalDocs := float64(info[2])
+	avgLengthOffset := 3
+	lengthOffset := avgLengthOffset + columnCount
+	hitsOffset := lengthOffset + columnCount
+	if len(info) < hitsOffset+3*phraseCount*columnCount {
+		return 0
+	}
+
+	for p := 0; p < phraseCount; p++ {
+		for c := 0; c < columnCount; c++ {
+			weight := 1.0
+			if c < len(weights) {
+				weight = weights[c]
+			}
+			hits := float64(info[hitsOffset+3*(c+p*columnCount)])
+			docsWithHits := float64(info[hitsOffset+3*(c+p*columnCount)+2])
+			if hits == 0 || weight == 0 {
+				continue
+			}
+			avgLength := float64(info[avgLengthOffset+c])
+			length := float64(info[lengthOffset+c])
+			ratio := 1.0
+			if avgLength > 0 {
+				ratio = length / avgLength
+			}
+
+			idf := math.Log((totalDocs - docsWithHits + 0.5) / (docsWithHits + 0.5))
+			if idf <= 0 {
+				idf = 1e-6
+			}
+			score += weight * idf * (hits * (k1 + 1)) / (hits + k1*(1-b+b*ratio))
+		}
+	}
+
+	return score
 }
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/beevik/etree"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+)
+
+// Series store a series of books, books keep the name in Serie and their position in SerieNumber
+type Series struct {
+	gorm.Model
+	Name        string `gorm:"unique_index"`
+	Description string
+}
+
+// SeriesCount is a series with the number of its books and the missing volumes
+type SeriesCount struct {
+	Series
+	Count   int
+	Missing []int `gorm:"-"`
+}
+
+// seriesMutex avoid two import jobs creating the same series
+var seriesMutex sync.Mutex
+
+// findOrCreateSeries return the series with this name
+func findOrCreateSeries(name string) Series {
+	var series Series
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return series
+	}
+
+	seriesMutex.Lock()
+	defer seriesMutex.Unlock()
+
+	// the name is unique, a series deleted before is used again
+	db.Unscoped().Where("name = ?", name).First(&series)
+	if series.ID == 0 {
+		series.Name = name
+		db.Save(&series)
+	} else if series.DeletedAt != nil {
+		series.DeletedAt = nil
+		db.Unscoped().Model(&series).UpdateColumn("deleted_at", nil)
+	}
+	return series
+}
+
+// linkSeries set the series of the book from its Serie name, it must be called before saving the book
+func (book *Book) linkSeries() {
+	book.Serie = strings.TrimSpace(book.Serie)
+	book.SeriesID = findOrCreateSeries(book.Serie).ID
+}
+
+// setupSeries create the series of books imported before they existed
+func setupSeries() {
+	var names []string
+
+	db.Model(&Book{}).Where("serie <> '' AND (series_id IS NULL OR series_id = 0)").Pluck("DISTINCT serie", &names)
+	for _, name := range names {
+		series := findOrCreateSeries(name)
+		db.Model(&Book{}).Where("serie = ?", name).UpdateColumn("series_id", series.ID)
+	}
+}
+
+// missingVolumes return the whole positions lower than the last one without a book
+func missingVolumes(numbers []float32) []int {
+	var missing []int
+	var last int
+
+	present := map[int]bool{}
+	for _, number := range numbers {
+		position := int(math.Floor(float64(number)))
+		present[position] = true
+		if position > last {
+			last = position
+		}
+	}
+	for position := 1; position < last; position++ {
+		if !present[position] {
+			missing = append(missing, position)
+		}
+	}
+	return missing
+}
+
+// seriesWithCount return series ordered by name with the number of their books and the missing volumes
+func seriesWithCount(limit int, offset int) ([]SeriesCount, int) {
+	var series []SeriesCount
+	var count int
+
+	db.Model(&Series{}).Where("id IN (SELECT series_id FROM books WHERE deleted_at IS NULL)").Count(&count)
+
+	query := db.Table("series").
+		Select("series.*, count(books.id) AS count").
+		Joins("INNER JOIN books ON books.series_id = series.id AND books.deleted_at IS NULL").
+		Where("series.deleted_at IS NULL").
+		Group("series.id").
+		Order("series.name COLLATE NOCASE asc")
+	if limit > 0 {
+		query = query.Limit(limit).Offset(offset)
+	}
+	query.Scan(&series)
+
+	// positions of every book in one query
+	numbers := map[uint][]float32{}
+	rows, err := db.Table("books").Select("series_id, serie_number").Where("series_id > 0 AND deleted_at IS NULL").Rows()
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var seriesID uint
+			var number float32
+			rows.Scan(&seriesID, &number)
+			numbers[seriesID] = append(numbers[seriesID], number)
+		}
+	}
+	for i := range series {
+		series[i].Missing = missingVolumes(numbers[series[i].ID])
+	}
+	return series, count
+}
+
+// nextUnreadInSeries return the first book after this one in its series not read by the user
+func (book *Book) nextUnreadInSeries(userID uint) Book {
+	var next Book
+
+	if book.SeriesID == 0 {
+		return next
+	}
+	db.Where("series_id = ? AND serie_number > ? AND id <> ?", book.SeriesID, book.SerieNumber, book.ID).
+		Where("books.id NOT IN (SELECT book_id FROM user_books WHERE user_id = ? AND read = 1 AND deleted_at IS NULL)", userID).
+		Order("serie_number asc").First(&next)
+	return next
+}
+
+// SeriesURL return the page of the series of the book
+func (book Book) SeriesURL() string {
+	if book.SeriesID == 0 {
+		return ""
+	}
+	return "/series/" + strconv.Itoa(int(book.SeriesID)) + ".html"
+}
+
+// catalogEntry return the entry of the series in the series navigation feed
+func (series SeriesCount) catalogEntry() CatalogEntry {
+	content := strconv.Itoa(series.Count) + " livres"
+	if len(series.Missing) > 0 {
+		content += ", " + strconv.Itoa(len(series.Missing)) + " tomes manquants"
+	}
+	return CatalogEntry{
+		ID:      "urn:myopds:series:" + strconv.Itoa(int(series.ID)),
+		Title:   series.Name,
+		Content: content,
+		Path:    "/series/" + strconv.Itoa(int(series.ID)),
+		Kind:    "acquisition",
+		Rel:     "subsection",
+		Count:   series.Count,
+	}
+}
+
+// seriesLinkOpds return the link to the feed of the series
+func seriesLinkOpds(seriesID uint, ext string, token string) string {
+	return withToken("/series/"+strconv.Itoa(int(seriesID))+"."+ext, token)
+}
+
+func seriesListHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+	var pageInt = 1
+
+	db.First(&serverOption)
+	vars := mux.Vars(req)
+	token := req.URL.Query().Get("token")
+
+	if page := req.URL.Query().Get("page"); page != "" {
+		pageInt, _ = strconv.Atoi(page)
+		if pageInt < 1 {
+			pageInt = 1
+		}
+	}
+	limit := serverOption.NumberBookPerPage
+	offset := limit * (pageInt - 1)
+
+	if vars["format"] == atomExt {
+		series, count := seriesWithCount(limit, offset)
+		_, prevLink, nextLink, _ := paginationLinks(req.URL, pageInt, limit, count)
+
+		res.Header().Set("Content-Type", opdsNavigationType)
+		baseDoc := etree.NewDocument()
+		baseDoc.Indent(2)
+		feed := baseOpds(baseDoc, serverOption.UUID+":series", "Séries", count, limit, offset+1, RootURL(req), req.URL.String(), "/index.atom", prevLink, nextLink, opdsNavigationType, token)
+		for _, serie := range series {
+			navigationEntryOpds(feed, serie.catalogEntry(), RootURL(req), token)
+		}
+		xmlString, _ := baseDoc.WriteToString()
+		fmt.Fprintf(res, xmlString)
+	} else if vars["format"] == jsonExt {
+		series, count := seriesWithCount(limit, offset)
+		firstLink, prevLink, nextLink, lastLink := paginationLinks(req.URL, pageInt, limit, count)
+
+		feed := baseOpds2(serverOption.UUID+":series", "Séries", count, limit, pageInt, RootURL(req)+req.URL.String(), prevLink, nextLink, firstLink, lastLink, token)
+		for _, serie := range series {
+			feed.Navigation = append(feed.Navigation, navigationLinkOpds2(serie.catalogEntry(), RootURL(req), token))
+		}
+		writeOpds2(res, opds2MediaType, feed)
+	} else {
+		series, _ := seriesWithCount(0, 0)
+
+		seriesTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+		templateFile, _ := pkger.Open("/template/series_list.html")
+		templateData, _ := ioutil.ReadAll(templateFile)
+		seriesTemplate = template.Must(seriesTemplate.Parse(string(templateData)))
+		seriesTemplate.Execute(res, Page{Content: series, Title: serverOption.Name})
+	}
+}
+
+func seriesHandler(res http.ResponseWriter, req *http.Request) {
+	var series Series
+	var books []Book
+	var serverOption ServerOption
+	var pageInt = 1
+
+	db.First(&serverOption)
+	vars := mux.Vars(req)
+	token := req.URL.Query().Get("token")
+	seriesID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.First(&series, seriesID)
+	if series.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+
+	if page := req.URL.Query().Get("page"); page != "" {
+		pageInt, _ = strconv.Atoi(page)
+		if pageInt < 1 {
+			pageInt = 1
+		}
+	}
+	limit := serverOption.NumberBookPerPage
+	offset := limit * (pageInt - 1)
+
+	var count int
+	db.Model(&Book{}).Where("series_id = ?", series.ID).Count(&count)
+	query := db.Where("series_id = ?", series.ID).Order("serie_number asc, title asc")
+	if vars["format"] != "html" {
+		query = query.Limit(limit).Offset(offset)
+	}
+	query.Preload("Authors").Find(&books)
+	firstLink, prevLink, nextLink, lastLink := paginationLinks(req.URL, pageInt, limit, count)
+
+	if vars["format"] == atomExt {
+		res.Header().Set("Content-Type", opdsAcquisitionType)
+		baseDoc := etree.NewDocument()
+		baseDoc.Indent(2)
+		feed := baseOpds(baseDoc, "urn:myopds:series:"+strconv.Itoa(int(series.ID)), series.Name, count, limit, offset+1, RootURL(req), req.URL.String(), "/series.atom", prevLink, nextLink, opdsAcquisitionType, token)
+		for _, book := range books {
+			entryOpds(&book, feed, RootURL(req), token)
+		}
+		xmlString, _ := baseDoc.WriteToString()
+		fmt.Fprintf(res, xmlString)
+	} else if vars["format"] == jsonExt {
+		feed := baseOpds2("urn:myopds:series:"+strconv.Itoa(int(series.ID)), series.Name, count, limit, pageInt, RootURL(req)+req.URL.String(), prevLink, nextLink, firstLink, lastLink, token)
+		feed.Publications = []Opds2Publication{}
+		for _, book := range books {
+			feed.Publications = append(feed.Publications, publicationOpds2(&book, RootURL(req), token))
+		}
+		writeOpds2(res, opds2MediaType, feed)
+	} else {
+		var numbers []float32
+		user := currentUser(req)
+		for i := range books {
+			books[i].loadUserState(user.ID)
+			numbers = append(numbers, books[i].SerieNumber)
+		}
+
+		seriesTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+		templateFile, _ := pkger.Open("/template/series.html")
+		templateData, _ := ioutil.ReadAll(templateFile)
+		seriesTemplate = template.Must(seriesTemplate.Parse(string(templateData)))
+		seriesTemplate.Execute(res, Page{Content: struct {
+			Series  Series
+			Books   []Book
+			Missing []int
+		}{series, books, missingVolumes(numbers)}, Title: serverOption.Name})
+	}
+}
+
+// seriesEditHandler rename the series and renumber its books, renaming to an existing series merge them
+func seriesEditHandler(res http.ResponseWriter, req *http.Request) {
+	var series Series
+
+	vars := mux.Vars(req)
+	seriesID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.First(&series, seriesID)
+	if series.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+
+	req.ParseForm()
+	bookIDs := req.Form["books"]
+	numbers := req.Form["numbers"]
+	sequence := req.FormValue("sequence") != ""
+
+	tx := db.Begin()
+	for i, value := range bookIDs {
+		var number float64
+		bookID, _ := strconv.ParseInt(value, 10, 64)
+		if sequence {
+			// the books are sent in the order of the page
+			number = float64(i + 1)
+		} else if i < len(numbers) {
+			var err error
+			number, err = strconv.ParseFloat(strings.Replace(numbers[i], ",", ".", 1), 32)
+			if err != nil {
+				continue
+			}
+		} else {
+			continue
+		}
+		tx.Model(&Book{}).Where("id = ? AND series_id = ?", bookID, series.ID).UpdateColumn("serie_number", float32(number))
+	}
+
+	merged := false
+	name := strings.TrimSpace(req.FormValue("name"))
+	if name != "" && name != series.Name {
+		var existing Series
+		tx.Where("name = ? AND id <> ?", name, series.ID).First(&existing)
+		if existing.ID == 0 {
+			series.Name = name
+			tx.Save(&series)
+		} else {
+			tx.Unscoped().Delete(&series)
+			series = existing
+			merged = true
+		}
+		tx.Model(&Book{}).Where("series_id = ?", seriesID).UpdateColumns(map[string]interface{}{"series_id": series.ID, "serie": series.Name})
+	}
+	// the description of the series merged into is kept, unless it has none
+	if !merged || series.Description == "" {
+		series.Description = req.FormValue("description")
+		tx.Model(&series).UpdateColumn("description", series.Description)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the series name is part of the search index
+	var books []Book
+	db.Where("series_id = ?", series.ID).Find(&books)
+	for _, book := range books {
+		indexBook(db, &book)
+	}
+
+	http.Redirect(res, req, "/series/"+strconv.Itoa(int(series.ID))+".html", http.StatusFound)
+}
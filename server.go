@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,11 +11,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"sort"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
@@ -38,11 +42,26 @@ type ServerOption struct {
 	UUID              string
 	Password          string
 	Token             string
+	SessionSecret     string
 	Name              string
 	BaseURL           string
 	LastSync          time.Time `sql:"DEFAULT:current_timestamp"`
 	Port              int       `sql:"DEFAULT:3000"`
 	NumberBookPerPage int       `sql:"DEFAULT:50"`
+	JobWorkers        int       `sql:"DEFAULT:2"`
+	InboxDir          string
+	DuplicatePolicy   string
+	// ReadThreshold is the percentage of progress marking a book read, 0 disable it
+	ReadThreshold int `sql:"DEFAULT:95"`
+	SMTPHost      string
+	SMTPPort      int `sql:"DEFAULT:587"`
+	SMTPUser      string
+	SMTPPassword  string
+	SMTPFrom      string
+	// EmbedMetadata write the metadata of the database in the downloaded EPUB files
+	EmbedMetadata bool
+	// TagSeparator split the tag names in sub tags, empty for flat tags
+	TagSeparator string `sql:"DEFAULT:'/'"`
 }
 
 // Service store sync information
@@ -64,6 +83,7 @@ type Page struct {
 	FirstPage   string
 	LastPage    string
 	FilterBlock bool
+	Sort        SortBlock
 }
 
 var db *gorm.DB
@@ -73,21 +93,36 @@ var options ServerOption
 var importDir = kingpin.Flag("import", "Import directory path").Short('i').String()
 var serverMode = kingpin.Flag("server", "Server mode").Short('s').Bool()
 var metaMode = kingpin.Flag("meta", "Regen all metada").Short('m').Bool()
+var inboxDir = kingpin.Flag("inbox", "Watch this directory and import new files in server mode").String()
+var duplicatesFlag = kingpin.Flag("duplicates", "What to do with imported files already in the library: skip, merge or import").Enum(duplicateSkip, duplicateMerge, duplicateImport)
+var attachID = kingpin.Flag("attach", "Attach imported files as extra formats of this book id").Uint()
 
-//create another main() to run the overseer process
-//and then convert your old main() into a 'prog(state)'
+// create another main() to run the overseer process
+// and then convert your old main() into a 'prog(state)'
 func main() {
 	var serverOption ServerOption
 	var books []Book
 	var err error
 	var version = "0.1"
 
-	db, err = gorm.Open("sqlite3", "db/myopds.db")
+	sqlDB, err := sql.Open(sqliteDriver, "db/myopds.db")
+	if err != nil {
+		panic(err)
+	}
+	db, err = gorm.Open("sqlite3", sqlDB)
 	if err != nil {
 		panic(err)
 	}
 
-	db.AutoMigrate(&ServerOption{}, &Service{}, &Book{}, &Author{}, &Tag{}, &ServerOption{})
+	db.AutoMigrate(&ServerOption{}, &Service{}, &Book{}, &Author{}, &Tag{}, &ServerOption{}, &BookFile{}, &User{}, &UserBook{}, &ClientToken{}, &Job{}, &DuplicateIgnore{}, &AuthorAlias{}, &Series{}, &SyncProgress{}, &Device{}, &TagAlias{}, &Shelf{}, &ShelfBook{})
+	setupSearchIndex()
+	migrateBookFiles()
+	setupDuplicateKeys()
+	setupAuthors()
+	setupSeries()
+	setupTags()
+	setupTitleSort()
+	setupDocumentHashes()
 
 	db.First(&serverOption)
 	if serverOption.UUID == "" {
@@ -99,8 +134,19 @@ func main() {
 	if serverOption.NumberBookPerPage == 0 {
 		serverOption.NumberBookPerPage = 20
 	}
+	if serverOption.JobWorkers < 1 {
+		serverOption.JobWorkers = 2
+	}
+	if serverOption.SessionSecret == "" {
+		serverOption.SessionSecret = randomHex(32)
+	}
+	setupUsers(&serverOption)
+	// the old clear text password and token now live in users and client_tokens
+	serverOption.Password = ""
+	serverOption.Token = ""
 	db.Save(&serverOption)
 	options = serverOption
+	migrateClientTokens()
 
 	kingpin.Version(version)
 	kingpin.Parse()
@@ -127,7 +173,7 @@ func main() {
 		pidFile.WriteString(strconv.Itoa(currentPid))
 		pidFile.Close()
 
-		layout = template.Must(template.ParseFiles("template/layout.html"))
+		layout = template.Must(template.New("layout.html").Funcs(csrfFuncs(nil)).ParseFiles("template/layout.html"))
 
 		routeur := mux.NewRouter()
 		routeur.HandleFunc("/index.{format}", rootHandler)
@@ -136,43 +182,113 @@ func main() {
 		routeur.HandleFunc("/books/{id}.{format}", bookHandler)
 		routeur.HandleFunc("/books/{id}/delete", deleteBookHandler)
 		routeur.HandleFunc("/books/{id}/edit", editBookHandler)
+		routeur.HandleFunc("/books/{id}/metadata", applyMetadataHandler).Methods(http.MethodPost)
 		routeur.HandleFunc("/books/{id}/favorite", favoriteBookHandler)
 		routeur.HandleFunc("/books/{id}/readed", readedBookHandler)
 		routeur.HandleFunc("/books/{id}/download", downloadBookHandler)
+		routeur.HandleFunc("/books/{id}/download/{format}", downloadFormatHandler)
 		routeur.HandleFunc("/books/{id}/refresh", refreshMetaBookHandler)
+		routeur.HandleFunc("/books/{id}/cover/extract", extractCoverBookHandler)
+		routeur.HandleFunc("/books/{id}/cover/{size:thumb|medium|full}.jpg", coverImageHandler)
+		routeur.HandleFunc("/books/{id}/read", readBookHandler)
+		routeur.HandleFunc("/books/{id}/read/manifest.json", readerManifestHandler)
+		routeur.HandleFunc("/books/{id}/read/webapp.webmanifest", readerWebManifestHandler)
+		routeur.HandleFunc("/books/{id}/read/{asset:.*}", readerAssetHandler)
+		routeur.HandleFunc("/books/{id}/progress", readerProgressHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/books/{id}/send", sendBookHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/jobs.{format}", jobsHandler)
+		routeur.HandleFunc("/duplicates.html", duplicatesHandler)
+		routeur.HandleFunc("/duplicates/merge", duplicatesMergeHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/duplicates/ignore", duplicatesIgnoreHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/jobs/retry", jobRetryHandler)
+		routeur.HandleFunc("/jobs/{id}/retry", jobRetryHandler)
+		routeur.HandleFunc("/authors.{format}", authorsHandler)
+		routeur.HandleFunc("/authors/merge", authorsMergeHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/authors/{id}.{format}", authorHandler)
+		routeur.HandleFunc("/authors/{id}/edit", authorEditHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/authors/{id}/aliases/{alias}/delete", authorAliasDeleteHandler)
+		routeur.HandleFunc("/series.{format}", seriesListHandler)
+		routeur.HandleFunc("/series/{id}.{format}", seriesHandler)
+		routeur.HandleFunc("/series/{id}/edit", seriesEditHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/shelves.{format}", shelvesHandler)
+		routeur.HandleFunc("/shelves/{id}.{format}", shelfHandler)
+		routeur.HandleFunc("/shelves/{id}/edit", shelfEditHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/shelves/{id}/delete", shelfDeleteHandler)
+		routeur.HandleFunc("/tags.{format:atom|json}", tagsFeedHandler)
+		routeur.HandleFunc("/languages.{format:atom|json}", languagesHandler)
+		routeur.HandleFunc("/publishers.{format:atom|json}", publishersHandler)
 		routeur.HandleFunc("/tags_list.html", tagsListHandler)
+		routeur.HandleFunc("/tags/merge", tagsMergeHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/tags/{id}/edit", tagEditHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/tags/{id}/aliases/{alias}/delete", tagAliasDeleteHandler)
 		routeur.HandleFunc("/tags/{id}/delete", tagDelete)
 		routeur.HandleFunc("/tags_completion.json", tagsCompletionHandler)
 		routeur.HandleFunc("/opensearch.xml", opensearchHandler)
 		routeur.HandleFunc("/search.{format}", searchHandler)
-		routeur.HandleFunc("/books/changeTag", changeTagHandler)
+		routeur.HandleFunc("/books/changeTag", changeTagHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/books/batch", batchHandler).Methods(http.MethodPost)
 		routeur.HandleFunc("/login.html", loginHandler)
+		routeur.HandleFunc("/logout", logoutHandler)
+		routeur.HandleFunc("/users.html", usersHandler)
+		routeur.HandleFunc("/tokens.html", tokensHandler)
+		routeur.HandleFunc("/tokens/{id}/revoke", tokenRevokeHandler)
+		routeur.HandleFunc("/devices.html", devicesHandler)
+		routeur.HandleFunc("/devices/{id}/delete", deviceDeleteHandler)
+		routeur.HandleFunc("/users/{id}/delete", userDeleteHandler)
+		routeur.HandleFunc("/users/create", kosyncCreateHandler).Methods(http.MethodPost)
+		routeur.HandleFunc("/users/auth", kosyncAuthHandler).Methods(http.MethodGet)
+		routeur.HandleFunc("/syncs/progress", kosyncUpdateHandler).Methods(http.MethodPut)
+		routeur.HandleFunc("/syncs/progress/{document}", kosyncProgressHandler).Methods(http.MethodGet)
+		routeur.HandleFunc("/healthcheck", kosyncHealthHandler)
+		apiRoutes(routeur)
 		routeur.HandleFunc("/", redirectRootHandler)
 
-		n := negroni.Classic()
+		n := negroni.New(negroni.NewRecovery(), negroni.NewLogger())
 
-		store := cookiestore.New([]byte(serverOption.Password))
+		store := cookiestore.New([]byte(serverOption.SessionSecret))
+		store.Options(sessions.Options{Path: "/", MaxAge: 30 * 24 * 3600, HTTPOnly: true})
 		n.Use(sessions.Sessions("myopds", store))
+		n.UseFunc(authMiddleware)
+		n.Use(negroni.NewStatic(http.Dir("public")))
 
 		n.UseHandler(routeur)
+		startJobWorkers(serverOption.JobWorkers)
+		if *inboxDir != "" {
+			options.InboxDir = *inboxDir
+		}
+		startInbox(options.InboxDir)
 		fmt.Println("launching server version " + version + " listening port " + strconv.Itoa(serverOption.Port))
 		graceful.Run(":"+strconv.Itoa(serverOption.Port), 10*time.Second, n)
 	}
 
 	if *importDir != "" {
+		var attachBook Book
+		if *attachID != 0 {
+			db.Find(&attachBook, *attachID)
+			if attachBook.ID == 0 {
+				panic("can't find book to attach files")
+			}
+		}
+
 		files, _ := ioutil.ReadDir(*importDir)
 		for _, f := range files {
 			fmt.Println(f.Name())
-			importFile(*importDir + "/" + f.Name())
+			if attachBook.ID != 0 {
+				enqueueJob(jobAttach, *importDir+"/"+f.Name(), attachBook.ID)
+			} else {
+				enqueueJob(jobImport, *importDir+"/"+f.Name(), 0)
+			}
 		}
+		runJobs(serverOption.JobWorkers)
 	}
 
 	if *metaMode == true {
 
 		db.Where("edited = 0").Find(&books)
 		for _, book := range books {
-			book.getMetada()
+			enqueueJob(jobMetadata, "", book.ID)
 		}
+		runJobs(serverOption.JobWorkers)
 	}
 
 }
@@ -185,149 +301,95 @@ func rootHandler(res http.ResponseWriter, req *http.Request) {
 	var books []Book
 	var booksCount int
 	var serverOption ServerOption
-	var page string
 	var pageInt = 1
 	var offset int
-	var nextLink string
-	var prevLink string
-	var firstLink string
-	var lastLink string
 	var bookTemplate *template.Template
-	var tags []Tag
 
 	baseDoc := etree.NewDocument()
 	baseDoc.Indent(2)
 	vars := mux.Vars(req)
+	selfLink := req.URL.String()
 
-	db.First(&serverOption)
-
-	if serverOption.Password != "" && (vars["format"] == "html") {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
-		}
+	if vars["format"] != "html" && rootCatalog(req) {
+		rootCatalogHandler(res, req)
+		return
 	}
 
-	if serverOption.Token != "" && (vars["format"] == atomExt) {
-		token := req.URL.Query().Get("token")
-		if token != serverOption.Token {
-			res.WriteHeader(401)
-			return
-		}
-	}
+	db.First(&serverOption)
 
-	page = req.URL.Query().Get("page")
-	if page != "" {
+	user := currentUser(req)
+	token := req.URL.Query().Get("token")
+	baseURL := RootURL(req)
+
+	if page := req.URL.Query().Get("page"); page != "" {
 		pageInt, _ = strconv.Atoi(page)
-		if pageInt > 1 {
-			prevPageStr := strconv.Itoa(pageInt - 1)
-			prevReq := req
-			values := prevReq.URL.Query()
-			values.Set("page", prevPageStr)
-			prevReq.URL.RawQuery = values.Encode()
-			prevLink = prevReq.URL.String()
-
-			firstReq := req
-			values = firstReq.URL.Query()
-			values.Set("page", "1")
-			firstReq.URL.RawQuery = values.Encode()
-			firstLink = firstReq.URL.String()
+		if pageInt < 1 {
+			pageInt = 1
 		}
-		nextPageStr := strconv.Itoa(pageInt + 1)
-		nextReq := req
-		values := nextReq.URL.Query()
-		values.Set("page", nextPageStr)
-		nextReq.URL.RawQuery = values.Encode()
-		nextLink = nextReq.URL.String()
-	} else {
-		nextReq := req
-		values := nextReq.URL.Query()
-		values.Add("page", "2")
-		nextReq.URL.RawQuery = values.Encode()
-		nextLink = nextReq.URL.String()
 	}
 
 	limit := serverOption.NumberBookPerPage
 	offset = limit * (pageInt - 1)
-	tag := req.URL.Query().Get("tag")
-	author := req.URL.Query().Get("author")
-	authorIDStr := req.URL.Query().Get("author_id")
-	authorID, _ := strconv.Atoi(authorIDStr)
-	order := req.URL.Query().Get("order")
-	serie := req.URL.Query().Get("serie")
-	filter := req.URL.Query().Get("filter")
-
-	db.Limit(limit).Offset(offset).Scopes(BookwithCat(tag)).Scopes(BookwithAuthorID(authorID)).Scopes(BookwithAuthor(author)).Scopes(BookOrder(order)).Scopes(BookwithSerie(serie)).Scopes(BookFilter(filter)).Find(&books)
-
-	db.Model(Book{}).Scopes(BookwithCat(tag)).Scopes(BookwithAuthorID(authorID)).Scopes(BookwithAuthor(author)).Scopes(BookwithSerie(serie)).Scopes(BookFilter(filter)).Count(&booksCount)
-	if offset+limit > booksCount {
-		nextLink = ""
-	}
-	lastPage := booksCount/limit + 1
+	query := req.URL.Query()
+	bookQuery(query, user.ID).Scopes(BookOrder(query.Get("order"), query.Get("dir"), user.ID)).Limit(limit).Offset(offset).Find(&books)
+	bookQuery(query, user.ID).Count(&booksCount)
 
-	if lastPage != pageInt {
-		lastPageStr := strconv.Itoa(lastPage)
-		lastReq := req
-		values := lastReq.URL.Query()
-		values.Set("page", lastPageStr)
-		lastReq.URL.RawQuery = values.Encode()
-		lastLink = lastReq.URL.String()
-	}
+	firstLink, prevLink, nextLink, lastLink := paginationLinks(req.URL, pageInt, limit, booksCount)
 
 	if vars["format"] == atomExt {
-		res.Header().Set("Content-Type", "application/atom+xml")
-		feed := baseOpds(baseDoc, serverOption.UUID, serverOption.Name, booksCount, serverOption.NumberBookPerPage, offset+1, prevLink, nextLink)
+		res.Header().Set("Content-Type", opdsAcquisitionType)
+		feedQuery := req.URL.Query()
+		feedQuery.Del("token")
+		feedQuery.Del("page")
+		feed := baseOpds(baseDoc, serverOption.UUID+":"+feedQuery.Encode(), serverOption.Name, booksCount, serverOption.NumberBookPerPage, offset+1, baseURL, selfLink, "/index.atom", prevLink, nextLink, opdsAcquisitionType, token)
 
 		linkFavorite := feed.CreateElement("link")
-		linkFavorite.CreateAttr("type", "application/atom+xml;profile=opds-catalog;kind=acquisition")
-		linkFavorite.CreateAttr("href", "/index.atom?filter=favorite&token="+serverOption.Token)
+		linkFavorite.CreateAttr("type", opdsAcquisitionType)
+		linkFavorite.CreateAttr("href", baseURL+withToken("/index.atom?filter=favorite", token))
 		linkFavorite.CreateAttr("rel", "http://opds-spec.org/sort/popular")
 		linkFavorite.CreateAttr("title", "Favori")
 
 		linkRoot := feed.CreateElement("link")
-		linkRoot.CreateAttr("type", "application/atom+xml;profile=opds-catalog;kind=acquisition")
-		linkRoot.CreateAttr("href", "/index.atom?page=1&token="+serverOption.Token)
+		linkRoot.CreateAttr("type", opdsAcquisitionType)
+		linkRoot.CreateAttr("href", baseURL+withToken("/index.atom?order=new", token))
 		linkRoot.CreateAttr("rel", "http://opds-spec.org/sort/new")
 		linkRoot.CreateAttr("title", "Recent")
 
-		if page != "" || len(req.URL.Query()) > 1 {
-			for _, book := range books {
-				entryOpds(&book, feed)
-			}
-		} else {
-			db.Find(&tags)
-			sort.Sort(ByBookCount(tags))
-
-			for _, tag := range tags {
-				e := feed.CreateElement("entry")
-				t := e.CreateElement("title")
-				t.SetText(tag.Name)
-				i := e.CreateElement("id")
-				i.SetText(tag.Name)
-				updatedAt := e.CreateElement("updated")
-				updatedAt.SetText(time.Now().Format(time.RFC3339))
-				linkTag := e.CreateElement("link")
-				linkTag.CreateAttr("href", "/index.atom?tag="+strings.Replace(tag.Name, " ", "+", -1)+"&token="+serverOption.Token)
-				linkTag.CreateAttr("type", "application/atom+xml;profile=opds-catalog;kind=acquisition")
-				linkTag.CreateAttr("rel", "http://opds-spec.org/sort/new")
-			}
+		facetLinksOpds(feed, bookFacets(query, user.ID), baseURL, "/index.atom", query)
+
+		for _, book := range books {
+			entryOpds(&book, feed, baseURL, token)
 		}
 
-		// tags := []string{"Roman", "Science-Fiction", "Fantasy", "Thriller", "Romance"}
-		// for _, tag := range tags {
-		// 	link := feed.CreateElement("link")
-		// 	link.CreateAttr("type", "application/atom+xml;profile=opds-catalog;kind=acquisition")
-		// 	link.CreateAttr("href", "/index.atom?tag="+strings.Replace(tag, " ", "+", -1))
-		// 	link.CreateAttr("rel", "http://opds-spec.org/sort/popular")
-		// 	link.CreateAttr("title", tag)
-		// }
 		xmlString, _ := baseDoc.WriteToString()
 		fmt.Fprintf(res, xmlString)
-	} else if vars["format"] == "json" {
-		// Use OPDS2 feed
+	} else if vars["format"] == jsonExt {
+		feed := baseOpds2(serverOption.UUID, serverOption.Name, booksCount, serverOption.NumberBookPerPage, pageInt, baseURL+selfLink, prevLink, nextLink, firstLink, lastLink, token)
+
+		feed.Navigation = append(feed.Navigation, Opds2Link{
+			Href:  baseURL + withToken("/index.json?filter=favorite", token),
+			Type:  opds2MediaType,
+			Rel:   "http://opds-spec.org/sort/popular",
+			Title: "Favori",
+		})
+		feed.Navigation = append(feed.Navigation, Opds2Link{
+			Href:  baseURL + withToken("/index.json?order=new", token),
+			Type:  opds2MediaType,
+			Rel:   "http://opds-spec.org/sort/new",
+			Title: "Recent",
+		})
+
+		feed.Facets = facetGroupsOpds2(bookFacets(query, user.ID), baseURL, "/index.json", query)
+
+		feed.Publications = []Opds2Publication{}
+		for _, book := range books {
+			feed.Publications = append(feed.Publications, publicationOpds2(&book, baseURL, token))
+		}
+
+		writeOpds2(res, opds2MediaType, feed)
 	} else {
-		bookTemplate = template.Must(layout.Clone())
+		loadUserStates(books, user.ID)
+		bookTemplate = template.Must(layout.Clone()).Funcs(csrfFuncs(req))
 		templateFile, _ := pkger.Open("/template/bookcover.html")
 		templateData, _ := ioutil.ReadAll(templateFile)
 		bookTemplate = template.Must(bookTemplate.Parse(string(templateData)))
@@ -338,6 +400,7 @@ func rootHandler(res http.ResponseWriter, req *http.Request) {
 			LastPage:    lastLink,
 			Content:     books,
 			FilterBlock: true,
+			Sort:        sortBlock(query),
 			Title:       serverOption.Name,
 		})
 		if err != nil {
@@ -347,13 +410,17 @@ func rootHandler(res http.ResponseWriter, req *http.Request) {
 
 }
 
-// BookwithCat scope to get book with specific categories
+// BookwithCat scope to get book with specific categories, the books of the sub tags are included
 func BookwithCat(category string) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
 		if category == "" {
 			return db
 		}
-		return db.Joins("inner join book_tags on book_tags.book_id = books.id inner join tags on book_tags.tag_id = tags.id").Where("name = ?", category)
+		separator := tagSeparator()
+		prefix := category + tagJoin(separator)
+		return db.Where("books.id IN (SELECT book_tags.book_id FROM book_tags INNER JOIN tags ON book_tags.tag_id = tags.id "+
+			"WHERE tags.deleted_at IS NULL AND (tags.name = ? OR (? <> '' AND substr(tags.name, 1, ?) = ?)))",
+			category, separator, utf8.RuneCountInString(prefix), prefix)
 	}
 }
 
@@ -367,20 +434,40 @@ func BookwithSerie(serie string) func(db *gorm.DB) *gorm.DB {
 	}
 }
 
-// BookFilter scope to filter book
-func BookFilter(filter string) func(db *gorm.DB) *gorm.DB {
+// BookwithLanguage scope to get book in a language
+func BookwithLanguage(language string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if language == "" {
+			return db
+		}
+		return db.Where("books.language = ?", language)
+	}
+}
+
+// BookwithPublisher scope to get book of a publisher
+func BookwithPublisher(publisher string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if publisher == "" {
+			return db
+		}
+		return db.Where("books.publisher = ?", publisher)
+	}
+}
+
+// BookFilter scope to filter book with the reading state of the user
+func BookFilter(filter string, userID uint) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
 		if filter == "" {
 			return db
 		}
 		if filter == "favorite" {
-			return db.Where("favorite = 1")
+			return db.Where("books.id IN (SELECT book_id FROM user_books WHERE user_id = ? AND favorite = 1 AND deleted_at IS NULL)", userID)
 		}
 		if filter == "notread" {
-			return db.Where("read = 0")
+			return db.Where("books.id NOT IN (SELECT book_id FROM user_books WHERE user_id = ? AND read = 1 AND deleted_at IS NULL)", userID)
 		}
 		if filter == "read" {
-			return db.Where("read = 1")
+			return db.Where("books.id IN (SELECT book_id FROM user_books WHERE user_id = ? AND read = 1 AND deleted_at IS NULL)", userID)
 		}
 		return db
 	}
@@ -406,16 +493,37 @@ func BookwithAuthorID(authorID int) func(db *gorm.DB) *gorm.DB {
 	}
 }
 
-// BookOrder scope to order book
-func BookOrder(order string) func(db *gorm.DB) *gorm.DB {
+// BookOrder scope to order book, dir is asc or desc, empty for the default direction of the order
+func BookOrder(order string, dir string, userID uint) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		if order == "new" {
-			return db.Order("id desc")
+		sort, desc := findBookSort(order, dir)
+		direction := " asc"
+		if desc {
+			direction = " desc"
 		}
-		if order == "old" {
-			return db.Order("id asc")
+
+		switch sort.Value {
+		case "title":
+			db = db.Order("books.title_sort COLLATE NOCASE" + direction)
+		case "author":
+			db = db.Order("(SELECT min(authors.sort_name) FROM authors INNER JOIN book_authors ON book_authors.author_id = authors.id WHERE book_authors.book_id = books.id) COLLATE NOCASE" + direction).Order("books.title_sort COLLATE NOCASE asc")
+		case "serie":
+			db = db.Order("books.serie = '' asc").Order("books.serie COLLATE NOCASE" + direction).Order("books.serie_number" + direction)
+		case "publisher":
+			db = db.Order("books.publisher = '' asc").Order("books.publisher COLLATE NOCASE" + direction).Order("books.title_sort COLLATE NOCASE asc")
+		case "published":
+			db = db.Order("books.published_at IS NULL asc").Order("books.published_at" + direction)
+		case "read":
+			lastRead := "(SELECT read_at FROM user_books WHERE user_books.book_id = books.id AND user_books.user_id = " + strconv.Itoa(int(userID)) + ")"
+			db = db.Order(lastRead + " IS NULL asc").Order(lastRead + direction)
+		case "size":
+			db = db.Order("(SELECT max(size) FROM book_files WHERE book_files.book_id = books.id AND book_files.deleted_at IS NULL)" + direction)
+		case "random":
+			db = db.Order("(books.id * 2654435761 + " + strconv.FormatInt(randomSeed(), 10) + ") % 1000003" + direction)
+		default:
+			return db.Order("books.id" + direction)
 		}
-		return db.Order("id desc")
+		return db.Order("books.id desc")
 	}
 }
 
@@ -428,18 +536,13 @@ func bookHandler(res http.ResponseWriter, req *http.Request) {
 	db.First(&serverOption)
 
 	bookID, _ := strconv.ParseInt(vars["id"], 10, 64)
-	db.Preload("Authors").Preload("Tags").Find(&book, bookID)
+	db.Preload("Authors").Preload("Tags").Preload("Files").Find(&book, bookID)
+	book.loadUserState(currentUser(req).ID)
+	book.Devices = userDevices(currentUser(req).ID)
 
 	if vars["format"] == "html" {
-		if serverOption.Password != "" {
-			if !checkAuth(req) {
-				res.Header().Set("Location", "/login.html")
-				res.WriteHeader(302)
-				return
-			}
-		}
 
-		bookTemplate = template.Must(layout.Clone())
+		bookTemplate = template.Must(layout.Clone()).Funcs(csrfFuncs(req))
 		templateFile, _ := pkger.Open("/template/book.html")
 		templateData, _ := ioutil.ReadAll(templateFile)
 		bookTemplate = template.Must(bookTemplate.Parse(string(templateData)))
@@ -462,15 +565,24 @@ func bookHandler(res http.ResponseWriter, req *http.Request) {
 
 		feed := baseDoc.CreateElement("entry")
 
-		fullEntryOpds(&book, feed, RootURL(req))
+		fullEntryOpds(&book, feed, RootURL(req), req.URL.Query().Get("token"), currentUser(req).ID)
 		xmlString, _ := baseDoc.WriteToString()
 		fmt.Fprintf(res, xmlString)
 
 	}
 
+	if vars["format"] == jsonExt {
+		if book.ID == 0 {
+			http.NotFound(res, req)
+			return
+		}
+		publication := publicationOpds2(&book, RootURL(req), req.URL.Query().Get("token"))
+		writeOpds2(res, opds2PublicationMediaType, publication)
+	}
+
 }
 
-func baseOpds(doc *etree.Document, uuid string, name string, totalResult int, perPage int, offset int, prevLink string, nextLink string) *etree.Element {
+func baseOpds(doc *etree.Document, uuid string, name string, totalResult int, perPage int, offset int, baseURL string, selfLink string, upLink string, prevLink string, nextLink string, kind string, token string) *etree.Element {
 	var totalResultText string
 	var perPageText string
 	var offsetText string
@@ -518,35 +630,49 @@ func baseOpds(doc *etree.Document, uuid string, name string, totalResult int, pe
 		offsetXML.SetText(offsetText)
 	}
 
+	linkSelf := feed.CreateElement("link")
+	linkSelf.CreateAttr("type", kind)
+	linkSelf.CreateAttr("href", baseURL+selfLink)
+	linkSelf.CreateAttr("rel", "self")
+
+	linkStart := feed.CreateElement("link")
+	linkStart.CreateAttr("type", opdsNavigationType)
+	linkStart.CreateAttr("href", baseURL+withToken("/index.atom", token))
+	linkStart.CreateAttr("rel", "start")
+
+	if upLink != "" {
+		linkUp := feed.CreateElement("link")
+		linkUp.CreateAttr("type", opdsNavigationType)
+		linkUp.CreateAttr("href", baseURL+withToken(upLink, token))
+		linkUp.CreateAttr("rel", "up")
+	}
+
 	if prevLink != "" {
 		prevLinkXML := feed.CreateElement("link")
-		prevLinkXML.CreateAttr("type", "application/atom+xml;profile=opds-catalog;kind=acquisition")
+		prevLinkXML.CreateAttr("type", kind)
 		prevLinkXML.CreateAttr("title", "Previous")
-		prevLinkXML.CreateAttr("href", prevLink)
+		prevLinkXML.CreateAttr("href", baseURL+prevLink)
 		prevLinkXML.CreateAttr("rel", "previous")
 	}
 
 	if nextLink != "" {
 		nextLinkXML := feed.CreateElement("link")
-		nextLinkXML.CreateAttr("type", "application/atom+xml;profile=opds-catalog;kind=acquisition")
+		nextLinkXML.CreateAttr("type", kind)
 		nextLinkXML.CreateAttr("title", "Next")
-		nextLinkXML.CreateAttr("href", nextLink)
+		nextLinkXML.CreateAttr("href", baseURL+nextLink)
 		nextLinkXML.CreateAttr("rel", "next")
 	}
 
 	linkSearch := feed.CreateElement("link")
 	linkSearch.CreateAttr("type", "application/opensearchdescription+xml")
-	linkSearch.CreateAttr("href", "/opensearch.xml")
+	linkSearch.CreateAttr("href", baseURL+withToken("/opensearch.xml", token))
 	linkSearch.CreateAttr("rel", "search")
 
 	return feed
 }
 
-func entryOpds(book *Book, feed *etree.Element) {
+func entryOpds(book *Book, feed *etree.Element, baseURL string, token string) {
 	var authors []Author
-	var serverOption ServerOption
-
-	db.First(&serverOption)
 
 	entry := feed.CreateElement("entry")
 
@@ -565,41 +691,55 @@ func entryOpds(book *Book, feed *etree.Element) {
 		name := authorTag.CreateElement("name")
 		name.SetText(author.Name)
 		uri := authorTag.CreateElement("uri")
-		uri.SetText("/authors/" + strconv.Itoa(int(author.ID)))
+		uri.SetText(baseURL + authorLinkOpds(author, atomExt, token))
 	}
 
 	language := entry.CreateElement("dcterms:language")
 	language.SetText(book.Language)
 
+	if book.PublishedAt != nil {
+		issued := entry.CreateElement("dcterms:issued")
+		issued.SetText(book.PublishedDate())
+	}
+
 	summary := entry.CreateElement("summary")
 	summary.CreateAttr("type", "text")
 	summary.CreateCharData(book.Description)
 
-	link := entry.CreateElement("link")
-	link.CreateAttr("rel", "http://opds-spec.org/acquisition/open-access")
-	link.CreateAttr("type", "application/epub+zip")
-	link.CreateAttr("href", book.DownloadURL())
-
-	if book.CoverDownloadURL() != "" {
-		linkCover := entry.CreateElement("link")
-		linkCover.CreateAttr("rel", "http://opds-spec.org/image")
-		if book.CoverType == jpgMediaType {
-			linkCover.CreateAttr("type", jpgMediaType)
-		} else if book.CoverType == pngMediaType {
-			linkCover.CreateAttr("type", pngMediaType)
-		}
-		linkCover.CreateAttr("href", book.CoverDownloadURL())
-	}
+	acquisitionLinksOpds(book, entry, baseURL, token)
+
+	coverLinksOpds(entry, *book, baseURL, token)
 
 	linkFull := entry.CreateElement("link")
 	linkFull.CreateAttr("rel", "alternate")
-	linkFull.CreateAttr("href", "/books/"+strconv.Itoa(int(book.ID))+".atom?token="+serverOption.Token)
-	linkFull.CreateAttr("type", "application/atom+xml;type=entry;profile=opds-catalog")
-	linkFull.CreateAttr("tile", "Full entry")
+	linkFull.CreateAttr("href", baseURL+withToken("/books/"+strconv.Itoa(int(book.ID))+".atom", token))
+	linkFull.CreateAttr("type", opdsEntryType)
+	linkFull.CreateAttr("title", "Full entry")
 
 }
 
-func fullEntryOpds(book *Book, feed *etree.Element, baseURL string) {
+// acquisitionLinksOpds add one acquisition link per file of the book
+func acquisitionLinksOpds(book *Book, entry *etree.Element, baseURL string, token string) {
+	files := book.bookFiles()
+	if len(files) == 0 {
+		link := entry.CreateElement("link")
+		link.CreateAttr("rel", "http://opds-spec.org/acquisition/open-access")
+		link.CreateAttr("type", book.fileFormat().MediaType)
+		link.CreateAttr("href", withToken(baseURL+book.DownloadURL(), token))
+		return
+	}
+
+	for _, file := range files {
+		link := entry.CreateElement("link")
+		link.CreateAttr("rel", "http://opds-spec.org/acquisition/open-access")
+		link.CreateAttr("type", file.MediaType)
+		link.CreateAttr("href", withToken(baseURL+book.FormatDownloadURL(file.Format), token))
+		link.CreateAttr("title", file.FormatName())
+		link.CreateAttr("length", strconv.FormatInt(file.Size, 10))
+	}
+}
+
+func fullEntryOpds(book *Book, feed *etree.Element, baseURL string, token string, userID uint) {
 	var authors []Author
 	var serverOption ServerOption
 
@@ -632,7 +772,7 @@ func fullEntryOpds(book *Book, feed *etree.Element, baseURL string) {
 		name := authorTag.CreateElement("name")
 		name.SetText(author.Name)
 		uri := authorTag.CreateElement("uri")
-		uri.SetText("/authors/" + strconv.Itoa(int(author.ID)))
+		uri.SetText(baseURL + authorLinkOpds(author, atomExt, token))
 	}
 
 	if book.Language != "" {
@@ -640,6 +780,11 @@ func fullEntryOpds(book *Book, feed *etree.Element, baseURL string) {
 		language.SetText(book.Language)
 	}
 
+	if book.PublishedAt != nil {
+		issued := entry.CreateElement("dcterms:issued")
+		issued.SetText(book.PublishedDate())
+	}
+
 	summary := entry.CreateElement("summary")
 	summary.CreateAttr("type", "text")
 	summary.CreateCharData(book.Description)
@@ -651,35 +796,31 @@ func fullEntryOpds(book *Book, feed *etree.Element, baseURL string) {
 		catElem.CreateAttr("term", cat.Name)
 	}
 
-	link := entry.CreateElement("link")
-	link.CreateAttr("rel", "http://opds-spec.org/acquisition/open-access")
-	link.CreateAttr("type", "application/epub+zip")
-	link.CreateAttr("href", baseURL+book.DownloadURL())
+	acquisitionLinksOpds(book, entry, baseURL, token)
 
-	if book.CoverDownloadURL() != "" {
-		linkCover := entry.CreateElement("link")
-		linkCover.CreateAttr("rel", "http://opds-spec.org/image")
-		if book.CoverType == "image/jpeg" {
-			linkCover.CreateAttr("type", "image/jpeg")
-		} else if book.CoverType == "image/png" {
-			linkCover.CreateAttr("type", "image/png")
-		}
-		linkCover.CreateAttr("href", baseURL+book.CoverDownloadURL())
-	}
+	coverLinksOpds(entry, *book, baseURL, token)
 
 	if book.Serie != "" {
 		serieElem := entry.CreateElement("link")
 		serieElem.CreateAttr("rel", "related")
 		serieElem.CreateAttr("type", "application/atom+xml;profile=opds-catalog;kind=acquisition")
-		serieElem.CreateAttr("href", baseURL+"/index.atom?serie="+strings.Replace(book.Serie, " ", "+", -1))
+		serieElem.CreateAttr("href", baseURL+seriesLinkOpds(book.SeriesID, atomExt, token))
 		serieElem.CreateAttr("title", book.Serie)
+
+		if next := book.nextUnreadInSeries(userID); next.ID != 0 {
+			nextElem := entry.CreateElement("link")
+			nextElem.CreateAttr("rel", "related")
+			nextElem.CreateAttr("type", opdsEntryType)
+			nextElem.CreateAttr("href", withToken(baseURL+"/books/"+strconv.Itoa(int(next.ID))+".atom", token))
+			nextElem.CreateAttr("title", "Suivant dans la série : "+next.Title)
+		}
 	}
 
 	for _, author := range book.Authors {
 		linkAuthor := entry.CreateElement("link")
 		linkAuthor.CreateAttr("rel", "http://www.feedbooks.com/opds/same_author")
 		linkAuthor.CreateAttr("type", "application/atom+xml;profile=opds-catalog;kind=acquisition")
-		linkAuthor.CreateAttr("href", baseURL+"/index.atom?author_id="+strconv.Itoa(int(author.ID)))
+		linkAuthor.CreateAttr("href", withToken(baseURL+"/index.atom?author_id="+strconv.Itoa(int(author.ID)), token))
 		linkAuthor.CreateAttr("title", author.Name)
 	}
 
@@ -687,7 +828,7 @@ func fullEntryOpds(book *Book, feed *etree.Element, baseURL string) {
 		linkTag := entry.CreateElement("link")
 		linkTag.CreateAttr("rel", "related")
 		linkTag.CreateAttr("type", "application/atom+xml;profile=opds-catalog;kind=acquisition")
-		linkTag.CreateAttr("href", baseURL+"/index.atom?tag="+strings.Replace(tag.Name, " ", "+", -1))
+		linkTag.CreateAttr("href", withToken(baseURL+"/index.atom?tag="+strings.Replace(tag.Name, " ", "+", -1), token))
 		linkTag.CreateAttr("title", tag.Name)
 	}
 
@@ -697,6 +838,7 @@ func opensearchHandler(res http.ResponseWriter, req *http.Request) {
 	var xmlString string
 
 	res.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	token := req.URL.Query().Get("token")
 
 	baseDoc := etree.NewDocument()
 	baseDoc.Indent(2)
@@ -722,7 +864,11 @@ func opensearchHandler(res http.ResponseWriter, req *http.Request) {
 
 	atomURL := opensearch.CreateElement("Url")
 	atomURL.CreateAttr("type", "application/atom+xml")
-	atomURL.CreateAttr("template", RootURL(req)+"/search.atom?query={searchTerms}")
+	atomURL.CreateAttr("template", withToken(RootURL(req)+"/search.atom?query={searchTerms}", token))
+
+	jsonURL := opensearch.CreateElement("Url")
+	jsonURL.CreateAttr("type", opds2MediaType)
+	jsonURL.CreateAttr("template", withToken(RootURL(req)+"/search.json?query={searchTerms}", token))
 
 	// <Url type="application/x-suggestions+json" rel="suggestions" template="http://www.feedbooks.com/search.json?query={searchTerms}"/>
 	// <Url type="application/x-suggestions+xml" rel="suggestions" template="http://www.feedbooks.com/suggest.xml?query={searchTerms}"/>
@@ -740,10 +886,22 @@ func searchHandler(res http.ResponseWriter, req *http.Request) {
 	var xmlString string
 	var bookTemplate *template.Template
 	var serverOption ServerOption
+	var pageInt = 1
 
 	db.First(&serverOption)
 	search := req.URL.Query().Get("query")
-	books := findBookBySearch(search)
+	page := req.URL.Query().Get("page")
+	if page != "" {
+		pageInt, _ = strconv.Atoi(page)
+		if pageInt < 1 {
+			pageInt = 1
+		}
+	}
+
+	limit := serverOption.NumberBookPerPage
+	offset := limit * (pageInt - 1)
+	books, booksCount := searchBooks(search, limit, offset)
+	firstLink, prevLink, nextLink, lastLink := paginationLinks(req.URL, pageInt, limit, booksCount)
 
 	vars := mux.Vars(req)
 
@@ -753,32 +911,38 @@ func searchHandler(res http.ResponseWriter, req *http.Request) {
 		baseDoc := etree.NewDocument()
 		baseDoc.Indent(2)
 
-		feed := baseOpds(baseDoc, RootURL(req)+"/search.atom", search, len(books), len(books), 0, "", "")
+		feed := baseOpds(baseDoc, RootURL(req)+"/search.atom", search, booksCount, limit, offset+1, RootURL(req), req.URL.String(), "/index.atom", prevLink, nextLink, opdsAcquisitionType, req.URL.Query().Get("token"))
 
 		for _, book := range books {
-			entryOpds(&book, feed)
+			entryOpds(&book, feed, RootURL(req), req.URL.Query().Get("token"))
 		}
 
 		xmlString, _ = baseDoc.WriteToString()
 
 		fmt.Fprintf(res, xmlString)
-	} else {
+	} else if vars["format"] == jsonExt {
+		feed := baseOpds2(RootURL(req)+"/search.json", search, booksCount, limit, pageInt, req.URL.String(), prevLink, nextLink, firstLink, lastLink, req.URL.Query().Get("token"))
 
-		if serverOption.Password != "" {
-			if !checkAuth(req) {
-				res.Header().Set("Location", "/login.html")
-				res.WriteHeader(302)
-				return
-			}
+		feed.Publications = []Opds2Publication{}
+		for _, book := range books {
+			feed.Publications = append(feed.Publications, publicationOpds2(&book, RootURL(req), req.URL.Query().Get("token")))
 		}
 
-		bookTemplate = template.Must(layout.Clone())
+		writeOpds2(res, opds2MediaType, feed)
+	} else {
+
+		loadUserStates(books, currentUser(req).ID)
+		bookTemplate = template.Must(layout.Clone()).Funcs(csrfFuncs(req))
 		templateFile, _ := pkger.Open("/template/bookcover.html")
 		templateData, _ := ioutil.ReadAll(templateFile)
 		bookTemplate = template.Must(bookTemplate.Parse(string(templateData)))
 		err := bookTemplate.Execute(res, Page{
-			Content: books,
-			Title:   serverOption.Name,
+			PrevPage:  prevLink,
+			NextPage:  nextLink,
+			FirstPage: firstLink,
+			LastPage:  lastLink,
+			Content:   books,
+			Title:     serverOption.Name,
 			//			FilterBlock: true,
 		})
 		if err != nil {
@@ -788,6 +952,36 @@ func searchHandler(res http.ResponseWriter, req *http.Request) {
 
 }
 
+// paginationLinks return first, previous, next and last page links for the url
+func paginationLinks(pageURL *url.URL, pageInt int, limit int, count int) (string, string, string, string) {
+	var firstLink string
+	var prevLink string
+	var nextLink string
+	var lastLink string
+
+	link := func(page int) string {
+		linkURL := *pageURL
+		values := linkURL.Query()
+		values.Set("page", strconv.Itoa(page))
+		linkURL.RawQuery = values.Encode()
+		return linkURL.String()
+	}
+
+	if pageInt > 1 {
+		firstLink = link(1)
+		prevLink = link(pageInt - 1)
+	}
+	if limit*pageInt < count {
+		nextLink = link(pageInt + 1)
+	}
+	lastPage := (count + limit - 1) / limit
+	if lastPage > pageInt {
+		lastLink = link(lastPage)
+	}
+
+	return firstLink, prevLink, nextLink, lastLink
+}
+
 // RootURL return url with absolute path
 func RootURL(req *http.Request) string {
 	var option ServerOption
@@ -801,30 +995,11 @@ func RootURL(req *http.Request) string {
 	}
 }
 
-func changeTagHandler(res http.ResponseWriter, req *http.Request) {
-
-	// action := req.URL.Query().Get("action")
-	// tag := req.URL.Query().Get("tag")
-	// bookID := req.URL.Query().Get("id")
-
-}
-
 func uploadBookForm(res http.ResponseWriter, req *http.Request) {
 }
 
 func deleteBookHandler(res http.ResponseWriter, req *http.Request) {
 	var book Book
-	var serverOption ServerOption
-
-	db.First(&serverOption)
-
-	if serverOption.Password != "" {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
-		}
-	}
 
 	vars := mux.Vars(req)
 
@@ -840,17 +1015,6 @@ func deleteBookHandler(res http.ResponseWriter, req *http.Request) {
 
 func favoriteBookHandler(res http.ResponseWriter, req *http.Request) {
 	var book Book
-	var serverOption ServerOption
-
-	db.First(&serverOption)
-
-	if serverOption.Password != "" {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
-		}
-	}
 
 	vars := mux.Vars(req)
 
@@ -859,30 +1023,20 @@ func favoriteBookHandler(res http.ResponseWriter, req *http.Request) {
 	db.Find(&book, bookID)
 
 	if book.ID != 0 {
-		if book.Favorite == false {
-			book.Favorite = true
+		state := userBook(currentUser(req).ID, book.ID)
+		if state.Favorite == false {
+			state.Favorite = true
 		} else {
-			book.Favorite = false
+			state.Favorite = false
 		}
 
-		db.Save(&book)
+		db.Save(&state)
 	}
 	http.Redirect(res, req, "/books/"+vars["id"]+".html", http.StatusTemporaryRedirect)
 }
 
 func refreshMetaBookHandler(res http.ResponseWriter, req *http.Request) {
 	var book Book
-	var serverOption ServerOption
-
-	db.First(&serverOption)
-
-	if serverOption.Password != "" {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
-		}
-	}
 
 	vars := mux.Vars(req)
 
@@ -891,24 +1045,27 @@ func refreshMetaBookHandler(res http.ResponseWriter, req *http.Request) {
 	db.Find(&book, bookID)
 
 	if book.ID != 0 {
-		book.getMetada()
+		enqueueJob(jobMetadata, "", book.ID)
 	}
-	http.Redirect(res, req, "/books/"+vars["id"]+".html", http.StatusTemporaryRedirect)
+	http.Redirect(res, req, "/jobs.html", http.StatusTemporaryRedirect)
 }
 
-func readedBookHandler(res http.ResponseWriter, req *http.Request) {
+func extractCoverBookHandler(res http.ResponseWriter, req *http.Request) {
 	var book Book
-	var serverOption ServerOption
 
-	db.First(&serverOption)
+	vars := mux.Vars(req)
+	bookID, _ := strconv.ParseInt(vars["id"], 10, 64)
 
-	if serverOption.Password != "" {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
-		}
+	db.Find(&book, bookID)
+
+	if book.ID != 0 {
+		enqueueJob(jobCover, "", book.ID)
 	}
+	http.Redirect(res, req, "/jobs.html", http.StatusTemporaryRedirect)
+}
+
+func readedBookHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
 
 	vars := mux.Vars(req)
 
@@ -917,40 +1074,73 @@ func readedBookHandler(res http.ResponseWriter, req *http.Request) {
 	db.Find(&book, bookID)
 
 	if book.ID != 0 {
-		if book.Read == false {
-			book.Read = true
+		state := userBook(currentUser(req).ID, book.ID)
+		if state.Read == false {
+			now := time.Now()
+			state.Read = true
+			state.ReadAt = &now
 		} else {
-			book.Read = false
+			state.Read = false
 		}
 
-		db.Save(&book)
+		db.Save(&state)
 	}
 	http.Redirect(res, req, "/books/"+vars["id"]+".html", http.StatusTemporaryRedirect)
 }
 
 func downloadBookHandler(res http.ResponseWriter, req *http.Request) {
 	var book Book
-	var serverOption ServerOption
 
-	db.First(&serverOption)
 	vars := mux.Vars(req)
 
-	if serverOption.Password != "" && (vars["format"] == "html") {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
-		}
+	bookID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.Find(&book, bookID)
+
+	format := book.fileFormat()
+	bookFile := BookFile{Path: book.FilePath(), Format: format.Name}
+	bookFile.UpdatedAt = book.UpdatedAt
+	db.Where("book_id = ? AND format = ?", book.ID, format.Name).First(&bookFile)
+	filePath, modtime := servedFilePath(book, bookFile)
+	f, err := os.Open(filePath)
+	if err != nil {
+		http.NotFound(res, req)
+		return
 	}
+	defer f.Close()
+
+	filename := book.Title + "." + format.Extension
+	res.Header().Set("Content-Type", format.MediaType)
+	res.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	http.ServeContent(res, req, filename, modtime, f)
+}
 
+func downloadFormatHandler(res http.ResponseWriter, req *http.Request) {
+	var book Book
+	var bookFile BookFile
+
+	vars := mux.Vars(req)
 	bookID, _ := strconv.ParseInt(vars["id"], 10, 64)
 
 	db.Find(&book, bookID)
+	db.Where("book_id = ? AND format = ?", bookID, vars["format"]).First(&bookFile)
+	if book.ID == 0 || bookFile.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
 
-	f, _ := os.Open(book.FilePath())
+	filePath, modtime := servedFilePath(book, bookFile)
+	f, err := os.Open(filePath)
+	if err != nil {
+		http.NotFound(res, req)
+		return
+	}
+	defer f.Close()
 
-	res.Header().Set("Content-Disposition", "attachment; filename=\""+book.Title+".epub\"")
-	http.ServeContent(res, req, book.Title+".epub", book.UpdatedAt, f)
+	filename := book.Title + "." + formatByName(bookFile.Format).Extension
+	res.Header().Set("Content-Type", bookFile.MediaType)
+	res.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	http.ServeContent(res, req, filename, modtime, f)
 }
 
 func editBookHandler(res http.ResponseWriter, req *http.Request) {
@@ -958,21 +1148,12 @@ func editBookHandler(res http.ResponseWriter, req *http.Request) {
 	var bookTemplate *template.Template
 	var tagsObjs []Tag
 	var tagObj Tag
-	var authorStruct Author
 	var authors []Author
 	var serverOption ServerOption
 
 	vars := mux.Vars(req)
 	db.First(&serverOption)
 
-	if serverOption.Password != "" && (vars["format"] == "html") {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
-		}
-	}
-
 	bookID, _ := strconv.ParseInt(vars["id"], 10, 64)
 
 	db.Preload("Authors").Find(&book, bookID)
@@ -983,44 +1164,71 @@ func editBookHandler(res http.ResponseWriter, req *http.Request) {
 		book.Isbn = req.FormValue("isbn")
 		book.Publisher = req.FormValue("publisher")
 		book.Collection = req.FormValue("collection")
+		book.PublishedAt = nil
+		if published, err := time.Parse("2006-01-02", req.FormValue("published")); err == nil {
+			book.PublishedAt = &published
+		}
 		book.Serie = req.FormValue("serie")
 		num := req.FormValue("serie_number")
 		numF, errF := strconv.ParseFloat(num, 32)
 		if errF == nil && numF != 0 {
 			book.SerieNumber = float32(numF)
 		}
+		book.linkSeries()
 
 		db.Unscoped().Where("book_id = ?", book.ID).Delete(BookTag{})
 		tags := strings.Split(req.FormValue("tags"), ",")
 		for _, tag := range tags {
-			tagObj = Tag{}
-			db.FirstOrCreate(&tagObj, Tag{Name: tag})
-			tagsObjs = append(tagsObjs, tagObj)
+			if tagObj = findOrCreateTag(tag); tagObj.ID != 0 {
+				tagsObjs = append(tagsObjs, tagObj)
+			}
 		}
 		book.Tags = tagsObjs
 
-		author := req.FormValue("author")
-		fmt.Println("author " + author)
-		if author != "" {
-			db.Where("name = ? ", author).Find(&authorStruct)
-			if authorStruct.ID == 0 {
-				authorStruct.Name = author
-				db.Save(&authorStruct)
+		for _, author := range req.Form["author"] {
+			if strings.TrimSpace(author) != "" {
+				authors = append(authors, findOrCreateAuthor(author, ""))
 			}
-			authors = append(authors, authorStruct)
 		}
 		db.Model(&book).Association("Authors").Clear()
 		book.Authors = authors
 
+		book.Edited = true
 		db.Save(&book)
+
+		cover, err := uploadedCover(req)
+		if err == nil && len(cover) > 0 {
+			err = book.replaceCover(cover)
+		}
+		if err != nil {
+			http.Error(res, "Error saving cover: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Redirect(res, req, "/books/"+vars["id"]+".html", http.StatusTemporaryRedirect)
 	} else {
-		bookTemplate = template.Must(layout.Clone())
+		bookTemplate = template.Must(layout.Clone()).Funcs(csrfFuncs(req))
 		templateFile, _ := pkger.Open("/template/book_edit.html")
 		templateData, _ := ioutil.ReadAll(templateFile)
 		bookTemplate = template.Must(bookTemplate.Parse(string(templateData)))
+		content := struct {
+			Book
+			Query      MetadataQuery
+			Lookup     bool
+			Choices    []MetadataChoice
+			LookupErrs []error
+		}{Book: book, Query: lookupQuery(book)}
+		// the lookup is made with the values of the search form, by default the book ones
+		if req.FormValue("lookup") != "" {
+			content.Lookup = true
+			content.Query = MetadataQuery{
+				Isbn:   normalizeIsbn(req.FormValue("lookup_isbn")),
+				Title:  strings.TrimSpace(req.FormValue("lookup_title")),
+				Author: strings.TrimSpace(req.FormValue("lookup_author")),
+			}
+			content.Choices, content.LookupErrs = metadataChoices(book, content.Query)
+		}
 		bookTemplate.Execute(res, Page{
-			Content: book,
+			Content: content,
 			Title:   serverOption.Name,
 		})
 	}
@@ -1032,41 +1240,36 @@ func newBookHandler(res http.ResponseWriter, req *http.Request) {
 	var serverOption ServerOption
 
 	db.First(&serverOption)
-	if serverOption.Password != "" {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
-		}
-	}
 
 	if req.Method == http.MethodPost {
-		infile, header, err := req.FormFile("book")
+		filePath, err := saveUpload(req, "book")
 		if err != nil {
-			http.Error(res, "Error parsing uploaded file: "+err.Error(), http.StatusBadRequest)
+			http.Error(res, "Error saving file: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		outfile, err := os.Create("/tmp/" + header.Filename)
-		if err != nil {
-			http.Error(res, "Error saving file: "+err.Error(), http.StatusBadRequest)
+		var book Book
+		bookID, _ := strconv.ParseInt(req.FormValue("book_id"), 10, 64)
+		if bookID == 0 {
+			enqueueJob(jobImport, filePath, 0)
+			res.Header().Set("Location", "/jobs.html")
+			res.WriteHeader(302)
 			return
 		}
 
-		_, err = io.Copy(outfile, infile)
-		if err != nil {
-			http.Error(res, "Error saving file: "+err.Error(), http.StatusBadRequest)
+		db.Find(&book, bookID)
+		if book.ID == 0 {
+			os.RemoveAll(filepath.Dir(filePath))
+			http.NotFound(res, req)
 			return
 		}
-		outfile.Close()
-
-		book := importFile("/tmp/" + header.Filename)
+		enqueueJob(jobAttach, filePath, book.ID)
 
 		idStr := strconv.Itoa(int(book.ID))
 		res.Header().Set("Location", "/books/"+idStr+".html")
 		res.WriteHeader(302)
 	} else {
-		bookTemplate = template.Must(layout.Clone())
+		bookTemplate = template.Must(layout.Clone()).Funcs(csrfFuncs(req))
 		templateFile, _ := pkger.Open("/template/book_new.html")
 		templateData, _ := ioutil.ReadAll(templateFile)
 		bookTemplate = template.Must(bookTemplate.Parse(string(templateData)))
@@ -1075,68 +1278,95 @@ func newBookHandler(res http.ResponseWriter, req *http.Request) {
 
 }
 
-func importFile(filePath string) Book {
-	var book Book
-
-	book.Edited = false
-	db.Save(&book)
+func attachFile(filePath string, book *Book) (BookFile, error) {
+	format, err := detectFormat(filePath)
+	if err != nil {
+		return BookFile{}, err
+	}
 
-	moveEpub(filePath, &book)
-	book.getMetada()
-	return book
+	return storeBookFile(filePath, book, format)
 }
 
-func moveEpub(filepath string, book *Book) {
+// storeBookFile copy the file in the book directory and record it, replacing a previous file in the same format
+func storeBookFile(filePath string, book *Book, format Format) (BookFile, error) {
+	var bookFile BookFile
 
-	bookIDStr := strconv.Itoa(int(book.ID))
-	epubDirPath := "public/books/" + bookIDStr
-	epubFilePath := epubDirPath + "/" + bookIDStr + ".epub"
+	db.Where("book_id = ? AND format = ?", book.ID, format.Name).First(&bookFile)
+	if err := copyBookFile(filePath, book, format, &bookFile); err != nil {
+		return BookFile{}, err
+	}
+	db.Save(&bookFile)
 
-	_, err := os.Open(epubFilePath)
-	if os.IsNotExist(err) {
+	return bookFile, nil
+}
 
-		os.MkdirAll(epubDirPath, os.ModePerm)
-		infile, err := os.Open(filepath)
-		if err != nil {
-			return
-		}
-		outfile, err := os.Create(epubFilePath)
-		if err != nil {
-			// http.Error(res, "Error saving file: "+err.Error(), http.StatusBadRequest)
-			return
-		}
+// copyBookFile copy the file in the book directory and fill bookFile, it is not saved
+func copyBookFile(filePath string, book *Book, format Format, bookFile *BookFile) error {
+	bookDirPath := "public/books/" + strconv.Itoa(int(book.ID))
+	bookFilePath := book.filePathFor(format)
 
-		_, err = io.Copy(outfile, infile)
-		if err != nil {
-			// http.Error(res, "Error saving file: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-		outfile.Close()
+	os.MkdirAll(bookDirPath, os.ModePerm)
+	infile, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer infile.Close()
 
+	outfile, err := os.Create(bookFilePath)
+	if err != nil {
+		return err
 	}
+	defer outfile.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(outfile, hash), infile)
+	if err != nil {
+		return err
+	}
+
+	bookFile.BookID = book.ID
+	bookFile.Format = format.Name
+	bookFile.MediaType = format.MediaType
+	bookFile.Size = size
+	bookFile.Checksum = hex.EncodeToString(hash.Sum(nil))
+	bookFile.Path = bookFilePath
+	bookFile.DocumentHash = partialMD5(bookFilePath)
+	return nil
 }
 
-func tagsListHandler(res http.ResponseWriter, req *http.Request) {
-	var tags []Tag
-	var serverOption ServerOption
+// migrateBookFiles record the file of books imported before multiple formats
+func migrateBookFiles() {
+	var books []Book
 
-	db.First(&serverOption)
-	if serverOption.Password != "" {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
+	db.Where("id NOT IN (SELECT book_id FROM book_files WHERE deleted_at IS NULL)").Find(&books)
+	for _, book := range books {
+		format := book.fileFormat()
+		info, err := os.Stat(book.FilePath())
+		if err != nil {
+			continue
 		}
+		db.Save(&BookFile{
+			BookID:    book.ID,
+			Format:    format.Name,
+			MediaType: format.MediaType,
+			Size:      info.Size(),
+			Checksum:  fileChecksum(book.FilePath()),
+			Path:      book.FilePath(),
+		})
 	}
+}
 
-	db.Order("name asc").Find(&tags)
-
-	tagsTemplate := template.Must(layout.Clone())
-	templateFile, _ := pkger.Open("/template/tags_list.html")
-	templateData, _ := ioutil.ReadAll(templateFile)
-	tagsTemplate = template.Must(tagsTemplate.Parse(string(templateData)))
-	tagsTemplate.Execute(res, Page{Content: tags, Title: serverOption.Name})
+// fileChecksum return the sha256 of the file content
+func fileChecksum(filePath string) string {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
 
+	hash := sha256.New()
+	io.Copy(hash, f)
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
 func tagsCompletionHandler(res http.ResponseWriter, req *http.Request) {
@@ -1158,14 +1388,11 @@ func tagsCompletionHandler(res http.ResponseWriter, req *http.Request) {
 func settingsHandler(res http.ResponseWriter, req *http.Request) {
 	var serverOption ServerOption
 
-	db.First(&serverOption)
-	if serverOption.Password != "" {
-		if !checkAuth(req) {
-			res.Header().Set("Location", "/login.html")
-			res.WriteHeader(302)
-			return
-		}
+	if !currentUser(req).Admin {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
 	}
+	db.First(&serverOption)
 
 	if req.Method == http.MethodPost {
 
@@ -1178,15 +1405,48 @@ func settingsHandler(res http.ResponseWriter, req *http.Request) {
 		if err == nil {
 			serverOption.Port = port
 		}
-		serverOption.Password = req.FormValue("password")
-		serverOption.Token = req.FormValue("token")
+		inbox := serverOption.InboxDir
+		serverOption.InboxDir = strings.TrimSpace(req.FormValue("inbox_dir"))
+		switch req.FormValue("duplicate_policy") {
+		case duplicateSkip, duplicateMerge, duplicateImport:
+			serverOption.DuplicatePolicy = req.FormValue("duplicate_policy")
+		}
+		workers, err := strconv.Atoi(req.FormValue("job_workers"))
+		if err == nil && workers > 0 {
+			serverOption.JobWorkers = workers
+		}
+		serverOption.EmbedMetadata = req.FormValue("embed_metadata") == "on"
+		serverOption.SMTPHost = strings.TrimSpace(req.FormValue("smtp_host"))
+		smtpPort, err := strconv.Atoi(req.FormValue("smtp_port"))
+		if err == nil && smtpPort > 0 {
+			serverOption.SMTPPort = smtpPort
+		}
+		serverOption.SMTPUser = req.FormValue("smtp_user")
+		// the password is not shown, an empty field keep it
+		if req.FormValue("smtp_password") != "" {
+			serverOption.SMTPPassword = req.FormValue("smtp_password")
+		}
+		serverOption.SMTPFrom = strings.TrimSpace(req.FormValue("smtp_from"))
+		threshold, err := strconv.Atoi(req.FormValue("read_threshold"))
+		if err == nil && threshold >= 0 && threshold <= 100 {
+			serverOption.ReadThreshold = threshold
+		}
+		separator := strings.TrimSpace(req.FormValue("tag_separator"))
+		changedSeparator := separator != serverOption.TagSeparator
+		serverOption.TagSeparator = separator
 
 		db.Save(&serverOption)
+		if changedSeparator {
+			setupTags()
+		}
+		if serverOption.InboxDir != inbox {
+			startInbox(serverOption.InboxDir)
+		}
 		res.Header().Set("Location", "/index.html")
 		res.WriteHeader(302)
 	} else {
 
-		settingTemplate := template.Must(layout.Clone())
+		settingTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
 		templateFile, _ := pkger.Open("/template/settings.html")
 		templateData, _ := ioutil.ReadAll(templateFile)
 		settingTemplate = template.Must(settingTemplate.Parse(string(templateData)))
@@ -1195,36 +1455,42 @@ func settingsHandler(res http.ResponseWriter, req *http.Request) {
 
 }
 
-func checkAuth(req *http.Request) bool {
-	session := sessions.GetSession(req)
-	auth := session.Get("auth")
-	fmt.Println("AUTH : ")
-	fmt.Println(auth)
-	if auth == "OK" {
-		return true
-	}
-	return false
-}
-
 func loginHandler(res http.ResponseWriter, req *http.Request) {
-	var serverOption ServerOption
-
-	db.First(&serverOption)
+	var user User
 
 	if req.Method == http.MethodPost {
 
+		name := req.FormValue("name")
 		password := req.FormValue("password")
 
-		if password == serverOption.Password {
-			session := sessions.GetSession(req)
-			session.Set("auth", "OK")
-			fmt.Println("set auth")
+		if loginBlocked(req) {
+			http.Error(res, "Trop de tentatives, réessayez plus tard", http.StatusTooManyRequests)
+			return
+		}
+
+		db.Where("name = ?", name).First(&user)
+		if user.ID == 0 || !user.CheckPassword(password) {
+			loginFailed(req)
+			res.Header().Set("Location", "/login.html")
+			res.WriteHeader(302)
+			return
+		}
+		loginSucceeded(req)
+		if user.SyncKeyHash == "" {
+			// accounts created before the KOReader sync get their key on next login
+			user.SetPassword(password)
+			db.Save(&user)
 		}
 
+		session := sessions.GetSession(req)
+		session.Set("user_id", user.ID)
+		// new token after login
+		session.Set(csrfField, randomHex(32))
+
 		res.Header().Set("Location", "/index.html")
 		res.WriteHeader(302)
 	} else {
-		settingTemplate := template.Must(layout.Clone())
+		settingTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
 		templateFile, _ := pkger.Open("/template/login.html")
 		templateData, _ := ioutil.ReadAll(templateFile)
 		settingTemplate = template.Must(settingTemplate.Parse(string(templateData)))
@@ -1236,17 +1502,3 @@ func loginHandler(res http.ResponseWriter, req *http.Request) {
 func escape(s string) string {
 	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
 }
-
-func tagDelete(res http.ResponseWriter, req *http.Request) {
-	var tag Tag
-
-	vars := mux.Vars(req)
-	tagID, _ := strconv.ParseInt(vars["id"], 10, 64)
-
-	db.First(&tag, tagID)
-
-	if tag.ID != 0 {
-		db.Delete(&tag)
-	}
-	http.Redirect(res, req, "/tags_list.html", http.StatusTemporaryRedirect)
-}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/beevik/etree"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+)
+
+// Shelf store a list of books made by a user, a smart shelf list the books matching its saved filters
+type Shelf struct {
+	gorm.Model
+	UserID      uint `gorm:"index"`
+	Name        string
+	Description string
+	// Public shelves are shown to every user and in their OPDS catalog
+	Public bool
+	Smart  bool
+	// Query is the query string of the filters of a smart shelf, like tag=Roman&filter=notread&order=new
+	Query string
+	Count int    `gorm:"-"`
+	Owner string `gorm:"-"`
+}
+
+// ShelfBook store a book of a manual shelf with its position
+type ShelfBook struct {
+	gorm.Model
+	ShelfID  uint `gorm:"index"`
+	BookID   uint `gorm:"index"`
+	Position int
+}
+
+// ShelfEntry is a book of a shelf with its position on the page
+type ShelfEntry struct {
+	Book
+	Position int
+}
+
+// shelfFilters are the keys of the book filters a smart shelf can save
+var shelfFilters = []string{"q", "tag", "author", "serie", "language", "publisher", "filter", "order", "dir"}
+
+// Filters return the saved filters of a smart shelf
+func (shelf Shelf) Filters() url.Values {
+	values, _ := url.ParseQuery(shelf.Query)
+	return values
+}
+
+// Filter return one saved filter of a smart shelf
+func (shelf Shelf) Filter(key string) string {
+	return shelf.Filters().Get(key)
+}
+
+// URL return the page of the shelf
+func (shelf Shelf) URL() string {
+	return "/shelves/" + strconv.Itoa(int(shelf.ID)) + ".html"
+}
+
+// shelfQuery keep the filters of a smart shelf sent in the form
+func shelfQuery(form url.Values) string {
+	values := url.Values{}
+	for _, key := range shelfFilters {
+		if value := strings.TrimSpace(form.Get(key)); value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values.Encode()
+}
+
+// visibleShelves return the shelves of the user and the public shelves of the others, with their number of books
+func visibleShelves(userID uint) []Shelf {
+	var shelves []Shelf
+	var users []User
+	var counts []struct {
+		ShelfID uint
+		Count   int
+	}
+
+	db.Where("user_id = ? OR public = ?", userID, true).Order("name COLLATE NOCASE asc").Find(&shelves)
+
+	db.Table("shelf_books").Select("shelf_books.shelf_id, count(books.id) AS count").
+		Joins("INNER JOIN books ON books.id = shelf_books.book_id AND books.deleted_at IS NULL").
+		Where("shelf_books.deleted_at IS NULL").Group("shelf_books.shelf_id").Scan(&counts)
+	manual := map[uint]int{}
+	for _, count := range counts {
+		manual[count.ShelfID] = count.Count
+	}
+	db.Find(&users)
+	names := map[uint]string{}
+	for _, user := range users {
+		names[user.ID] = user.Name
+	}
+
+	for i := range shelves {
+		shelves[i].Owner = names[shelves[i].UserID]
+		if shelves[i].Smart {
+			// the filters depend on the user, like the books not read
+			_, shelves[i].Count = bookList(shelves[i].Filters(), userID, 0, 0)
+		} else {
+			shelves[i].Count = manual[shelves[i].ID]
+		}
+	}
+	return shelves
+}
+
+// shelfBooks return a page of the books of the shelf, in the shelf order or the order of the filters
+func shelfBooks(shelf Shelf, userID uint, limit int, offset int) ([]Book, int) {
+	var books []Book
+	var count int
+
+	if shelf.Smart {
+		return bookList(shelf.Filters(), userID, limit, offset)
+	}
+	query := db.Model(&Book{}).
+		Joins("INNER JOIN shelf_books ON shelf_books.book_id = books.id AND shelf_books.deleted_at IS NULL").
+		Where("shelf_books.shelf_id = ?", shelf.ID)
+	query.Count(&count)
+	query.Order("shelf_books.position asc, shelf_books.id asc").Limit(limit).Offset(offset).Preload("Authors").Find(&books)
+	return books, count
+}
+
+// catalogEntry return the entry of the shelf in the navigation feed
+func (shelf Shelf) catalogEntry() CatalogEntry {
+	content := strconv.Itoa(shelf.Count) + " livres"
+	if shelf.Description != "" {
+		content = shelf.Description + " (" + content + ")"
+	}
+	return CatalogEntry{
+		ID:      "urn:myopds:shelf:" + strconv.Itoa(int(shelf.ID)),
+		Title:   shelf.Name,
+		Content: content,
+		Path:    "/shelves/" + strconv.Itoa(int(shelf.ID)),
+		Kind:    "acquisition",
+		Rel:     "subsection",
+		Count:   shelf.Count,
+	}
+}
+
+// findOrCreateShelf return the manual shelf of the user with this name
+func findOrCreateShelf(userID uint, name string) Shelf {
+	var shelf Shelf
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return shelf
+	}
+	db.Where("user_id = ? AND name = ? AND smart = ?", userID, name, false).First(&shelf)
+	if shelf.ID == 0 {
+		shelf.UserID = userID
+		shelf.Name = name
+		db.Save(&shelf)
+	}
+	return shelf
+}
+
+// addToShelf put the book at the end of the shelf, it return false when the book is already on it
+func addToShelf(tx *gorm.DB, shelf Shelf, bookID uint) (bool, error) {
+	var count int
+	var last struct {
+		Position int
+	}
+
+	tx.Model(&ShelfBook{}).Where("shelf_id = ? AND book_id = ?", shelf.ID, bookID).Count(&count)
+	if count > 0 {
+		return false, nil
+	}
+	tx.Model(&ShelfBook{}).Select("IFNULL(MAX(position), 0) AS position").Where("shelf_id = ?", shelf.ID).Scan(&last)
+	return true, tx.Create(&ShelfBook{ShelfID: shelf.ID, BookID: bookID, Position: last.Position + 1}).Error
+}
+
+// requestShelf return the shelf of the route if the user can see it, and if the user can change it
+func requestShelf(req *http.Request) (Shelf, bool) {
+	var shelf Shelf
+
+	vars := mux.Vars(req)
+	shelfID, _ := strconv.ParseInt(vars["id"], 10, 64)
+	user := currentUser(req)
+
+	db.First(&shelf, shelfID)
+	if shelf.ID == 0 || (shelf.UserID != user.ID && !shelf.Public) {
+		return Shelf{}, false
+	}
+	return shelf, shelf.UserID == user.ID
+}
+
+// shelvesHandler list the shelves the user can see or create one
+func shelvesHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	vars := mux.Vars(req)
+	token := req.URL.Query().Get("token")
+	user := currentUser(req)
+
+	if req.Method == http.MethodPost {
+		name := strings.TrimSpace(req.FormValue("name"))
+		if name == "" {
+			http.Error(res, "Error creating shelf: name can't be empty", http.StatusBadRequest)
+			return
+		}
+		shelf := Shelf{
+			UserID:      user.ID,
+			Name:        name,
+			Description: strings.TrimSpace(req.FormValue("description")),
+			Public:      req.FormValue("public") == "on",
+			Smart:       req.FormValue("smart") == "on",
+		}
+		if shelf.Smart {
+			shelf.Query = shelfQuery(req.Form)
+		}
+		db.Save(&shelf)
+		http.Redirect(res, req, shelf.URL(), http.StatusFound)
+		return
+	}
+
+	shelves := visibleShelves(user.ID)
+	if vars["format"] == atomExt {
+		res.Header().Set("Content-Type", opdsNavigationType)
+		baseDoc := etree.NewDocument()
+		baseDoc.Indent(2)
+		feed := baseOpds(baseDoc, serverOption.UUID+":shelves", "Étagères", len(shelves), 0, 0, RootURL(req), req.URL.String(), "/index.atom", "", "", opdsNavigationType, token)
+		for _, shelf := range shelves {
+			navigationEntryOpds(feed, shelf.catalogEntry(), RootURL(req), token)
+		}
+		xmlString, _ := baseDoc.WriteToString()
+		fmt.Fprintf(res, xmlString)
+	} else if vars["format"] == jsonExt {
+		feed := baseOpds2(serverOption.UUID+":shelves", "Étagères", len(shelves), 0, 1, RootURL(req)+req.URL.String(), "", "", "", "", token)
+		for _, shelf := range shelves {
+			feed.Navigation = append(feed.Navigation, navigationLinkOpds2(shelf.catalogEntry(), RootURL(req), token))
+		}
+		writeOpds2(res, opds2MediaType, feed)
+	} else {
+		shelvesTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+		templateFile, _ := pkger.Open("/template/shelves.html")
+		templateData, _ := ioutil.ReadAll(templateFile)
+		shelvesTemplate = template.Must(shelvesTemplate.Parse(string(templateData)))
+		shelvesTemplate.Execute(res, Page{Content: struct {
+			Shelves []Shelf
+			Sorts   []BookSort
+			Reads   interface{}
+		}{shelves, bookSorts, readFacets}, Title: serverOption.Name})
+	}
+}
+
+// shelfHandler serve the books of a shelf as a page or an acquisition feed
+func shelfHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+	var pageInt = 1
+
+	db.First(&serverOption)
+	vars := mux.Vars(req)
+	token := req.URL.Query().Get("token")
+	user := currentUser(req)
+
+	shelf, owner := requestShelf(req)
+	if shelf.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+
+	if page := req.URL.Query().Get("page"); page != "" {
+		pageInt, _ = strconv.Atoi(page)
+		if pageInt < 1 {
+			pageInt = 1
+		}
+	}
+	limit := serverOption.NumberBookPerPage
+	offset := limit * (pageInt - 1)
+	if vars["format"] != atomExt && vars["format"] != jsonExt {
+		// the page show the whole shelf to order it
+		limit = -1
+		offset = -1
+	}
+	books, count := shelfBooks(shelf, user.ID, limit, offset)
+	firstLink, prevLink, nextLink, lastLink := paginationLinks(req.URL, pageInt, serverOption.NumberBookPerPage, count)
+
+	if vars["format"] == atomExt {
+		res.Header().Set("Content-Type", opdsAcquisitionType)
+		baseDoc := etree.NewDocument()
+		baseDoc.Indent(2)
+		feed := baseOpds(baseDoc, "urn:myopds:shelf:"+strconv.Itoa(int(shelf.ID)), shelf.Name, count, limit, offset+1, RootURL(req), req.URL.String(), "/shelves.atom", prevLink, nextLink, opdsAcquisitionType, token)
+		for _, book := range books {
+			entryOpds(&book, feed, RootURL(req), token)
+		}
+		xmlString, _ := baseDoc.WriteToString()
+		fmt.Fprintf(res, xmlString)
+	} else if vars["format"] == jsonExt {
+		feed := baseOpds2("urn:myopds:shelf:"+strconv.Itoa(int(shelf.ID)), shelf.Name, count, limit, pageInt, RootURL(req)+req.URL.String(), prevLink, nextLink, firstLink, lastLink, token)
+		feed.Publications = []Opds2Publication{}
+		for _, book := range books {
+			feed.Publications = append(feed.Publications, publicationOpds2(&book, RootURL(req), token))
+		}
+		writeOpds2(res, opds2MediaType, feed)
+	} else {
+		loadUserStates(books, user.ID)
+		shelf.Count = count
+		entries := make([]ShelfEntry, len(books))
+		for i, book := range books {
+			entries[i] = ShelfEntry{book, i + 1}
+		}
+
+		shelfTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+		templateFile, _ := pkger.Open("/template/shelf.html")
+		templateData, _ := ioutil.ReadAll(templateFile)
+		shelfTemplate = template.Must(shelfTemplate.Parse(string(templateData)))
+		shelfTemplate.Execute(res, Page{Content: struct {
+			Shelf Shelf
+			Books []ShelfEntry
+			Owner bool
+			Sorts []BookSort
+			Reads interface{}
+		}{shelf, entries, owner, bookSorts, readFacets}, Title: serverOption.Name})
+	}
+}
+
+// shelfEditHandler change the shelf, the books of a manual shelf are ordered by the positions sent and can be removed
+func shelfEditHandler(res http.ResponseWriter, req *http.Request) {
+	shelf, owner := requestShelf(req)
+	if shelf.ID == 0 || !owner {
+		http.NotFound(res, req)
+		return
+	}
+
+	req.ParseForm()
+	if name := strings.TrimSpace(req.FormValue("name")); name != "" {
+		shelf.Name = name
+	}
+	shelf.Description = strings.TrimSpace(req.FormValue("description"))
+	shelf.Public = req.FormValue("public") == "on"
+	if shelf.Smart {
+		shelf.Query = shelfQuery(req.Form)
+	}
+
+	tx := db.Begin()
+	tx.Save(&shelf)
+	if !shelf.Smart {
+		removed := map[string]bool{}
+		for _, value := range req.Form["remove"] {
+			removed[value] = true
+		}
+		positions := req.Form["positions"]
+		for i, value := range req.Form["books"] {
+			if removed[value] {
+				tx.Unscoped().Where("shelf_id = ? AND book_id = ?", shelf.ID, value).Delete(ShelfBook{})
+				continue
+			}
+			position := i + 1
+			if i < len(positions) {
+				if number, err := strconv.Atoi(strings.TrimSpace(positions[i])); err == nil {
+					position = number
+				}
+			}
+			tx.Model(&ShelfBook{}).Where("shelf_id = ? AND book_id = ?", shelf.ID, value).UpdateColumn("position", position)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(res, req, shelf.URL(), http.StatusFound)
+}
+
+func shelfDeleteHandler(res http.ResponseWriter, req *http.Request) {
+	shelf, owner := requestShelf(req)
+	if shelf.ID == 0 || !owner {
+		http.NotFound(res, req)
+		return
+	}
+
+	db.Unscoped().Where("shelf_id = ?", shelf.ID).Delete(ShelfBook{})
+	db.Delete(&shelf)
+	http.Redirect(res, req, "/shelves.html", http.StatusFound)
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+)
+
+// TagAlias store another name of a tag, a book imported with this tag get the tag instead
+type TagAlias struct {
+	gorm.Model
+	TagID uint   `gorm:"index"`
+	Name  string `gorm:"unique_index"`
+}
+
+// TagCount is a tag with the number of books of the tag and its sub tags
+type TagCount struct {
+	Tag
+	Count int
+	// Children is the number of direct sub tags
+	Children int
+	Label    string     `gorm:"-"`
+	Depth    int        `gorm:"-"`
+	Aliases  []TagAlias `gorm:"-"`
+}
+
+// tagMutex avoid two import jobs creating the same tag
+var tagMutex sync.Mutex
+
+// tagSeparator return the separator of the tag levels, empty when tags are flat
+func tagSeparator() string {
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	return strings.TrimSpace(serverOption.TagSeparator)
+}
+
+// tagJoin is written between the levels of a tag name
+func tagJoin(separator string) string {
+	return " " + separator + " "
+}
+
+// tagSegments split a tag name in the names of its levels
+func tagSegments(name string, separator string) []string {
+	var segments []string
+
+	parts := []string{name}
+	if separator != "" {
+		parts = strings.Split(name, separator)
+	}
+	for _, part := range parts {
+		if part = strings.Join(strings.Fields(part), " "); part != "" {
+			segments = append(segments, part)
+		}
+	}
+	return segments
+}
+
+// tagLabel return the last level of the tag name
+func tagLabel(name string, separator string) string {
+	segments := tagSegments(name, separator)
+	if len(segments) == 0 {
+		return name
+	}
+	return segments[len(segments)-1]
+}
+
+// isSubTag return true when name is under the parent tag
+func isSubTag(name string, parent string, separator string) bool {
+	return separator != "" && strings.HasPrefix(name, parent+tagJoin(separator))
+}
+
+// findOrCreateTag return the tag with this name or alias, the parent tags are created too
+func findOrCreateTag(name string) Tag {
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+
+	separator := tagSeparator()
+	segments := tagSegments(name, separator)
+	if len(segments) == 0 {
+		return Tag{}
+	}
+	return createTag(segments, separator)
+}
+
+func createTag(segments []string, separator string) Tag {
+	var tag Tag
+	var alias TagAlias
+
+	db.Where("name = ? COLLATE NOCASE", strings.Join(segments, tagJoin(separator))).First(&alias)
+	if alias.ID != 0 {
+		db.First(&tag, alias.TagID)
+		if tag.ID != 0 {
+			return tag
+		}
+	}
+
+	parent, name := tagPlace(segments, separator)
+	db.Where("name = ? COLLATE NOCASE", name).First(&tag)
+	if tag.ID == 0 {
+		tag.Name = name
+		tag.ParentID = parent.ID
+		db.Save(&tag)
+	}
+	return tag
+}
+
+// tagPlace return the parent of the tag, created if needed, and its full name under the parent
+func tagPlace(segments []string, separator string) (Tag, string) {
+	var parent Tag
+
+	last := segments[len(segments)-1]
+	if len(segments) == 1 {
+		return parent, last
+	}
+	// the parent can be an alias, the name follow the real parent
+	parent = createTag(segments[:len(segments)-1], separator)
+	return parent, parent.Name + tagJoin(separator) + last
+}
+
+// setupTags split the tags in levels and link them to their parent, tags written the same way are merged
+func setupTags() {
+	var tagIDs []uint
+
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+
+	separator := tagSeparator()
+	db.Model(&Tag{}).Order("id asc").Pluck("id", &tagIDs)
+	for _, tagID := range tagIDs {
+		var tag Tag
+		var existing Tag
+
+		// a previous merge can have removed the tag
+		db.First(&tag, tagID)
+		segments := tagSegments(tag.Name, separator)
+		if tag.ID == 0 || len(segments) == 0 {
+			continue
+		}
+		parent, name := tagPlace(segments, separator)
+		if name == tag.Name && parent.ID == tag.ParentID {
+			continue
+		}
+		db.Where("name = ? COLLATE NOCASE AND id <> ?", name, tag.ID).First(&existing)
+		if existing.ID != 0 {
+			mergeTagInto(existing, tag, separator)
+			continue
+		}
+		tag.Name = name
+		tag.ParentID = parent.ID
+		db.Save(&tag)
+		reindexTagBooks(tag.ID)
+	}
+}
+
+// renameTag change the name of the tag and of its sub tags, renaming to an existing tag merge them
+func renameTag(tag Tag, name string) (Tag, error) {
+	var existing Tag
+
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+
+	separator := tagSeparator()
+	segments := tagSegments(name, separator)
+	if len(segments) == 0 {
+		return tag, errors.New("name can't be empty")
+	}
+	name = strings.Join(segments, tagJoin(separator))
+	if isSubTag(name, tag.Name, separator) {
+		return tag, errors.New("a tag can't be moved under itself")
+	}
+
+	db.Where("name = ? COLLATE NOCASE AND id <> ?", name, tag.ID).First(&existing)
+	if existing.ID != 0 {
+		if isSubTag(existing.Name, tag.Name, separator) {
+			return tag, errors.New("a tag can't be merged in its sub tag")
+		}
+		mergeTagInto(existing, tag, separator)
+		return existing, nil
+	}
+	return moveTag(tag, segments, separator), nil
+}
+
+// moveTag give the tag the name of the levels, the old name become an alias
+func moveTag(tag Tag, segments []string, separator string) Tag {
+	var children []Tag
+
+	parent, name := tagPlace(segments, separator)
+	if name != tag.Name {
+		db.Unscoped().Where("name = ?", tag.Name).Delete(TagAlias{})
+		db.Save(&TagAlias{TagID: tag.ID, Name: tag.Name})
+	}
+	db.Unscoped().Where("name = ?", name).Delete(TagAlias{})
+	tag.Name = name
+	tag.ParentID = parent.ID
+	db.Save(&tag)
+	reindexTagBooks(tag.ID)
+
+	// the sub tags follow their parent
+	db.Where("parent_id = ?", tag.ID).Find(&children)
+	for _, child := range children {
+		var existing Tag
+
+		childSegments := append(tagSegments(tag.Name, separator), tagLabel(child.Name, separator))
+		db.Where("name = ? COLLATE NOCASE AND id <> ?", strings.Join(childSegments, tagJoin(separator)), child.ID).First(&existing)
+		if existing.ID != 0 {
+			mergeTagInto(existing, child, separator)
+		} else {
+			moveTag(child, childSegments, separator)
+		}
+	}
+	return tag
+}
+
+// mergeTags move the books and sub tags of other to keep, the name of other become an alias of keep
+func mergeTags(keep Tag, other Tag) error {
+	tagMutex.Lock()
+	defer tagMutex.Unlock()
+
+	separator := tagSeparator()
+	if keep.ID == other.ID {
+		return nil
+	}
+	if isSubTag(keep.Name, other.Name, separator) {
+		return errors.New("a tag can't be merged in its sub tag")
+	}
+	mergeTagInto(keep, other, separator)
+	return nil
+}
+
+func mergeTagInto(keep Tag, other Tag, separator string) {
+	var children []Tag
+
+	// a book with both tags keep only one link
+	db.Exec("DELETE FROM book_tags WHERE tag_id = ? AND book_id IN (SELECT book_id FROM book_tags WHERE tag_id = ?)", other.ID, keep.ID)
+	db.Exec("UPDATE book_tags SET tag_id = ? WHERE tag_id = ?", keep.ID, other.ID)
+	db.Model(&TagAlias{}).Where("tag_id = ?", other.ID).Update("tag_id", keep.ID)
+	db.Unscoped().Where("name = ?", other.Name).Delete(TagAlias{})
+	db.Save(&TagAlias{TagID: keep.ID, Name: other.Name})
+
+	db.Where("parent_id = ?", other.ID).Find(&children)
+	for _, child := range children {
+		var existing Tag
+
+		segments := append(tagSegments(keep.Name, separator), tagLabel(child.Name, separator))
+		db.Where("name = ? COLLATE NOCASE AND id <> ?", strings.Join(segments, tagJoin(separator)), child.ID).First(&existing)
+		if existing.ID != 0 {
+			mergeTagInto(existing, child, separator)
+		} else {
+			moveTag(child, segments, separator)
+		}
+	}
+
+	db.Delete(&other)
+	reindexTagBooks(keep.ID)
+}
+
+// deleteTag delete the tag with its sub tags and their aliases, the books are kept
+func deleteTag(tag Tag) {
+	var tags []Tag
+
+	separator := tagSeparator()
+	db.Where("id = ?", tag.ID).Or("? <> '' AND substr(name, 1, ?) = ?", separator, utf8.RuneCountInString(tag.Name+tagJoin(separator)), tag.Name+tagJoin(separator)).Find(&tags)
+	for _, sub := range tags {
+		db.Unscoped().Where("tag_id = ?", sub.ID).Delete(TagAlias{})
+		db.Delete(&sub)
+	}
+}
+
+// reindexTagBooks update the search index of the books of the tag
+func reindexTagBooks(tagID uint) {
+	var books []Book
+
+	db.Joins("inner join book_tags on book_tags.book_id = books.id").Where("book_tags.tag_id = ?", tagID).Find(&books)
+	for _, book := range books {
+		indexBook(db, &book)
+	}
+}
+
+// tagCounts return the tags ordered by name with the number of books of each tag and its sub tags,
+// parentID limit the list to the sub tags of a tag, 0 to the first level and -1 return all the tags
+func tagCounts(parentID int) []TagCount {
+	var tags []TagCount
+
+	separator := tagSeparator()
+	join := tagJoin(separator)
+	query := db.Table("tags").
+		Select("tags.*, count(DISTINCT books.id) AS count, "+
+			"(SELECT count(*) FROM tags AS child WHERE child.parent_id = tags.id AND child.deleted_at IS NULL) AS children").
+		Joins("LEFT JOIN tags AS sub ON sub.deleted_at IS NULL AND (sub.id = tags.id OR (? <> '' AND substr(sub.name, 1, length(tags.name) + ?) = tags.name || ?))",
+			separator, utf8.RuneCountInString(join), join).
+		Joins("LEFT JOIN book_tags ON book_tags.tag_id = sub.id").
+		Joins("LEFT JOIN books ON books.id = book_tags.book_id AND books.deleted_at IS NULL").
+		Where("tags.deleted_at IS NULL AND tags.name <> ''")
+	if parentID >= 0 {
+		query = query.Where("IFNULL(tags.parent_id, 0) = ?", parentID)
+	}
+	query.Group("tags.id").Order("tags.name COLLATE NOCASE asc").Scan(&tags)
+
+	for i := range tags {
+		tags[i].Label = tagLabel(tags[i].Name, separator)
+		tags[i].Depth = len(tagSegments(tags[i].Name, separator)) - 1
+	}
+	return tags
+}
+
+// tagEntries turn the tags with books into entries, a tag with sub tags lead to their navigation feed
+func tagEntries(tags []TagCount) []CatalogEntry {
+	var entries []CatalogEntry
+
+	for _, tag := range tags {
+		if tag.Count == 0 {
+			continue
+		}
+		entry := CatalogEntry{
+			ID:      "urn:myopds:tag:" + url.QueryEscape(tag.Name),
+			Title:   tag.Label,
+			Content: strconv.Itoa(tag.Count) + " livres",
+			Path:    "/index?tag=" + url.QueryEscape(tag.Name),
+			Kind:    "acquisition",
+			Rel:     "subsection",
+			Count:   tag.Count,
+		}
+		if tag.Children > 0 {
+			entry.Path = "/tags?parent=" + url.QueryEscape(tag.Name)
+			entry.Kind = "navigation"
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// tagsFeedHandler serve the navigation feed of a level of tags, the most used first
+func tagsFeedHandler(res http.ResponseWriter, req *http.Request) {
+	var parent Tag
+	var entries []CatalogEntry
+
+	title := "Tags"
+	id := "tags"
+	if name := req.URL.Query().Get("parent"); name != "" {
+		db.Where("name = ?", name).First(&parent)
+		if parent.ID == 0 {
+			http.NotFound(res, req)
+			return
+		}
+		title = parent.Name
+		id = "tags:" + url.QueryEscape(parent.Name)
+	}
+
+	tags := tagCounts(int(parent.ID))
+	sortTagsByCount(tags)
+	if parent.ID != 0 {
+		var count int
+		db.Model(&Book{}).Scopes(BookwithCat(parent.Name)).Count(&count)
+		entries = append(entries, CatalogEntry{
+			ID:      "urn:myopds:tag:" + url.QueryEscape(parent.Name),
+			Title:   "Tous les livres",
+			Content: strconv.Itoa(count) + " livres",
+			Path:    "/index?tag=" + url.QueryEscape(parent.Name),
+			Kind:    "acquisition",
+			Rel:     "subsection",
+			Count:   count,
+		})
+	}
+	navigationFeedHandler(res, req, id, title, append(entries, tagEntries(tags)...))
+}
+
+// sortTagsByCount order the tags by number of books, then by name
+func sortTagsByCount(tags []TagCount) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].Count > tags[j].Count
+	})
+}
+
+func tagsListHandler(res http.ResponseWriter, req *http.Request) {
+	var serverOption ServerOption
+	var aliases []TagAlias
+
+	db.First(&serverOption)
+
+	tags := tagCounts(-1)
+	db.Order("name asc").Find(&aliases)
+	byTag := map[uint][]TagAlias{}
+	for _, alias := range aliases {
+		byTag[alias.TagID] = append(byTag[alias.TagID], alias)
+	}
+	for i := range tags {
+		tags[i].Aliases = byTag[tags[i].ID]
+	}
+
+	tagsTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+	templateFile, _ := pkger.Open("/template/tags_list.html")
+	templateData, _ := ioutil.ReadAll(templateFile)
+	tagsTemplate = template.Must(tagsTemplate.Parse(string(templateData)))
+	tagsTemplate.Execute(res, Page{Content: tags, Title: serverOption.Name})
+}
+
+// tagEditHandler rename or move the tag and add an alias, renaming to an existing tag merge them
+func tagEditHandler(res http.ResponseWriter, req *http.Request) {
+	var tag Tag
+
+	vars := mux.Vars(req)
+	tagID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.First(&tag, tagID)
+	if tag.ID == 0 {
+		http.NotFound(res, req)
+		return
+	}
+
+	if name := strings.TrimSpace(req.FormValue("name")); name != "" && name != tag.Name {
+		var err error
+		tag, err = renameTag(tag, name)
+		if err != nil {
+			http.Error(res, "Error renaming tag: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if alias := strings.TrimSpace(req.FormValue("alias")); alias != "" && alias != tag.Name {
+		var existing TagAlias
+		db.Where("name = ?", alias).First(&existing)
+		existing.TagID = tag.ID
+		existing.Name = alias
+		db.Save(&existing)
+	}
+
+	http.Redirect(res, req, "/tags_list.html#tag-"+strconv.Itoa(int(tag.ID)), http.StatusFound)
+}
+
+// tagsMergeHandler merge the selected tags in the tag to keep
+func tagsMergeHandler(res http.ResponseWriter, req *http.Request) {
+	var keep Tag
+
+	keepID, _ := strconv.ParseInt(req.FormValue("keep"), 10, 64)
+	db.First(&keep, keepID)
+	if keep.ID == 0 {
+		http.Error(res, "Error merging tags: choose the tag to keep", http.StatusBadRequest)
+		return
+	}
+
+	req.ParseForm()
+	for _, value := range req.Form["tags"] {
+		var other Tag
+		otherID, _ := strconv.ParseInt(value, 10, 64)
+		db.First(&other, otherID)
+		if other.ID == 0 {
+			continue
+		}
+		if err := mergeTags(keep, other); err != nil {
+			http.Error(res, "Error merging tags: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	http.Redirect(res, req, "/tags_list.html#tag-"+strconv.Itoa(int(keep.ID)), http.StatusFound)
+}
+
+func tagAliasDeleteHandler(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	aliasID, _ := strconv.ParseInt(vars["alias"], 10, 64)
+
+	tagID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.Unscoped().Where("tag_id = ?", tagID).Delete(&TagAlias{}, aliasID)
+
+	http.Redirect(res, req, "/tags_list.html#tag-"+vars["id"], http.StatusFound)
+}
+
+func tagDelete(res http.ResponseWriter, req *http.Request) {
+	var tag Tag
+
+	vars := mux.Vars(req)
+	tagID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.First(&tag, tagID)
+
+	if tag.ID != 0 {
+		deleteTag(tag)
+	}
+	http.Redirect(res, req, "/tags_list.html", http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	sessions "github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/pkger"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultUserName = "opds"
+
+// User store a reader account
+type User struct {
+	gorm.Model
+	Name         string `gorm:"unique_index"`
+	PasswordHash string
+	// SyncKeyHash is the bcrypt hash of the md5 of the password, the key sent by KOReader
+	SyncKeyHash string
+	Admin       bool
+}
+
+// UserBook store the reading state of a book for a user
+type UserBook struct {
+	gorm.Model
+	UserID   uint `gorm:"unique_index:idx_user_book"`
+	BookID   uint `gorm:"unique_index:idx_user_book"`
+	Favorite bool
+	Read     bool
+	Progress float32
+	Position string
+	ReadAt   *time.Time
+	// Device is the name of the reader which sent the progress
+	Device     string
+	ProgressAt *time.Time
+}
+
+// SetPassword store the bcrypt hash of the password, an empty password remove it
+func (user *User) SetPassword(password string) error {
+	if password == "" {
+		user.PasswordHash = ""
+		user.SyncKeyHash = ""
+		return nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = string(hash)
+	syncHash, err := bcrypt.GenerateFromPassword([]byte(md5Hex(password)), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.SyncKeyHash = string(syncHash)
+	return nil
+}
+
+// CheckPassword compare the password with the stored hash
+func (user *User) CheckPassword(password string) bool {
+	if user.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+}
+
+// setupUsers create the default admin user from the old single password and
+// move the favorite and read flags of books to this user
+func setupUsers(serverOption *ServerOption) {
+	var count int
+	var user User
+
+	db.Model(&User{}).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	user.Name = defaultUserName
+	user.Admin = true
+	user.SetPassword(serverOption.Password)
+	db.Save(&user)
+	fmt.Println("created user " + user.Name)
+	if serverOption.Token != "" {
+		db.Save(&ClientToken{UserID: user.ID, Name: "OPDS", Token: serverOption.Token})
+	}
+
+	rows, err := db.Raw("SELECT id, COALESCE(favorite, 0), COALESCE(read, 0) FROM books WHERE deleted_at IS NULL AND (favorite = 1 OR read = 1)").Rows()
+	if err != nil {
+		// new database, books never had these columns
+		return
+	}
+	defer rows.Close()
+
+	var userBooks []UserBook
+	for rows.Next() {
+		var userBook UserBook
+		rows.Scan(&userBook.BookID, &userBook.Favorite, &userBook.Read)
+		userBook.UserID = user.ID
+		userBooks = append(userBooks, userBook)
+	}
+	rows.Close()
+	for _, userBook := range userBooks {
+		db.Save(&userBook)
+	}
+}
+
+// authRequired return true when at least one user has a password
+func authRequired() bool {
+	var count int
+
+	db.Model(&User{}).Where("password_hash <> ''").Count(&count)
+	return count > 0
+}
+
+// adminHasPassword return true when at least one admin can log in
+func adminHasPassword() bool {
+	var count int
+
+	db.Model(&User{}).Where("admin = ? and password_hash <> ''", true).Count(&count)
+	return count > 0
+}
+
+// defaultUser return the first admin, used when authentication is disabled
+func defaultUser() User {
+	var user User
+
+	db.Where("admin = ?", true).Order("id asc").First(&user)
+	return user
+}
+
+// sessionUser return the user logged in the session
+func sessionUser(req *http.Request) User {
+	var user User
+
+	session := sessions.GetSession(req)
+	userID, ok := session.Get("user_id").(uint)
+	if ok && userID != 0 {
+		db.First(&user, userID)
+	}
+	return user
+}
+
+// currentUser return the user authenticated by the auth middleware
+func currentUser(req *http.Request) User {
+	user, ok := req.Context().Value(userContextKey).(User)
+	if !ok {
+		return defaultUser()
+	}
+	return user
+}
+
+// userBook return the reading state of the book for the user
+func userBook(userID uint, bookID uint) UserBook {
+	var state UserBook
+
+	db.Where("user_id = ? AND book_id = ?", userID, bookID).First(&state)
+	state.UserID = userID
+	state.BookID = bookID
+	return state
+}
+
+// loadUserState fill the favorite and read flags of the book for the user
+func (book *Book) loadUserState(userID uint) {
+	state := userBook(userID, book.ID)
+	book.Favorite = state.Favorite
+	book.Read = state.Read
+	book.Progress = state.Progress
+	book.ProgressDevice = state.Device
+}
+
+// loadUserStates fill the reading state of a list of books for the user with one query
+func loadUserStates(books []Book, userID uint) {
+	var states []UserBook
+	var ids []uint
+
+	for _, book := range books {
+		ids = append(ids, book.ID)
+	}
+	db.Where("user_id = ? AND book_id IN (?)", userID, ids).Find(&states)
+	byBook := map[uint]UserBook{}
+	for _, state := range states {
+		byBook[state.BookID] = state
+	}
+	for i := range books {
+		state := byBook[books[i].ID]
+		books[i].Favorite = state.Favorite
+		books[i].Read = state.Read
+		books[i].Progress = state.Progress
+		books[i].ProgressDevice = state.Device
+	}
+}
+
+// ProgressPercent return the reading progress of the book in percent
+func (book Book) ProgressPercent() int {
+	return int(book.Progress*100 + 0.5)
+}
+
+func usersHandler(res http.ResponseWriter, req *http.Request) {
+	var users []User
+	var serverOption ServerOption
+
+	db.First(&serverOption)
+	user := currentUser(req)
+
+	if req.Method == http.MethodPost {
+		var editedUser User
+
+		name := req.FormValue("name")
+		if name == "" {
+			http.Error(res, "Name is required", http.StatusBadRequest)
+			return
+		}
+		if !user.Admin && name != user.Name {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+			return
+		}
+		db.Where("name = ?", name).First(&editedUser)
+		editedUser.Name = name
+		if user.Admin {
+			editedUser.Admin = req.FormValue("admin") == "on" || editedUser.ID == user.ID
+		}
+		password := req.FormValue("password")
+		if password == "" && editedUser.ID == 0 {
+			http.Error(res, "Password is required", http.StatusBadRequest)
+			return
+		}
+		// the first password enable the authentication, an admin without password would be locked out
+		if password != "" && !editedUser.Admin && !adminHasPassword() {
+			http.Error(res, "An admin must have a password first", http.StatusBadRequest)
+			return
+		}
+		if password != "" {
+			editedUser.SetPassword(password)
+			clearBasicAuthCache()
+		}
+		db.Save(&editedUser)
+
+		res.Header().Set("Location", "/users.html")
+		res.WriteHeader(302)
+		return
+	}
+
+	if user.Admin {
+		db.Order("name asc").Find(&users)
+	} else {
+		users = append(users, user)
+	}
+
+	usersTemplate := template.Must(layout.Clone()).Funcs(csrfFuncs(req))
+	templateFile, _ := pkger.Open("/template/users.html")
+	templateData, _ := ioutil.ReadAll(templateFile)
+	usersTemplate = template.Must(usersTemplate.Parse(string(templateData)))
+	usersTemplate.Execute(res, Page{Content: users, Title: serverOption.Name})
+}
+
+func userDeleteHandler(res http.ResponseWriter, req *http.Request) {
+	var deletedUser User
+
+	user := currentUser(req)
+	if !user.Admin {
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(req)
+	userID, _ := strconv.ParseInt(vars["id"], 10, 64)
+
+	db.First(&deletedUser, userID)
+	if deletedUser.ID != 0 && deletedUser.ID != user.ID {
+		db.Unscoped().Where("user_id = ?", deletedUser.ID).Delete(UserBook{})
+		db.Unscoped().Delete(&deletedUser)
+	}
+	http.Redirect(res, req, "/users.html", http.StatusTemporaryRedirect)
+}